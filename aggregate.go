@@ -0,0 +1,172 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+/*
+
+	Aggregate saves writing the same loop over Filter results every time. The entries are
+	grouped by the values of the by labels, so grouping by "service" gives one result per
+	service, and each group is combined into a single float64. Grouping by nothing combines
+	everything into one result with an empty Key.
+
+	The Key of each result only has the by labels. An entry without one of them goes into
+	the group where that label is missing, the same way Prometheus' sum by (...) works.
+
+	Any int, uint or float type works as a value, as do Counters and Gauges. Count counts
+	entries so it works with any value.
+
+*/
+
+var (
+	valueNotNumeric = errors.New("Value is not a number")
+)
+
+// AggregateOp is how the values in a group are combined
+type AggregateOp int
+
+const (
+	// AggregateSum adds the values up
+	AggregateSum AggregateOp = iota
+	// AggregateAvg is the mean of the values
+	AggregateAvg
+	// AggregateMin is the smallest value
+	AggregateMin
+	// AggregateMax is the largest value
+	AggregateMax
+	// AggregateCount is how many entries are in the group
+	AggregateCount
+)
+
+var aggregateOpNames = map[AggregateOp]string{
+	AggregateSum:   "sum",
+	AggregateAvg:   "avg",
+	AggregateMin:   "min",
+	AggregateMax:   "max",
+	AggregateCount: "count",
+}
+
+func (op AggregateOp) String() string {
+	if name, ok := aggregateOpNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("AggregateOp(%d)", int(op))
+}
+
+// Aggregate Filters r with k and combines the values of the entries with op, one result per group of by label values
+func Aggregate(r Registry, k Key, by []string, op AggregateOp) ([]Entry, error) {
+	return AggregateEntries(r.Filter(k), by, op)
+}
+
+// AggregateEntries combines the values of the entries with op, one result per group of by label values
+// The results are sorted by the by label values in the order the labels are given
+func AggregateEntries(entries []Entry, by []string, op AggregateOp) ([]Entry, error) {
+	if _, ok := aggregateOpNames[op]; !ok {
+		return nil, fmt.Errorf("Unknown aggregation %v", op)
+	}
+	groups := map[string]*aggregateGroup{}
+	for _, entry := range entries {
+		v := 0.0
+		if op != AggregateCount {
+			f, ok := numericValue(entry.Value)
+			if !ok {
+				return nil, fmt.Errorf("%w: %v holds a %T", valueNotNumeric, entry.Key, entry.Value)
+			}
+			v = f
+		}
+		k := projectKey(entry.Key, by)
+		hash := toHashString(k)
+		group, ok := groups[hash]
+		if !ok {
+			group = &aggregateGroup{key: k}
+			groups[hash] = group
+		}
+		group.add(v)
+	}
+
+	results := make([]Entry, 0, len(groups))
+	for _, group := range groups {
+		results = append(results, Entry{
+			Key:   group.key,
+			Value: group.result(op),
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return lessByLabels(results[i].Key, results[j].Key, by)
+	})
+	return results, nil
+}
+
+// aggregateGroup keeps what every op needs so values only have to be looked at once
+type aggregateGroup struct {
+	key   Key
+	count int
+	sum   float64
+	min   float64
+	max   float64
+}
+
+func (g *aggregateGroup) add(v float64) {
+	if g.count == 0 || v < g.min {
+		g.min = v
+	}
+	if g.count == 0 || v > g.max {
+		g.max = v
+	}
+	g.count++
+	g.sum += v
+}
+
+func (g *aggregateGroup) result(op AggregateOp) float64 {
+	switch op {
+	case AggregateAvg:
+		return g.sum / float64(g.count)
+	case AggregateMin:
+		return g.min
+	case AggregateMax:
+		return g.max
+	case AggregateCount:
+		return float64(g.count)
+	}
+	return g.sum
+}
+
+// numericValue converts the numeric types, Counters and Gauges to a float64
+func numericValue(i interface{}) (float64, bool) {
+	switch v := i.(type) {
+	case *Counter:
+		return float64(v.Value()), true
+	case *Gauge:
+		return v.Value(), true
+	}
+	return toFloat64(i)
+}
+
+// projectKey returns a Key with only the by labels of k
+func projectKey(k Key, by []string) Key {
+	projected := Key{}
+	for _, name := range by {
+		if value, ok := k[name]; ok {
+			projected[name] = value
+		}
+	}
+	return projected
+}
+
+// lessByLabels compares the by labels one at a time, a missing label comes before any value
+func lessByLabels(a Key, b Key, by []string) bool {
+	for _, name := range by {
+		av, aok := a[name]
+		bv, bok := b[name]
+		if aok != bok {
+			return !aok
+		}
+		if av != bv {
+			return av < bv
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+// +build all unit
+
+package registry
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Aggregation", func() {
+	Describe("Given entries with numeric values", func() {
+		var r Registry
+		BeforeEach(func() {
+			r = NewCacheRegistry(10)
+			r.Set(Key{"service": "api", "code": "200", "host": "a"}, 10)
+			r.Set(Key{"service": "api", "code": "500", "host": "a"}, int64(2))
+			r.Set(Key{"service": "api", "code": "200", "host": "b"}, 4.5)
+			r.Set(Key{"service": "db", "code": "200", "host": "c"}, uint8(7))
+			r.Set(Key{"code": "200", "host": "d"}, float32(1))
+		})
+		Context("When summing by a label", func() {
+			It("Then there should be one result per value of the label", func() {
+				results, err := Aggregate(r, Key{}, []string{"service"}, AggregateSum)
+				Expect(err).To(BeNil())
+				Expect(results).To(Equal([]Entry{
+					{Key: Key{}, Value: 1.0},
+					{Key: Key{"service": "api"}, Value: 16.5},
+					{Key: Key{"service": "db"}, Value: 7.0},
+				}))
+			})
+		})
+		Context("When grouping by more than one label", func() {
+			It("Then the results should be sorted by the labels in order", func() {
+				results, err := Aggregate(r, Key{"code": "200"}, []string{"service", "host"}, AggregateCount)
+				Expect(err).To(BeNil())
+				Expect(results).To(Equal([]Entry{
+					{Key: Key{"host": "d"}, Value: 1.0},
+					{Key: Key{"service": "api", "host": "a"}, Value: 1.0},
+					{Key: Key{"service": "api", "host": "b"}, Value: 1.0},
+					{Key: Key{"service": "db", "host": "c"}, Value: 1.0},
+				}))
+			})
+		})
+		Context("When not grouping at all", func() {
+			It("Then every op should combine all of the filtered entries", func() {
+				for op, expected := range map[AggregateOp]float64{
+					AggregateSum:   16.5,
+					AggregateAvg:   5.5,
+					AggregateMin:   2,
+					AggregateMax:   10,
+					AggregateCount: 3,
+				} {
+					results, err := Aggregate(r, Key{"service": "api"}, nil, op)
+					Expect(err).To(BeNil(), op.String())
+					Expect(results).To(Equal([]Entry{{Key: Key{}, Value: expected}}), op.String())
+				}
+			})
+		})
+		Context("When nothing matches the filter", func() {
+			It("Then there should be no results", func() {
+				results, err := Aggregate(r, Key{"service": "cache"}, []string{"service"}, AggregateSum)
+				Expect(err).To(BeNil())
+				Expect(results).To(BeEmpty())
+			})
+		})
+		Context("When the values are Counters and Gauges", func() {
+			It("Then their current values should be used", func() {
+				c := NewCounter()
+				c.Add(3)
+				g := NewGauge()
+				g.Set(-1.5)
+				r.Set(Key{"service": "cache", "kind": "counter"}, c)
+				r.Set(Key{"service": "cache", "kind": "gauge"}, g)
+				results, err := Aggregate(r, Key{"service": "cache"}, []string{"service"}, AggregateMax)
+				Expect(err).To(BeNil())
+				Expect(results).To(Equal([]Entry{{Key: Key{"service": "cache"}, Value: 3.0}}))
+			})
+		})
+	})
+	Describe("Given an entry that isn't a number", func() {
+		entries := []Entry{
+			{Key: Key{"service": "api"}, Value: 1},
+			{Key: Key{"service": "api", "host": "a"}, Value: "lots"},
+		}
+		Context("When it is summed", func() {
+			It("Then the error should say which Key and what type it holds", func() {
+				_, err := AggregateEntries(entries, []string{"service"}, AggregateSum)
+				Expect(errors.Is(err, valueNotNumeric)).To(BeTrue())
+				Expect(err.Error()).To(ContainSubstring("holds a string"))
+				Expect(err.Error()).To(ContainSubstring("host:a"))
+			})
+		})
+		Context("When it is counted", func() {
+			It("Then the value shouldn't matter", func() {
+				results, err := AggregateEntries(entries, []string{"service"}, AggregateCount)
+				Expect(err).To(BeNil())
+				Expect(results).To(Equal([]Entry{{Key: Key{"service": "api"}, Value: 2.0}}))
+			})
+		})
+	})
+	Describe("Given an op that doesn't exist", func() {
+		It("Then it should be an error", func() {
+			_, err := AggregateEntries(nil, nil, AggregateOp(42))
+			Expect(err).To(MatchError("Unknown aggregation AggregateOp(42)"))
+		})
+	})
+})
@@ -0,0 +1,188 @@
+package registry
+
+import "container/list"
+
+/*
+
+	ARCCache is the Adaptive Replacement Cache from Megiddo and Modha. It keeps two LRU lists,
+	recent for items that were only used once and frequent for items that were used again,
+	and a ghost list for each with the hashes of the items they evicted but not the values.
+	Adding an item that is in a ghost list means that list was evicting too early, so the
+	target size of recent moves towards it. A scan of items that are never used again only
+	goes through recent and can't push out what is in frequent.
+
+	Only Gets count as a use. Updating an item that is already there only replaces its value.
+	The lists are sized as if nothing is ever removed, so after a RemoveWithHash nothing is
+	evicted until the cache is full again.
+
+*/
+
+// ARCCache is a Cache that balances between evicting the least recently and least frequently used item
+type ARCCache struct {
+	items          map[string]*cacheItem // Every item in all four lists by hash
+	recent         *list.List            // Items used once, most recently used at the front
+	frequent       *list.List            // Items used more than once, most recently used at the front
+	recentGhosts   *list.List            // Hashes evicted from recent
+	frequentGhosts *list.List            // Hashes evicted from frequent
+	target         int                   // How big recent should be
+	maxSize        int                   // Max size of cache
+	stats          CacheStats
+}
+
+func NewARCCache(maxSize int) *ARCCache {
+	return &ARCCache{
+		items:          map[string]*cacheItem{},
+		recent:         list.New(),
+		frequent:       list.New(),
+		recentGhosts:   list.New(),
+		frequentGhosts: list.New(),
+		maxSize:        maxSize,
+	}
+}
+
+// GetWithKey gets a value from the cache that matches complete key
+func (c *ARCCache) GetWithKey(k Key) (interface{}, error) {
+	return c.GetWithHash(toHashString(k))
+}
+
+// GetWithHash gets a value from the cache that matches the hashstring and moves it to frequent
+func (c *ARCCache) GetWithHash(h string) (interface{}, error) {
+	item, ok := c.items[h]
+	ok = ok && c.cached(item)
+	c.stats.record(ok)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	moveToFront(item, c.frequent)
+	return item.value, nil
+}
+
+// hitWithHashBytes gets a value the cache has and moves it to frequent without making a string of the hash
+// A ghost is a miss, so it is left for GetWithHash
+func (c *ARCCache) hitWithHashBytes(h []byte) (interface{}, bool) {
+	item, ok := c.items[string(h)]
+	if !ok || !c.cached(item) {
+		return nil, false
+	}
+	i, err := c.GetWithHash(item.hash)
+	return i, err == nil
+}
+
+// PeekWithHash gets a value from the cache without counting it as a use or in the stats
+func (c *ARCCache) PeekWithHash(h string) (interface{}, error) {
+	if item, ok := c.items[h]; ok && c.cached(item) {
+		return item.value, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// UpdateWithKey adds a value to the cache. If cache size will be exceed, a value is removed and also returned
+func (c *ARCCache) UpdateWithKey(k Key, i interface{}) (cacheItemRemoved bool, cacheKeyRemoved string, cacheValueRemoved interface{}) {
+	return c.UpdateWithHash(toHashString(k), i)
+}
+
+// UpdateWithHash adds a value to the cache. If cache size will be exceed, a value is removed and also returned
+func (c *ARCCache) UpdateWithHash(h string, i interface{}) (cacheItemRemoved bool, cacheKeyRemoved string, cacheValueRemoved interface{}) {
+	item, ok := c.items[h]
+	if ok && c.cached(item) {
+		item.value = i
+		return false, "", nil
+	}
+	if c.maxSize <= 0 {
+		return true, h, i
+	}
+	switch {
+	case ok && item.list == c.recentGhosts:
+		// recent evicted it too early so it should be bigger
+		c.target += c.ratio(c.frequentGhosts, c.recentGhosts)
+		if c.target > c.maxSize {
+			c.target = c.maxSize
+		}
+		cacheItemRemoved, cacheKeyRemoved, cacheValueRemoved = c.replace(false)
+	case ok && item.list == c.frequentGhosts:
+		// frequent evicted it too early so recent should be smaller
+		c.target -= c.ratio(c.recentGhosts, c.frequentGhosts)
+		if c.target < 0 {
+			c.target = 0
+		}
+		cacheItemRemoved, cacheKeyRemoved, cacheValueRemoved = c.replace(true)
+	default:
+		cacheItemRemoved, cacheKeyRemoved, cacheValueRemoved = c.makeRoom()
+		item = &cacheItem{hash: h}
+		c.items[h] = item
+	}
+	item.value = i
+	if ok {
+		moveToFront(item, c.frequent)
+	} else {
+		moveToFront(item, c.recent)
+	}
+	return cacheItemRemoved, cacheKeyRemoved, cacheValueRemoved
+}
+
+// Stats returns how many Gets were hits and misses
+func (c *ARCCache) Stats() CacheStats {
+	return c.stats
+}
+
+func (c *ARCCache) RemoveWithHash(h string) {
+	if item, ok := c.items[h]; ok {
+		removeFromList(item)
+		delete(c.items, h)
+	}
+}
+
+// cached is whether the item has a value and isn't just a ghost
+func (c *ARCCache) cached(item *cacheItem) bool {
+	return item.list == c.recent || item.list == c.frequent
+}
+
+// ratio is how much to move the target by, at least one
+func (c *ARCCache) ratio(other *list.List, ghosts *list.List) int {
+	if other.Len() > ghosts.Len() {
+		return other.Len() / ghosts.Len()
+	}
+	return 1
+}
+
+// makeRoom makes room for an item that isn't in any list
+func (c *ARCCache) makeRoom() (bool, string, interface{}) {
+	recentSize := c.recent.Len() + c.recentGhosts.Len()
+	if recentSize >= c.maxSize {
+		if c.recent.Len() < c.maxSize {
+			c.forgetOldest(c.recentGhosts)
+			return c.replace(false)
+		}
+		// recent is the whole cache so its oldest is dropped without leaving a ghost
+		oldest := c.recent.Back().Value.(*cacheItem)
+		c.RemoveWithHash(oldest.hash)
+		return true, oldest.hash, oldest.value
+	}
+	if recentSize+c.frequent.Len()+c.frequentGhosts.Len() >= 2*c.maxSize {
+		c.forgetOldest(c.frequentGhosts)
+	}
+	return c.replace(false)
+}
+
+// replace evicts the oldest item from recent or frequent, leaving a ghost, if the cache is full
+func (c *ARCCache) replace(inFrequentGhosts bool) (bool, string, interface{}) {
+	if c.recent.Len()+c.frequent.Len() < c.maxSize {
+		return false, "", nil
+	}
+	from, ghosts := c.frequent, c.frequentGhosts
+	if c.frequent.Len() == 0 || c.recent.Len() > 0 && (c.recent.Len() > c.target || inFrequentGhosts && c.recent.Len() == c.target) {
+		from, ghosts = c.recent, c.recentGhosts
+	}
+	oldest := from.Back().Value.(*cacheItem)
+	value := oldest.value
+	oldest.value = nil
+	moveToFront(oldest, ghosts)
+	return true, oldest.hash, value
+}
+
+// forgetOldest drops the oldest ghost
+func (c *ARCCache) forgetOldest(ghosts *list.List) {
+	if ghosts.Len() > 0 {
+		c.RemoveWithHash(ghosts.Back().Value.(*cacheItem).hash)
+	}
+}
@@ -1,150 +1,263 @@
-package registry
-
-/*
-
-	Seeing that using keys and their values are usually repeated, we can take
-	advantage of this by using maps to perhaps speed up the key search. The performance
-	here is a little bit harder to calculate and is also based upon uniqueness of keys. This
-	should be faster than simpleRegistry, but by how much? Probably need some perf tests.
-
-*/
-
-// BetterRegistry is a better implmentation of registry .. but is it really better?
-type BetterRegistry struct {
-	registry map[string]values
-}
-type values map[string]entries
-type entries []*Entry
-
-func NewBetterRegistry() *BetterRegistry {
-	return &BetterRegistry{
-		registry: map[string]values{},
-	}
-}
-
-func (b *BetterRegistry) Get(k Key) interface{} {
-	entry := getEntryWithKey(b.registry, k)
-	if entry == nil {
-		return nil
-	}
-	return entry.Value
-}
-
-func (b *BetterRegistry) Filter(k Key) []Entry {
-	entriesWithKey := getEntriesContainKey(b.registry, k)
-	entries := []Entry{}
-	for _, entry := range entriesWithKey {
-		entries = append(entries, *entry)
-	}
-	return entries
-}
-
-func (b *BetterRegistry) Set(k Key, i interface{}) {
-	entryWithKey := getEntryWithKey(b.registry, k)
-	if entryWithKey != nil {
-		entryWithKey.Value = i
-	} else {
-		entryWithKey = &Entry{
-			Key:   k,
-			Value: i,
-		}
-		addEntry(b.registry, entryWithKey)
-
-	}
-}
-
-func (b *BetterRegistry) Delete(k Key) {
-	entriesWithKey := getEntryWithKey(b.registry, k)
-	if entriesWithKey == nil {
-		return
-	}
-	removeEntry(b.registry, entriesWithKey)
-}
-
-func addEntry(r map[string]values, e *Entry) {
-	for key, value := range e.Key {
-		_, ok := r[key]
-		if !ok {
-			r[key] = values{}
-		}
-		r[key][value] = append(r[key][value], e)
-	}
-}
-
-func removeEntry(r map[string]values, e *Entry) {
-	for key, value := range e.Key {
-		if _, ok := r[key]; !ok {
-			return
-		}
-		entries, ok := r[key][value]
-		if !ok {
-			return
-		}
-		for i, entry := range entries {
-			if entry == e {
-				r[key][value] = append(r[key][value][:i], r[key][value][i+1:]...)
-				break
-			}
-		}
-		if len(r[key][value]) == 0 {
-			delete(r[key], value)
-		}
-		if len(r[key]) == 0 {
-			delete(r, key)
-		}
-	}
-}
-
-// getEntryWithKey returns the Entry that has the exact Key
-func getEntryWithKey(r map[string]values, k Key) *Entry {
-	entriesWithKey := getEntriesContainKey(r, k)
-	for _, entry := range entriesWithKey {
-		if len(entry.Key) == len(k) {
-			return entry
-		}
-	}
-	return nil
-}
-
-// getEntriesContainKey returns all entries that contain all the key value pairs in Key
-func getEntriesContainKey(r map[string]values, k Key) entries {
-	entriesThatContainKey := []entries{}
-	for key, value := range k {
-		entriesWithAKey := getEntriesWithAKey(r, key, value)
-		if len(entriesWithAKey) == 0 {
-			return entries{}
-		}
-		entriesThatContainKey = append(entriesThatContainKey, entriesWithAKey)
-	}
-	return findUnionOfEntires(entriesThatContainKey)
-}
-
-// findUnionOfEntires returns a list of entries that are commom between all arrays of entries
-func findUnionOfEntires(es []entries) entries {
-	m := map[*Entry]int{}
-	for _, e := range es {
-		for _, entry := range e {
-			m[entry]++
-		}
-	}
-	entries := entries{}
-	for e, count := range m {
-		if count == len(es) {
-			entries = append(entries, e)
-		}
-	}
-	return entries
-}
-
-// getEntriesWithAKey returns all entires that has this key value pair in the Key
-func getEntriesWithAKey(r map[string]values, k string, v string) entries {
-	values, ok := r[k]
-	if !ok {
-		return entries{}
-	}
-	entriesWithKey, ok := values[v]
-	if !ok {
-		return entries{}
-	}
-	return entriesWithKey
-}
+package registry
+
+/*
+
+	Seeing that using keys and their values are usually repeated, we can take
+	advantage of this by using maps to perhaps speed up the key search. The performance
+	here is a little bit harder to calculate and is also based upon uniqueness of keys. This
+	should be faster than simpleRegistry, but by how much? Probably need some perf tests.
+
+*/
+
+// BetterRegistry is a better implmentation of registry .. but is it really better?
+type BetterRegistry struct {
+	registry   map[string]values
+	unlabelled *Entry // The Entry with the empty Key. It has no key value pairs to be found under in registry
+}
+type values map[string]entries
+type entries []*Entry
+
+func NewBetterRegistry() *BetterRegistry {
+	return &BetterRegistry{
+		registry: map[string]values{},
+	}
+}
+
+func (b *BetterRegistry) Get(k Key) interface{} {
+	i, _ := b.TryGet(k)
+	return i
+}
+
+// Lookup returns the value at k and whether there is an entry at k
+func (b *BetterRegistry) Lookup(k Key) (interface{}, bool) {
+	i, err := b.TryGet(k)
+	return i, err == nil
+}
+
+// TryGet returns the value at k or ErrKeyNotFound
+func (b *BetterRegistry) TryGet(k Key) (interface{}, error) {
+	entry := b.getEntry(k)
+	if entry == nil {
+		return nil, ErrKeyNotFound
+	}
+	return entry.Value, nil
+}
+
+func (b *BetterRegistry) Filter(k Key) []Entry {
+	entriesWithKey := getEntriesContainKey(b.registry, k)
+	if len(k) == 0 && b.unlabelled != nil {
+		entriesWithKey = append(entriesWithKey, b.unlabelled)
+	}
+	entries := []Entry{}
+	for _, entry := range entriesWithKey {
+		entries = append(entries, *entry)
+	}
+	return entries
+}
+
+// FilterMatchers returns every entry whose Key satisfies all the matchers. Equal matchers are looked up in
+// the index, or if there are none, a Present matcher is. The rest are checked against what is left
+func (b *BetterRegistry) FilterMatchers(ms ...Matcher) []Entry {
+	k := equalKey(ms)
+	var candidates entries
+	if name, ok := firstPresentName(ms); ok && len(k) == 0 {
+		// An entry is only under one value of a key so there is nothing to dedupe
+		candidates = entries{}
+		for _, entriesWithKey := range b.registry[name] {
+			candidates = append(candidates, entriesWithKey...)
+		}
+	} else {
+		candidates = getEntriesContainKey(b.registry, k)
+		if len(k) == 0 && b.unlabelled != nil {
+			candidates = append(candidates, b.unlabelled)
+		}
+	}
+	entries := []Entry{}
+	for _, entry := range candidates {
+		if matchesAll(entry.Key, ms) {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries
+}
+
+func (b *BetterRegistry) Set(k Key, i interface{}) {
+	b.TrySet(k, i)
+}
+
+// TrySet is Set, it never fails
+func (b *BetterRegistry) TrySet(k Key, i interface{}) error {
+	entryWithKey, _ := b.getOrAdd(k)
+	entryWithKey.Value = i
+	return nil
+}
+
+// Update replaces the value at k with what fn returns, creating the entry if needed
+func (b *BetterRegistry) Update(k Key, fn func(old interface{}) interface{}) {
+	entry, _ := b.getOrAdd(k)
+	entry.Value = fn(entry.Value)
+}
+
+// GetOrCreate returns the value at k or creates the entry with the value from create
+func (b *BetterRegistry) GetOrCreate(k Key, create func() interface{}) (interface{}, bool) {
+	entry, created := b.getOrAdd(k)
+	if created {
+		entry.Value = create()
+	}
+	return entry.Value, created
+}
+
+// getOrAdd returns the Entry with the exact Key, adding an empty one if there is none
+func (b *BetterRegistry) getOrAdd(k Key) (*Entry, bool) {
+	entry := b.getEntry(k)
+	if entry != nil {
+		return entry, false
+	}
+	entry = &Entry{
+		Key: copyKey(k),
+	}
+	if len(k) == 0 {
+		b.unlabelled = entry
+	} else {
+		addEntry(b.registry, entry)
+	}
+	return entry, true
+}
+
+// getEntry returns the Entry with the exact Key, including the one with the empty Key
+func (b *BetterRegistry) getEntry(k Key) *Entry {
+	if len(k) == 0 {
+		return b.unlabelled
+	}
+	return getEntryWithKey(b.registry, k)
+}
+
+func (b *BetterRegistry) Delete(k Key) {
+	b.TryDelete(k)
+}
+
+// TryDelete removes the entry at k or returns ErrKeyNotFound if there is none
+func (b *BetterRegistry) TryDelete(k Key) error {
+	if len(k) == 0 {
+		if b.unlabelled == nil {
+			return ErrKeyNotFound
+		}
+		b.unlabelled = nil
+		return nil
+	}
+	entriesWithKey := getEntryWithKey(b.registry, k)
+	if entriesWithKey == nil {
+		return ErrKeyNotFound
+	}
+	removeEntry(b.registry, entriesWithKey)
+	return nil
+}
+
+func addEntry(r map[string]values, e *Entry) {
+	for key, value := range e.Key {
+		_, ok := r[key]
+		if !ok {
+			r[key] = values{}
+		}
+		r[key][value] = append(r[key][value], e)
+	}
+}
+
+func removeEntry(r map[string]values, e *Entry) {
+	for key, value := range e.Key {
+		if _, ok := r[key]; !ok {
+			continue
+		}
+		entries, ok := r[key][value]
+		if !ok {
+			continue
+		}
+		for i, entry := range entries {
+			if entry == e {
+				r[key][value] = append(r[key][value][:i], r[key][value][i+1:]...)
+				break
+			}
+		}
+		if len(r[key][value]) == 0 {
+			delete(r[key], value)
+		}
+		if len(r[key]) == 0 {
+			delete(r, key)
+		}
+	}
+}
+
+// getEntryWithKey returns the Entry that has the exact Key
+func getEntryWithKey(r map[string]values, k Key) *Entry {
+	entriesWithKey := getEntriesContainKey(r, k)
+	for _, entry := range entriesWithKey {
+		if len(entry.Key) == len(k) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// getEntriesContainKey returns all entries that contain all the key value pairs in Key
+// Every entry contains the empty Key so that returns everything
+func getEntriesContainKey(r map[string]values, k Key) entries {
+	if len(k) == 0 {
+		return getAllEntries(r)
+	}
+	entriesThatContainKey := []entries{}
+	for key, value := range k {
+		entriesWithAKey := getEntriesWithAKey(r, key, value)
+		if len(entriesWithAKey) == 0 {
+			return entries{}
+		}
+		entriesThatContainKey = append(entriesThatContainKey, entriesWithAKey)
+	}
+	return findUnionOfEntires(entriesThatContainKey)
+}
+
+// findUnionOfEntires returns a list of entries that are commom between all arrays of entries
+func findUnionOfEntires(es []entries) entries {
+	m := map[*Entry]int{}
+	for _, e := range es {
+		for _, entry := range e {
+			m[entry]++
+		}
+	}
+	entries := entries{}
+	for e, count := range m {
+		if count == len(es) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// getAllEntries returns every entry once, even though each entry is in the registry once per key
+func getAllEntries(r map[string]values) entries {
+	seen := map[*Entry]bool{}
+	entries := entries{}
+	for _, values := range r {
+		for _, entriesWithKey := range values {
+			for _, entry := range entriesWithKey {
+				if !seen[entry] {
+					seen[entry] = true
+					entries = append(entries, entry)
+				}
+			}
+		}
+	}
+	return entries
+}
+
+// getEntriesWithAKey returns all entires that has this key value pair in the Key
+func getEntriesWithAKey(r map[string]values, k string, v string) entries {
+	values, ok := r[k]
+	if !ok {
+		return entries{}
+	}
+	entriesWithKey, ok := values[v]
+	if !ok {
+		return entries{}
+	}
+	return entriesWithKey
+}
@@ -1,118 +1,210 @@
-package registry
-
-import (
-	"encoding/base64"
-	"sort"
-)
-
-const (
-	hashKeyValueDelimiter = ":"
-	hashKeyDelimiter      = ","
-)
-
-type Cache interface {
-	GetWithKey(k Key) (interface{}, error)
-	GetWithHash(h string) (interface{}, error)
-	UpdateWithKey(k Key, i interface{}) (cacheItemRemoved bool, cacheKeyRemoved string, cacheValueRemoved interface{})
-	UpdateWithHash(h string, i interface{}) (cacheItemRemoved bool, cacheKeyRemoved string, cacheValueRemoved interface{})
-	RemoveWithHash(h string)
-}
-
-// SimpleCache will store commomly requested Keys and the associated Entries that have those keys
-// The Entries will contain at least the Key BUT could have more than the specified keys
-type SimpleCache struct {
-	cache      map[string]interface{} // Caches something based on hashed string
-	recentKeys []string               // In sync with the cache to keep track of cache entry recency
-	maxSize    int                    // Max size of cache
-}
-
-func NewSimpleCache(maxSize int) *SimpleCache {
-	return &SimpleCache{
-		cache:      map[string]interface{}{},
-		recentKeys: []string{}, // TODO: Could use make() to define length later
-		maxSize:    maxSize,
-	}
-}
-
-// GetWithKey gets a value from the cache that matches complete key
-func (c *SimpleCache) GetWithKey(k Key) (interface{}, error) {
-	hashString := toHashString(k)
-	return c.GetWithHash(hashString)
-
-}
-
-// GetWithHash gets a value from the cache that matches the hashstring
-func (c *SimpleCache) GetWithHash(h string) (interface{}, error) {
-	value := c.cache[h]
-	if value != nil {
-		return value, nil
-	}
-	return nil, keyNotFound
-}
-
-// UpdateWithKey adds a value to the cache. If cache size will be exceed, the oldest value is removed and also returned
-func (c *SimpleCache) UpdateWithKey(k Key, i interface{}) (cacheItemRemoved bool, cacheKeyRemoved string, cacheValueRemoved interface{}) {
-	return c.UpdateWithHash(toHashString(k), i)
-}
-
-// UpdateWithHash adds a value to the cache. If cache size will be exceed, the oldest value is removed and also returned
-func (c *SimpleCache) UpdateWithHash(h string, i interface{}) (cacheItemRemoved bool, cacheKeyRemoved string, cacheValueRemoved interface{}) {
-	if _, ok := c.cache[h]; ok {
-		c.RemoveWithHash(h)
-	}
-	c.cache[h] = i
-	c.addToRecentKeys(h)
-	return c.checkCacheSize()
-}
-
-func (c *SimpleCache) RemoveWithHash(h string) {
-	c.removeFromRecentKeys(h)
-	delete(c.cache, h)
-}
-
-// checkCacheSize checks if size has met maxSize and if so, remove oldest cache item
-// NOTE: This only removes ONE value ... in case of uncertain overage, use a loop
-func (c *SimpleCache) checkCacheSize() (exceeded bool, cacheKeyRemoved string, cacheValueRemoved interface{}) {
-	if len(c.cache) <= c.maxSize {
-		return false, "", nil
-	}
-	cacheKeyRemoved = c.recentKeys[0]
-	cacheValueRemoved = c.cache[cacheKeyRemoved]
-	c.RemoveWithHash(cacheKeyRemoved)
-	return true, cacheKeyRemoved, cacheValueRemoved
-}
-
-func (c *SimpleCache) removeFromRecentKeys(h string) {
-	for i, hash := range c.recentKeys {
-		if hash == h {
-			c.recentKeys = append(c.recentKeys[:i], c.recentKeys[i+1:]...)
-		}
-	}
-}
-
-func (c *SimpleCache) addToRecentKeys(h string) {
-	c.removeFromRecentKeys(h)
-	c.recentKeys = append(c.recentKeys, h)
-}
-
-func toHashString(k Key) string {
-	hash := ""
-	sortedKey := sortedKeys(k)
-	for _, key := range sortedKey {
-		encodedKey := base64.StdEncoding.EncodeToString([]byte(key))
-		encodedValue := base64.StdEncoding.EncodeToString([]byte(k[key]))
-		hash = hash + encodedKey + hashKeyValueDelimiter + encodedValue + hashKeyDelimiter
-	}
-	return hash
-}
-
-func sortedKeys(m map[string]string) []string {
-	keys := make([]string, len(m), len(m))
-	i := 0
-	for k := range m {
-		keys[i] = k
-		i++
-	}
-	sort.Strings(keys)
-	return keys
-}
+package registry
+
+import (
+	"container/list"
+	"sort"
+)
+
+type Cache interface {
+	GetWithKey(k Key) (interface{}, error)
+	GetWithHash(h string) (interface{}, error)
+	UpdateWithKey(k Key, i interface{}) (cacheItemRemoved bool, cacheKeyRemoved string, cacheValueRemoved interface{})
+	UpdateWithHash(h string, i interface{}) (cacheItemRemoved bool, cacheKeyRemoved string, cacheValueRemoved interface{})
+	RemoveWithHash(h string)
+}
+
+// CacheStats counts how often a cache had what was asked for
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// StatsCache is a Cache that counts its hits and misses
+type StatsCache interface {
+	Cache
+	Stats() CacheStats
+}
+
+// peeker is a Cache that can look at an item without it counting as a use or in its stats
+type peeker interface {
+	PeekWithHash(h string) (interface{}, error)
+}
+
+// peekWithHash looks at an item without it counting as a use if the cache can
+func peekWithHash(c Cache, h string) (interface{}, error) {
+	if p, ok := c.(peeker); ok {
+		return p.PeekWithHash(h)
+	}
+	return c.GetWithHash(h)
+}
+
+// hitter is a Cache that can answer a hit from the bytes of a hash without making a string of them
+// A miss isn't counted so it can be asked again with GetWithHash, which counts it
+type hitter interface {
+	hitWithHashBytes(h []byte) (interface{}, bool)
+}
+
+// hitWithHashBytes gets an item the cache has by the bytes of its hash, counting it like GetWithHash would, if the cache can
+func hitWithHashBytes(c Cache, h []byte) (interface{}, bool) {
+	if g, ok := c.(hitter); ok {
+		return g.hitWithHashBytes(h)
+	}
+	return nil, false
+}
+
+// hasHash is whether the cache has an item for the hash, without it counting as a use if the cache can
+func hasHash(c Cache, h string) bool {
+	_, err := peekWithHash(c, h)
+	return err == nil
+}
+
+func (s *CacheStats) record(hit bool) {
+	if hit {
+		s.Hits++
+	} else {
+		s.Misses++
+	}
+}
+
+// SimpleCache will store commomly requested Keys and the associated Entries that have those keys
+// The Entries will contain at least the Key BUT could have more than the specified keys
+type SimpleCache struct {
+	cache      map[string]interface{} // Caches something based on hashed string
+	recentKeys []string               // In sync with the cache to keep track of cache entry recency
+	maxSize    int                    // Max size of cache
+	stats      CacheStats
+}
+
+func NewSimpleCache(maxSize int) *SimpleCache {
+	return &SimpleCache{
+		cache:      map[string]interface{}{},
+		recentKeys: []string{}, // TODO: Could use make() to define length later
+		maxSize:    maxSize,
+	}
+}
+
+// GetWithKey gets a value from the cache that matches complete key
+func (c *SimpleCache) GetWithKey(k Key) (interface{}, error) {
+	hashString := toHashString(k)
+	return c.GetWithHash(hashString)
+
+}
+
+// GetWithHash gets a value from the cache that matches the hashstring
+func (c *SimpleCache) GetWithHash(h string) (interface{}, error) {
+	value := c.cache[h]
+	c.stats.record(value != nil)
+	if value != nil {
+		return value, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// hitWithHashBytes gets a value the cache has without making a string of the hash
+func (c *SimpleCache) hitWithHashBytes(h []byte) (interface{}, bool) {
+	value := c.cache[string(h)]
+	if value == nil {
+		return nil, false
+	}
+	c.stats.record(true)
+	return value, true
+}
+
+// PeekWithHash gets a value from the cache without counting it in the stats
+func (c *SimpleCache) PeekWithHash(h string) (interface{}, error) {
+	if value := c.cache[h]; value != nil {
+		return value, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// UpdateWithKey adds a value to the cache. If cache size will be exceed, the oldest value is removed and also returned
+func (c *SimpleCache) UpdateWithKey(k Key, i interface{}) (cacheItemRemoved bool, cacheKeyRemoved string, cacheValueRemoved interface{}) {
+	return c.UpdateWithHash(toHashString(k), i)
+}
+
+// UpdateWithHash adds a value to the cache. If cache size will be exceed, the oldest value is removed and also returned
+func (c *SimpleCache) UpdateWithHash(h string, i interface{}) (cacheItemRemoved bool, cacheKeyRemoved string, cacheValueRemoved interface{}) {
+	if _, ok := c.cache[h]; ok {
+		c.RemoveWithHash(h)
+	}
+	c.cache[h] = i
+	c.addToRecentKeys(h)
+	return c.checkCacheSize()
+}
+
+// Stats returns how many Gets were hits and misses
+func (c *SimpleCache) Stats() CacheStats {
+	return c.stats
+}
+
+func (c *SimpleCache) RemoveWithHash(h string) {
+	c.removeFromRecentKeys(h)
+	delete(c.cache, h)
+}
+
+// checkCacheSize checks if size has met maxSize and if so, remove oldest cache item
+// NOTE: This only removes ONE value ... in case of uncertain overage, use a loop (WeightedLRUCache does)
+func (c *SimpleCache) checkCacheSize() (exceeded bool, cacheKeyRemoved string, cacheValueRemoved interface{}) {
+	if len(c.cache) <= c.maxSize {
+		return false, "", nil
+	}
+	cacheKeyRemoved = c.recentKeys[0]
+	cacheValueRemoved = c.cache[cacheKeyRemoved]
+	c.RemoveWithHash(cacheKeyRemoved)
+	return true, cacheKeyRemoved, cacheValueRemoved
+}
+
+func (c *SimpleCache) removeFromRecentKeys(h string) {
+	for i, hash := range c.recentKeys {
+		if hash == h {
+			c.recentKeys = append(c.recentKeys[:i], c.recentKeys[i+1:]...)
+		}
+	}
+}
+
+func (c *SimpleCache) addToRecentKeys(h string) {
+	c.removeFromRecentKeys(h)
+	c.recentKeys = append(c.recentKeys, h)
+}
+
+// cacheItem is an item in one of the lists a cache keeps its items in
+type cacheItem struct {
+	hash    string
+	value   interface{}
+	count   int // How many times it was used, for the caches that count
+	list    *list.List
+	element *list.Element
+}
+
+// moveToFront moves the item to the front of l, taking it out of the list it was in
+func moveToFront(item *cacheItem, l *list.List) {
+	if item.list == l {
+		l.MoveToFront(item.element)
+		return
+	}
+	if item.list != nil {
+		item.list.Remove(item.element)
+	}
+	item.element = l.PushFront(item)
+	item.list = l
+}
+
+// removeFromList takes the item out of the list it is in
+func removeFromList(item *cacheItem) {
+	if item.list != nil {
+		item.list.Remove(item.element)
+		item.list, item.element = nil, nil
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, len(m), len(m))
+	i := 0
+	for k := range m {
+		keys[i] = k
+		i++
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,121 @@
+package registry
+
+import "sync/atomic"
+
+/*
+
+	There is no way to tell if the cacheSize given to NewCacheRegistry is too small without
+	counting what the caches do, so CachedRegistry counts for each of its caches:
+
+		hits           Gets or Filters the cache answered
+		misses         Gets or Filters that had to go to the registry
+		evictions      items the cache's policy removed to make room, or turned away
+		invalidations  items removed because the registry changed under them, a Delete for
+		               the get cache and a Delete or a new entry for the filter cache
+		size           items in the cache right now
+
+	The caches that come with the package count their own hits and misses in CacheStats too,
+	but those are plain counters only the cache touches, and a Cache from a CachePolicy of
+	your own might not count at all. CachedRegistry counts at the same calls so Stats works
+	with any policy. Its counters are atomic so a goroutine publishing them doesn't race the
+	one using the registry, for example while it only gets at it through a SafeRegistry.
+
+	PublishStats writes them into any registry, the CachedRegistry itself included, as
+	Counters and a Gauge labelled with the cache, so they can be exported like anything else.
+
+*/
+
+const (
+	// CacheLabel is the label that says which cache a published stat is for, "get" or "filter"
+	CacheLabel = "cache"
+
+	cacheHitsName          = "registry_cache_hits_total"
+	cacheMissesName        = "registry_cache_misses_total"
+	cacheEvictionsName     = "registry_cache_evictions_total"
+	cacheInvalidationsName = "registry_cache_invalidations_total"
+	cacheSizeName          = "registry_cache_size"
+)
+
+// CacheUsage is what happened in one of CachedRegistry's caches
+type CacheUsage struct {
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64
+	Invalidations uint64
+	Size          uint64
+}
+
+// CachedRegistryStats is what happened in both of CachedRegistry's caches
+type CachedRegistryStats struct {
+	Get    CacheUsage
+	Filter CacheUsage
+}
+
+// Stats returns what both caches did so far and how big they are
+func (c *CachedRegistry) Stats() CachedRegistryStats {
+	return CachedRegistryStats{
+		Get:    c.getUsage.load(),
+		Filter: c.filterUsage.load(),
+	}
+}
+
+// PublishStats writes the Stats into r as Counters and a Gauge with the CacheLabel set to "get" or "filter"
+// Publish from one goroutine at a time, it brings each Counter up to date by adding the difference
+func (c *CachedRegistry) PublishStats(r Registry) error {
+	stats := c.Stats()
+	for cache, usage := range map[string]CacheUsage{"get": stats.Get, "filter": stats.Filter} {
+		counts := map[string]uint64{
+			cacheHitsName:          usage.Hits,
+			cacheMissesName:        usage.Misses,
+			cacheEvictionsName:     usage.Evictions,
+			cacheInvalidationsName: usage.Invalidations,
+		}
+		for name, count := range counts {
+			counter, err := GetOrRegisterCounter(r, Key{NameLabel: name, CacheLabel: cache})
+			if err != nil {
+				return err
+			}
+			if published := counter.Value(); count > published {
+				counter.Add(count - published)
+			}
+		}
+		gauge, err := GetOrRegisterGauge(r, Key{NameLabel: cacheSizeName, CacheLabel: cache})
+		if err != nil {
+			return err
+		}
+		gauge.Set(float64(usage.Size))
+	}
+	return nil
+}
+
+func (u *CacheUsage) load() CacheUsage {
+	return CacheUsage{
+		Hits:          atomic.LoadUint64(&u.Hits),
+		Misses:        atomic.LoadUint64(&u.Misses),
+		Evictions:     atomic.LoadUint64(&u.Evictions),
+		Invalidations: atomic.LoadUint64(&u.Invalidations),
+		Size:          atomic.LoadUint64(&u.Size),
+	}
+}
+
+func (u *CacheUsage) hit() {
+	atomic.AddUint64(&u.Hits, 1)
+}
+
+func (u *CacheUsage) miss() {
+	atomic.AddUint64(&u.Misses, 1)
+}
+
+func (u *CacheUsage) added() {
+	atomic.AddUint64(&u.Size, 1)
+}
+
+func (u *CacheUsage) evicted() {
+	atomic.AddUint64(&u.Evictions, 1)
+	atomic.AddUint64(&u.Size, ^uint64(0))
+}
+
+func (u *CacheUsage) invalidated() {
+	atomic.AddUint64(&u.Invalidations, 1)
+	atomic.AddUint64(&u.Size, ^uint64(0))
+}
@@ -0,0 +1,151 @@
+// +build all unit
+
+package registry
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache stats", func() {
+	var r *CachedRegistry
+	a := Key{"a": "1"}
+	ab := Key{"a": "1", "b": "2"}
+	BeforeEach(func() {
+		r = NewCacheRegistry(1)
+		r.Set(a, 1)
+		r.Set(ab, 2)
+	})
+
+	Describe("Given a cached registry", func() {
+		Context("When Keys are got more than once", func() {
+			It("Then hits, misses and evictions should be counted", func() {
+				r.Get(a)
+				r.Get(a)
+				r.Get(Key{"missing": "1"})
+				r.Get(ab)
+				Expect(r.Stats().Get).To(Equal(CacheUsage{Hits: 1, Misses: 3, Evictions: 1, Size: 1}))
+				Expect(r.Stats().Filter).To(Equal(CacheUsage{}))
+			})
+		})
+		Context("When its caches count their own hits and misses", func() {
+			It("Then they should agree with its stats", func() {
+				r.Get(a)
+				r.Get(a)
+				r.Get(ab)
+				r.Filter(a)
+				r.Filter(a)
+				for _, c := range []struct {
+					cache Cache
+					usage CacheUsage
+				}{{r.getCache, r.Stats().Get}, {r.filterCache, r.Stats().Filter}} {
+					Expect(c.cache.(StatsCache).Stats()).To(Equal(CacheStats{Hits: c.usage.Hits, Misses: c.usage.Misses}))
+				}
+			})
+		})
+		Context("When Keys are filtered more than once", func() {
+			It("Then hits, misses and evictions should be counted", func() {
+				r.Filter(a)
+				r.Filter(a)
+				r.Filter(ab)
+				Expect(r.Stats().Filter).To(Equal(CacheUsage{Hits: 1, Misses: 2, Evictions: 1, Size: 1}))
+			})
+		})
+		Context("When a new entry is part of a cached filter", func() {
+			It("Then the filter should be counted as invalidated", func() {
+				r.Filter(a)
+				r.Set(Key{"a": "1", "c": "3"}, 3)
+				Expect(r.Stats().Filter).To(Equal(CacheUsage{Misses: 1, Invalidations: 1}))
+			})
+		})
+		Context("When a cached entry is deleted", func() {
+			It("Then it should be counted as invalidated in both caches", func() {
+				r.Get(ab)
+				r.Filter(ab)
+				r.Delete(ab)
+				r.Delete(a)
+				Expect(r.Stats().Get).To(Equal(CacheUsage{Misses: 1, Invalidations: 1}))
+				Expect(r.Stats().Filter).To(Equal(CacheUsage{Misses: 1, Invalidations: 1}))
+			})
+		})
+		Context("When a cached Key is got again", func() {
+			It("Then nothing should be allocated", func() {
+				r = NewCacheRegistry(10)
+				k := Key{"__name__": "http_requests_total", "method": "GET", "code": "200"}
+				r.Set(k, 1)
+				r.Get(k)
+				Expect(testing.AllocsPerRun(100, func() { r.Get(k) })).To(BeZero())
+			})
+			It("Then nothing should be allocated with any policy that keeps its lists on a hit", func() {
+				for name, p := range map[string]CachePolicy{"FIFO": FIFOPolicy, "LRU": LRUPolicy, "ARC": ARCPolicy, "TinyLFU": TinyLFUPolicy} {
+					r = NewCacheRegistry(10, WithCachePolicy(p))
+					r.Set(a, 1)
+					r.Get(a)
+					r.Get(a)
+					Expect(testing.AllocsPerRun(100, func() { r.Get(a) })).To(BeZero(), name)
+					Expect(r.Stats().Get.Hits).To(BeNumerically(">", 100), name)
+				}
+			})
+		})
+		Context("When a Delete only shrinks a cached filter", func() {
+			It("Then the filter should still be cached", func() {
+				r = NewCacheRegistry(10)
+				r.Set(a, 1)
+				r.Set(ab, 2)
+				r.Filter(a)
+				r.Delete(ab)
+				Expect(r.Filter(a)).To(HaveLen(1))
+				Expect(r.Stats().Filter).To(Equal(CacheUsage{Hits: 1, Misses: 1, Size: 1}))
+			})
+		})
+	})
+
+	Describe("Given stats to publish", func() {
+		BeforeEach(func() {
+			r.Get(a)
+			r.Get(a)
+			r.Filter(a)
+		})
+		Context("When they are published into the registry itself", func() {
+			It("Then they should be there as metrics labelled with the cache", func() {
+				Expect(r.PublishStats(r)).To(Succeed())
+				hits := r.Get(Key{NameLabel: "registry_cache_hits_total", CacheLabel: "get"}).(*Counter)
+				Expect(hits.Value()).To(Equal(uint64(1)))
+				size := r.Get(Key{NameLabel: "registry_cache_size", CacheLabel: "filter"}).(*Gauge)
+				Expect(size.Value()).To(Equal(float64(1)))
+				Expect(r.Filter(Key{CacheLabel: "filter"})).To(HaveLen(5))
+			})
+		})
+		Context("When they are published again after more lookups", func() {
+			It("Then the counters should be brought up to date", func() {
+				other := NewSimpleRegistry()
+				Expect(r.PublishStats(other)).To(Succeed())
+				r.Get(a)
+				r.Get(a)
+				Expect(r.PublishStats(other)).To(Succeed())
+				Expect(other.Get(Key{NameLabel: "registry_cache_hits_total", CacheLabel: "get"}).(*Counter).Value()).To(Equal(uint64(3)))
+				Expect(other.Filter(Key{})).To(HaveLen(10))
+			})
+		})
+		Context("When the registry they are published into is exported", func() {
+			It("Then they should be in the Prometheus output", func() {
+				other := NewSimpleRegistry()
+				Expect(r.PublishStats(other)).To(Succeed())
+				out := &strings.Builder{}
+				Expect(NewPrometheusExporter(other).Write(out)).To(Succeed())
+				Expect(out.String()).To(ContainSubstring("# TYPE registry_cache_misses_total counter"))
+				Expect(out.String()).To(ContainSubstring(`registry_cache_misses_total{cache="filter"} 1`))
+			})
+		})
+		Context("When a Key they use already holds something else", func() {
+			It("Then publishing should fail", func() {
+				other := NewSimpleRegistry()
+				other.Set(Key{NameLabel: "registry_cache_size", CacheLabel: "get"}, "taken")
+				Expect(r.PublishStats(other)).To(Equal(ErrMetricTypeMismatch))
+			})
+		})
+	})
+})
@@ -0,0 +1,277 @@
+// +build all unit
+
+package registry
+
+import (
+	"strconv"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache policies", func() {
+	policies := map[string]CachePolicy{
+		"fifo":    FIFOPolicy,
+		"lru":     LRUPolicy,
+		"lfu":     LFUPolicy,
+		"arc":     ARCPolicy,
+		"tinylfu": TinyLFUPolicy,
+	}
+	hash := func(i int) string {
+		return "h" + strconv.Itoa(i)
+	}
+	// cached returns which of the first n hashes the cache has without it counting as a use
+	cached := func(c Cache, n int) map[string]bool {
+		hashes := map[string]bool{}
+		for i := 0; i < n; i++ {
+			if _, err := peekWithHash(c, hash(i)); err == nil {
+				hashes[hash(i)] = true
+			}
+		}
+		return hashes
+	}
+	// use gets the hash and adds it if it wasn't there, like CachedRegistry does
+	use := func(c Cache, i int) {
+		if _, err := c.GetWithHash(hash(i)); err != nil {
+			c.UpdateWithHash(hash(i), i)
+		}
+	}
+
+	Describe("Given any policy", func() {
+		Context("When more items are added than it can hold", func() {
+			It("Then it should stay at its size and remove exactly what it says it removed", func() {
+				for name, policy := range policies {
+					c := policy(10)
+					expected := map[string]bool{}
+					for i := 0; i < 300; i++ {
+						n := (i * 7) % 31
+						if i%3 == 0 {
+							n = i % 5
+						}
+						if _, err := c.GetWithHash(hash(n)); err == nil {
+							continue
+						}
+						expected[hash(n)] = true
+						cacheItemRemoved, cacheKeyRemoved, cacheValueRemoved := c.UpdateWithHash(hash(n), n)
+						if cacheItemRemoved {
+							Expect(expected).To(HaveKey(cacheKeyRemoved), name)
+							Expect(hash(cacheValueRemoved.(int))).To(Equal(cacheKeyRemoved), name)
+							delete(expected, cacheKeyRemoved)
+						}
+						Expect(cached(c, 31)).To(Equal(expected), name)
+						Expect(len(expected)).To(BeNumerically("<=", 10), name)
+					}
+				}
+			})
+		})
+		Context("When an item that is there is updated", func() {
+			It("Then its value should be replaced without removing anything", func() {
+				for name, policy := range policies {
+					c := policy(2)
+					c.UpdateWithHash("a", 1)
+					c.UpdateWithKey(Key{}, 0)
+					cacheItemRemoved, _, _ := c.UpdateWithKey(Key{}, 5)
+					Expect(cacheItemRemoved).To(BeFalse(), name)
+					cacheItemRemoved, _, _ = c.UpdateWithHash("a", 10)
+					Expect(cacheItemRemoved).To(BeFalse(), name)
+					Expect(peekWithHash(c, "a")).To(Equal(10), name)
+				}
+			})
+		})
+		Context("When an item is removed", func() {
+			It("Then it shouldn't be found", func() {
+				for name, policy := range policies {
+					c := policy(2)
+					c.UpdateWithHash("a", 1)
+					c.RemoveWithHash("a")
+					c.RemoveWithHash("missing")
+					_, err := c.GetWithHash("a")
+					Expect(err).To(Equal(ErrKeyNotFound), name)
+					_, err = c.GetWithKey(Key{})
+					Expect(err).To(Equal(ErrKeyNotFound), name)
+				}
+			})
+		})
+		Context("When items are got", func() {
+			It("Then hits and misses should be counted but peeks shouldn't", func() {
+				for name, policy := range policies {
+					c := policy(2)
+					c.GetWithHash("a")
+					c.UpdateWithHash("a", 1)
+					c.GetWithHash("a")
+					c.GetWithHash("a")
+					peekWithHash(c, "a")
+					peekWithHash(c, "b")
+					Expect(c.(StatsCache).Stats()).To(Equal(CacheStats{Hits: 2, Misses: 1}), name)
+				}
+			})
+		})
+		Context("When it can't hold anything", func() {
+			It("Then it should give back the item it was given", func() {
+				for name, policy := range policies {
+					c := policy(0)
+					cacheItemRemoved, cacheKeyRemoved, cacheValueRemoved := c.UpdateWithHash("a", 1)
+					Expect(cacheItemRemoved).To(BeTrue(), name)
+					Expect(cacheKeyRemoved).To(Equal("a"), name)
+					Expect(cacheValueRemoved).To(Equal(1), name)
+				}
+			})
+		})
+	})
+
+	Describe("Given an LFU cache", func() {
+		Context("When it is full", func() {
+			It("Then the least frequently used item should be removed, the oldest one if there is a tie", func() {
+				c := NewLFUCache(3)
+				for i := 0; i < 3; i++ {
+					c.UpdateWithHash(hash(i), i)
+				}
+				c.GetWithHash(hash(0))
+				c.GetWithHash(hash(0))
+				c.GetWithHash(hash(2))
+				_, cacheKeyRemoved, _ := c.UpdateWithHash(hash(3), 3)
+				Expect(cacheKeyRemoved).To(Equal(hash(1)))
+				_, cacheKeyRemoved, _ = c.UpdateWithHash(hash(4), 4)
+				Expect(cacheKeyRemoved).To(Equal(hash(3)))
+			})
+		})
+		Context("When the only item with the lowest count is removed", func() {
+			It("Then the next lowest count should be evicted from", func() {
+				c := NewLFUCache(2)
+				c.UpdateWithHash(hash(0), 0)
+				c.UpdateWithHash(hash(1), 1)
+				c.GetWithHash(hash(1))
+				c.GetWithHash(hash(1))
+				c.RemoveWithHash(hash(0))
+				c.UpdateWithHash(hash(2), 2)
+				c.GetWithHash(hash(2))
+				_, cacheKeyRemoved, _ := c.UpdateWithHash(hash(3), 3)
+				Expect(cacheKeyRemoved).To(Equal(hash(2)))
+			})
+		})
+	})
+
+	Describe("Given an ARC cache with items that are used again and again", func() {
+		Context("When a scan of items that are only used once goes through it", func() {
+			It("Then the items used again should be kept", func() {
+				c := NewARCCache(4)
+				for j := 0; j < 3; j++ {
+					use(c, 0)
+					use(c, 1)
+				}
+				for i := 100; i < 200; i++ {
+					use(c, i)
+				}
+				Expect(cached(c, 2)).To(HaveLen(2))
+				Expect(c.recent.Len() + c.frequent.Len()).To(Equal(4))
+			})
+		})
+		Context("When items evicted from recent are asked for again", func() {
+			It("Then recent should be given more room", func() {
+				c := NewARCCache(4)
+				for j := 0; j < 3; j++ {
+					use(c, 0)
+					use(c, 1)
+				}
+				for j := 0; j < 5; j++ {
+					for i := 10; i < 13; i++ {
+						use(c, i)
+					}
+				}
+				Expect(c.target).To(BeNumerically(">", 0))
+				Expect(c.recentGhosts.Len() + c.frequentGhosts.Len()).To(BeNumerically("<=", 4))
+			})
+		})
+	})
+
+	Describe("Given a TinyLFU cache full of items that are asked for often", func() {
+		Context("When a scan of items that are only asked for once goes through it", func() {
+			It("Then they shouldn't push out the popular items like they do in an LRU cache", func() {
+				c := NewTinyLFUCache(10)
+				lru := NewLRUCache(10)
+				for j := 0; j < 3; j++ {
+					for i := 0; i < 10; i++ {
+						use(c, i)
+						use(lru, i)
+					}
+				}
+				for i := 100; i < 200; i++ {
+					use(c, i)
+					use(lru, i)
+				}
+				// The ones that made it to protected can only be pushed out through probation
+				Expect(len(cached(c, 10))).To(BeNumerically(">=", c.protectedSize))
+				Expect(cached(lru, 10)).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("Given a count-min sketch", func() {
+		Context("When a hash is added more times than a counter holds", func() {
+			It("Then its estimate should stop at the most a counter holds", func() {
+				s := newCountMinSketch(16)
+				for i := 0; i < 20; i++ {
+					s.add("a")
+				}
+				Expect(s.estimate("a")).To(Equal(uint8(sketchMaxCount)))
+				Expect(s.estimate("b")).To(BeNumerically("<=", s.estimate("a")))
+			})
+		})
+		Context("When enough hashes are added", func() {
+			It("Then every counter should be halved", func() {
+				s := newCountMinSketch(16)
+				for i := 0; i < s.resetAt; i++ {
+					s.add("a")
+				}
+				Expect(s.estimate("a")).To(Equal(uint8(sketchMaxCount / 2)))
+				Expect(s.additions).To(Equal(s.resetAt / 2))
+			})
+		})
+		Context("When hashes are added and estimated", func() {
+			It("Then nothing should be allocated", func() {
+				s := newCountMinSketch(16)
+				Expect(testing.AllocsPerRun(100, func() {
+					s.add("a")
+					s.estimate("a")
+				})).To(BeZero())
+			})
+		})
+	})
+
+	Describe("Given options for the cached registry", func() {
+		Context("When none are given", func() {
+			It("Then both caches should be LRU", func() {
+				r := NewCacheRegistry(10)
+				Expect(r.getCache).To(BeAssignableToTypeOf(&LRUCache{}))
+				Expect(r.filterCache).To(BeAssignableToTypeOf(&LRUCache{}))
+			})
+		})
+		Context("When a policy is picked for both and then another for filters", func() {
+			It("Then each cache should use the last policy picked for it", func() {
+				r := NewCacheRegistry(10, WithCachePolicy(ARCPolicy), WithFilterCachePolicy(TinyLFUPolicy))
+				Expect(r.getCache).To(BeAssignableToTypeOf(&ARCCache{}))
+				Expect(r.filterCache).To(BeAssignableToTypeOf(&TinyLFUCache{}))
+				r = NewCacheRegistry(10, WithGetCachePolicy(LFUPolicy))
+				Expect(r.getCache).To(BeAssignableToTypeOf(&LFUCache{}))
+				Expect(r.filterCache).To(BeAssignableToTypeOf(&LRUCache{}))
+			})
+		})
+		Context("When the caches can't hold anything", func() {
+			It("Then entries shouldn't point at cache keys that aren't cached", func() {
+				r := NewCacheRegistry(0)
+				k := Key{"a": "1"}
+				r.Set(k, 1)
+				for i := 0; i < 3; i++ {
+					Expect(r.Get(k)).To(Equal(1))
+					Expect(r.Filter(k)).To(HaveLen(1))
+				}
+				entry, err := r.registry.Get(k)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(entry.getCacheKey).To(BeEmpty())
+				Expect(entry.filterCacheKeys).To(BeEmpty())
+				Expect(r.filterKeys).To(BeEmpty())
+			})
+		})
+	})
+})
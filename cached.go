@@ -1,131 +1,354 @@
-package registry
-
-/*
-
-	This is essentially BetterRegistry with a cache. However, we couldn't directly use
-	BetterRegistry because we needed the Key and Entry to be able to relate back to the
-	cache so it can be updated
-
-*/
-
-type CachedRegistry struct {
-	registry    *EvenBetterRegistry
-	getCache    Cache // caches gets. Should only have one Entry per cache key
-	filterCache Cache // cache filters. Will have a list of Entries that satisfies the Key
-}
-
-type hashEntries []*hashEntry
-
-func NewCacheRegistry(cacheSize int) *CachedRegistry {
-	return &CachedRegistry{
-		registry:    NewEvenBetterRegistry(),
-		getCache:    NewSimpleCache(cacheSize),
-		filterCache: NewSimpleCache(cacheSize),
-	}
-}
-
-func (c *CachedRegistry) Get(k Key) interface{} {
-	entries, err := c.getCache.GetWithKey(k)
-	if err == nil {
-		return entries.(hashEntries)[0].value
-	}
-	entry, err := c.registry.Get(k)
-	if err != nil {
-		return nil
-	}
-	cacheItemRemoved, _, cacheValueRemoved := c.getCache.UpdateWithHash(entry.getCacheKey, hashEntries{entry})
-	if cacheItemRemoved {
-		removeGetCacheKey(cacheValueRemoved.(hashEntries))
-	}
-	addGetCacheKey(entry, k)
-	return entry.value
-}
-func (c *CachedRegistry) Filter(k Key) []Entry {
-	entries, err := c.filterCache.GetWithKey(k)
-	if err == nil {
-		return toEntryArray(entries)
-	}
-	entries = c.registry.Filter(k)
-	cacheItemRemoved, cacheKeyRemoved, cacheValueRemoved := c.filterCache.UpdateWithKey(k, entries)
-	if cacheItemRemoved {
-		removeFilterCacheKey(cacheKeyRemoved, cacheValueRemoved.(hashEntries))
-	}
-	addFilterCacheKey(entries.(hashEntries), k)
-	return toEntryArray(entries)
-}
-
-func (c *CachedRegistry) Set(k Key, i interface{}) {
-	c.registry.Set(k, i)
-}
-
-func (c *CachedRegistry) Delete(k Key) {
-	entry := c.registry.Delete(k)
-	if entry == nil {
-		return
-	}
-	// Clean up entry from caches
-	c.getCache.RemoveWithHash(entry.getCacheKey)
-	for _, hashString := range entry.filterCacheKeys {
-		entries, err := c.filterCache.GetWithHash(hashString)
-		if err != nil {
-			// shouldn't get here, this means entry cache list and cache are out of sync
-			continue
-		}
-		entries, _ = removeFromHashEntries(entries.(hashEntries), k)
-		if len(entries.(hashEntries)) == 0 {
-			c.filterCache.RemoveWithHash(hashString)
-		} else {
-			c.filterCache.UpdateWithHash(hashString, entries)
-		}
-	}
-}
-
-/*
-	We want to update the hashEntry that has been removed from the cache by deleteing the getCacheKey
-		which holds the key for the hashEntry in the cache
-	deleteEntries should really only have one value
-*/
-func removeGetCacheKey(deleteEntries hashEntries) {
-	for _, entry := range deleteEntries {
-		entry.getCacheKey = ""
-	}
-}
-
-func addGetCacheKey(entry *hashEntry, k Key) {
-	entry.getCacheKey = toHashString(k)
-}
-
-/*
-	Given the cache is filled, UpdateWithHash() will give us the cache key and value.
-	The value given will be an array of pointers to hashEntry(s) which we must remove the now deleted cache key
-		from the filterCacheKeys. Therefore this updates the hashEntry(s) that it has been removed from the cache for this key
-*/
-func removeFilterCacheKey(deletedKey string, deleteEntries hashEntries) {
-	for _, entry := range deleteEntries {
-		for i, hash := range entry.filterCacheKeys {
-			if hash == deletedKey {
-				entry.filterCacheKeys = append(entry.filterCacheKeys[:i], entry.filterCacheKeys[i+1:]...)
-				break
-			}
-		}
-	}
-}
-
-func addFilterCacheKey(entries hashEntries, k Key) {
-	cacheKey := toHashString(k)
-	for _, entry := range entries {
-		entry.filterCacheKeys = append(entry.filterCacheKeys, cacheKey)
-	}
-}
-
-// toEntryArray converts hashEntries (in interface or hashEntries type form) to []Entry
-func toEntryArray(i interface{}) []Entry {
-	entries := []Entry{}
-	for _, entry := range i.(hashEntries) {
-		entries = append(entries, Entry{
-			Key:   entry.keys,
-			Value: entry.value,
-		})
-	}
-	return entries
-}
+package registry
+
+/*
+
+	This is essentially BetterRegistry with a cache. However, we couldn't directly use
+	BetterRegistry because we needed the Key and Entry to be able to relate back to the
+	cache so it can be updated
+
+	A cached Filter result only knows about the entries that existed when it was cached. When
+	Set adds a new entry, every cached Filter whose Key is a subset of the new Key is dropped
+	so the next Filter picks the new entry up. Setting an entry that already exists doesn't
+	need this since the caches hold the same hashEntry as the registry.
+
+	Get and Filter write the hash of the Key into a buffer the registry reuses, and the caches
+	that come with the package answer a hit from its bytes, so a hit doesn't allocate unless
+	the cache does (LFUCache moves the item to the list for its next count). Only a miss makes
+	a string of the hash, since that is what the cache keeps.
+
+	WithFingerprintGets skips getCache. Hashing the Key for getCache costs about as much as
+	the lookup it saves, so Get goes straight to the registry's fingerprint index instead.
+	getCache stays empty and its stats stay at zero.
+
+*/
+
+type CachedRegistry struct {
+	registry    *EvenBetterRegistry
+	getCache    Cache          // caches gets. Should only have one Entry per cache key
+	filterCache Cache          // cache filters. Will have a list of Entries that satisfies the Key
+	filterKeys  map[string]Key // The Key of every filter in filterCache by its cache key
+	getUsage    CacheUsage     // What getCache did, see cacheStats.go
+	filterUsage CacheUsage     // What filterCache did
+	hash        []byte         // Reused to build the hash of the Key being looked up
+	// Gets are looked up by fingerprint in the registry instead of in getCache, see WithFingerprintGets
+	fingerprintGets bool
+}
+
+type hashEntries []*hashEntry
+
+// CachePolicy makes a Cache that holds at most maxSize items
+type CachePolicy func(maxSize int) Cache
+
+var (
+	FIFOPolicy    CachePolicy = func(maxSize int) Cache { return NewSimpleCache(maxSize) }
+	LRUPolicy     CachePolicy = func(maxSize int) Cache { return NewLRUCache(maxSize) }
+	LFUPolicy     CachePolicy = func(maxSize int) Cache { return NewLFUCache(maxSize) }
+	ARCPolicy     CachePolicy = func(maxSize int) Cache { return NewARCCache(maxSize) }
+	TinyLFUPolicy CachePolicy = func(maxSize int) Cache { return NewTinyLFUCache(maxSize) }
+)
+
+// CacheOption changes how NewCacheRegistry makes its caches
+type CacheOption func(*cacheOptions)
+
+type cacheOptions struct {
+	getPolicy       CachePolicy
+	filterPolicy    CachePolicy
+	fingerprintGets bool
+}
+
+// WithCachePolicy makes both caches with the policy
+func WithCachePolicy(p CachePolicy) CacheOption {
+	return func(o *cacheOptions) {
+		o.getPolicy = p
+		o.filterPolicy = p
+	}
+}
+
+// WithGetCachePolicy makes the cache for Get with the policy
+func WithGetCachePolicy(p CachePolicy) CacheOption {
+	return func(o *cacheOptions) {
+		o.getPolicy = p
+	}
+}
+
+// WithFilterCachePolicy makes the cache for Filter with the policy
+func WithFilterCachePolicy(p CachePolicy) CacheOption {
+	return func(o *cacheOptions) {
+		o.filterPolicy = p
+	}
+}
+
+// WithCacheBudget makes both caches WeightedLRUCaches that hold up to budget as weighed by weigh
+// cacheSize is ignored for a cache with a budget
+func WithCacheBudget(budget int64, weigh Weigher) CacheOption {
+	return func(o *cacheOptions) {
+		o.getPolicy = budgetPolicy(budget, weigh)
+		o.filterPolicy = budgetPolicy(budget, weigh)
+	}
+}
+
+// WithGetCacheBudget makes the cache for Get a WeightedLRUCache that holds up to budget as weighed by weigh
+func WithGetCacheBudget(budget int64, weigh Weigher) CacheOption {
+	return func(o *cacheOptions) {
+		o.getPolicy = budgetPolicy(budget, weigh)
+	}
+}
+
+// WithFilterCacheBudget makes the cache for Filter a WeightedLRUCache that holds up to budget as weighed by weigh
+func WithFilterCacheBudget(budget int64, weigh Weigher) CacheOption {
+	return func(o *cacheOptions) {
+		o.filterPolicy = budgetPolicy(budget, weigh)
+	}
+}
+
+// WithFingerprintGets makes Get look the Key's fingerprint up in the registry instead of using the get cache
+func WithFingerprintGets() CacheOption {
+	return func(o *cacheOptions) {
+		o.fingerprintGets = true
+	}
+}
+
+func budgetPolicy(budget int64, weigh Weigher) CachePolicy {
+	return func(int) Cache { return NewWeightedLRUCache(budget, weigh) }
+}
+
+// NewCacheRegistry returns a CachedRegistry whose caches hold cacheSize items each. Both are LRU unless an option says otherwise
+func NewCacheRegistry(cacheSize int, opts ...CacheOption) *CachedRegistry {
+	o := cacheOptions{
+		getPolicy:    LRUPolicy,
+		filterPolicy: LRUPolicy,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	c := &CachedRegistry{
+		registry:        NewEvenBetterRegistry(),
+		getCache:        o.getPolicy(cacheSize),
+		filterCache:     o.filterPolicy(cacheSize),
+		filterKeys:      map[string]Key{},
+		fingerprintGets: o.fingerprintGets,
+	}
+	if o.fingerprintGets {
+		c.registry.indexFingerprints()
+	}
+	return c
+}
+
+func (c *CachedRegistry) Get(k Key) interface{} {
+	i, _ := c.TryGet(k)
+	return i
+}
+
+// Lookup returns the value at k and whether there is an entry at k
+func (c *CachedRegistry) Lookup(k Key) (interface{}, bool) {
+	i, err := c.TryGet(k)
+	return i, err == nil
+}
+
+// TryGet returns the value at k or ErrKeyNotFound
+func (c *CachedRegistry) TryGet(k Key) (interface{}, error) {
+	if c.fingerprintGets {
+		entry, err := c.registry.Get(k)
+		if err != nil {
+			return nil, err
+		}
+		return entry.value, nil
+	}
+	c.hash = appendKeyHash(c.hash[:0], k)
+	if entries, ok := hitWithHashBytes(c.getCache, c.hash); ok {
+		c.getUsage.hit()
+		return entries.(hashEntries)[0].value, nil
+	}
+	hashString := string(c.hash)
+	entries, err := c.getCache.GetWithHash(hashString)
+	if err == nil {
+		c.getUsage.hit()
+		return entries.(hashEntries)[0].value, nil
+	}
+	c.getUsage.miss()
+	entry, err := c.registry.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	c.getUsage.added()
+	cached := true
+	for _, eviction := range updateCache(c.getCache, hashString, hashEntries{entry}) {
+		removeGetCacheKey(eviction.Value.(hashEntries))
+		c.getUsage.evicted()
+		// The cache's policy can turn away the item it was just given
+		cached = cached && eviction.Hash != hashString
+	}
+	if cached {
+		addGetCacheKey(entry, hashString)
+	}
+	return entry.value, nil
+}
+func (c *CachedRegistry) Filter(k Key) []Entry {
+	c.hash = appendKeyHash(c.hash[:0], k)
+	if entries, ok := hitWithHashBytes(c.filterCache, c.hash); ok {
+		c.filterUsage.hit()
+		return toEntryArray(entries)
+	}
+	hashString := string(c.hash)
+	entries, err := c.filterCache.GetWithHash(hashString)
+	if err == nil {
+		c.filterUsage.hit()
+		return toEntryArray(entries)
+	}
+	c.filterUsage.miss()
+	entries = c.registry.Filter(k)
+	c.filterUsage.added()
+	cached := true
+	for _, eviction := range updateCache(c.filterCache, hashString, entries) {
+		removeFilterCacheKey(eviction.Hash, eviction.Value.(hashEntries))
+		delete(c.filterKeys, eviction.Hash)
+		c.filterUsage.evicted()
+		// The cache's policy can turn away the item it was just given
+		cached = cached && eviction.Hash != hashString
+	}
+	if !cached {
+		return toEntryArray(entries)
+	}
+	addFilterCacheKey(entries.(hashEntries), hashString)
+	c.filterKeys[hashString] = copyKey(k)
+	return toEntryArray(entries)
+}
+
+// FilterMatchers returns every entry whose Key satisfies all the matchers
+// These aren't cached, only Filter with a plain Key is
+func (c *CachedRegistry) FilterMatchers(ms ...Matcher) []Entry {
+	return toEntryArray(c.registry.FilterMatchers(ms...))
+}
+
+func (c *CachedRegistry) Set(k Key, i interface{}) {
+	c.TrySet(k, i)
+}
+
+// TrySet is Set, it never fails
+func (c *CachedRegistry) TrySet(k Key, i interface{}) error {
+	entry, created := c.registry.getOrAdd(k)
+	entry.value = i
+	if created {
+		c.invalidateFilters(entry)
+	}
+	return nil
+}
+
+// Update replaces the value at k with what fn returns, creating the entry if needed
+// Caches hold the same hashEntry as the registry so they see the new value right away
+func (c *CachedRegistry) Update(k Key, fn func(old interface{}) interface{}) {
+	entry, created := c.registry.getOrAdd(k)
+	entry.value = fn(entry.value)
+	if created {
+		c.invalidateFilters(entry)
+	}
+}
+
+// GetOrCreate returns the value at k or creates the entry with the value from create
+func (c *CachedRegistry) GetOrCreate(k Key, create func() interface{}) (interface{}, bool) {
+	entry, created := c.registry.getOrAdd(k)
+	if created {
+		entry.value = create()
+		c.invalidateFilters(entry)
+	}
+	return entry.value, created
+}
+
+func (c *CachedRegistry) Delete(k Key) {
+	c.TryDelete(k)
+}
+
+// TryDelete removes the entry at k and cleans it out of the caches or returns ErrKeyNotFound if there is none
+func (c *CachedRegistry) TryDelete(k Key) error {
+	entry := c.registry.Delete(k)
+	if entry == nil {
+		return ErrKeyNotFound
+	}
+	// Clean up entry from caches. getCacheKey can't say if the entry is cached since the empty Key's hash is "" too
+	if hashString := toHashString(k); !c.fingerprintGets && hasHash(c.getCache, hashString) {
+		c.getCache.RemoveWithHash(hashString)
+		c.getUsage.invalidated()
+	}
+	for _, hashString := range entry.filterCacheKeys {
+		entries, err := peekWithHash(c.filterCache, hashString)
+		if err != nil {
+			// shouldn't get here, this means entry cache list and cache are out of sync
+			continue
+		}
+		entries, _ = removeFromHashEntries(entries.(hashEntries), k)
+		if len(entries.(hashEntries)) == 0 {
+			c.filterCache.RemoveWithHash(hashString)
+			delete(c.filterKeys, hashString)
+			c.filterUsage.invalidated()
+		} else {
+			c.filterCache.UpdateWithHash(hashString, entries)
+		}
+	}
+	return nil
+}
+
+/*
+	We want to update the hashEntry that has been removed from the cache by deleteing the getCacheKey
+		which holds the key for the hashEntry in the cache
+	deleteEntries should really only have one value
+*/
+func removeGetCacheKey(deleteEntries hashEntries) {
+	for _, entry := range deleteEntries {
+		entry.getCacheKey = ""
+	}
+}
+
+func addGetCacheKey(entry *hashEntry, hashString string) {
+	entry.getCacheKey = hashString
+}
+
+/*
+	Given the cache is filled, UpdateWithHash() will give us the cache key and value.
+	The value given will be an array of pointers to hashEntry(s) which we must remove the now deleted cache key
+		from the filterCacheKeys. Therefore this updates the hashEntry(s) that it has been removed from the cache for this key
+*/
+func removeFilterCacheKey(deletedKey string, deleteEntries hashEntries) {
+	for _, entry := range deleteEntries {
+		for i, hash := range entry.filterCacheKeys {
+			if hash == deletedKey {
+				entry.filterCacheKeys = append(entry.filterCacheKeys[:i], entry.filterCacheKeys[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func addFilterCacheKey(entries hashEntries, hashString string) {
+	for _, entry := range entries {
+		entry.filterCacheKeys = append(entry.filterCacheKeys, hashString)
+	}
+}
+
+// invalidateFilters drops every cached filter that the newly added entry should have been part of
+// NOTE: This looks at every cached filter so it is O(filter cache size) for every new entry
+func (c *CachedRegistry) invalidateFilters(newEntry *hashEntry) {
+	for hashString, k := range c.filterKeys {
+		if !isSubset(k, newEntry.keys) {
+			continue
+		}
+		entries, err := peekWithHash(c.filterCache, hashString)
+		if err == nil {
+			removeFilterCacheKey(hashString, entries.(hashEntries))
+			c.filterCache.RemoveWithHash(hashString)
+			c.filterUsage.invalidated()
+		}
+		delete(c.filterKeys, hashString)
+	}
+}
+
+// toEntryArray converts hashEntries (in interface or hashEntries type form) to []Entry
+func toEntryArray(i interface{}) []Entry {
+	entries := []Entry{}
+	for _, entry := range i.(hashEntries) {
+		entries = append(entries, Entry{
+			Key:   entry.keys,
+			Value: entry.value,
+		})
+	}
+	return entries
+}
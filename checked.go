@@ -0,0 +1,71 @@
+package registry
+
+/*
+
+	Get returns nil both when there is no entry and when the entry's value is nil, and Set
+	and Delete have no way to say they didn't do anything. Lookup, TryGet, TrySet and
+	TryDelete work on any Registry. Registries that implement CheckedRegistry answer them
+	directly. For the rest we fall back to the plain methods: a nil from Get is checked
+	against Filter to see if the entry is really there, which is slower but still right.
+	TryGetOrCreate does the same for GetOrCreate with CheckedUpdater.
+
+*/
+
+// Lookup returns the value at k in r and whether there is an entry at k
+func Lookup(r Registry, k Key) (interface{}, bool) {
+	if c, ok := r.(CheckedRegistry); ok {
+		return c.Lookup(k)
+	}
+	if i := r.Get(k); i != nil {
+		return i, true
+	}
+	for _, entry := range r.Filter(k) {
+		if len(entry.Key) == len(k) {
+			return entry.Value, true
+		}
+	}
+	return nil, false
+}
+
+// TryGet returns the value at k in r or ErrKeyNotFound
+func TryGet(r Registry, k Key) (interface{}, error) {
+	if c, ok := r.(CheckedRegistry); ok {
+		return c.TryGet(k)
+	}
+	i, ok := Lookup(r, k)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return i, nil
+}
+
+// TrySet Sets the value at k in r and returns why it couldn't if r is a CheckedRegistry
+func TrySet(r Registry, k Key, i interface{}) error {
+	if c, ok := r.(CheckedRegistry); ok {
+		return c.TrySet(k, i)
+	}
+	r.Set(k, i)
+	return nil
+}
+
+// TryGetOrCreate returns the value at k in r or Sets and returns the value from create
+// If r is a CheckedUpdater it returns why the value couldn't be stored instead
+func TryGetOrCreate(r Registry, k Key, create func() interface{}) (interface{}, bool, error) {
+	if c, ok := r.(CheckedUpdater); ok {
+		return c.TryGetOrCreate(k, create)
+	}
+	i, created := GetOrCreate(r, k, create)
+	return i, created, nil
+}
+
+// TryDelete removes the entry at k from r or returns ErrKeyNotFound if there is none
+func TryDelete(r Registry, k Key) error {
+	if c, ok := r.(CheckedRegistry); ok {
+		return c.TryDelete(k)
+	}
+	if _, ok := Lookup(r, k); !ok {
+		return ErrKeyNotFound
+	}
+	r.Delete(k)
+	return nil
+}
@@ -0,0 +1,63 @@
+// +build all unit
+
+package registry
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Checked registries", func() {
+	Describe("Given the registries in this package", func() {
+		It("Then the ones that can answer directly should be a CheckedRegistry", func() {
+			for _, r := range []Registry{
+				NewSimpleRegistry(),
+				NewBetterRegistry(),
+				NewCacheRegistry(10),
+				NewSafeRegistry(NewSimpleRegistry()),
+				NewShardedRegistry(2),
+				NewLimitedRegistry(NewSimpleRegistry(), Limits{}, LimitReject),
+			} {
+				_, ok := r.(CheckedRegistry)
+				Expect(ok).To(BeTrue(), "%T", r)
+			}
+		})
+	})
+	Describe("Given a registry that only has the Registry methods", func() {
+		var r Registry
+		k := Key{"a": "1"}
+		BeforeEach(func() {
+			r = plainRegistry{NewCacheRegistry(10)}
+			r.Set(Key{"a": "1", "b": "2"}, "ab")
+		})
+		Context("When a nil value is looked up", func() {
+			It("Then it should still be found", func() {
+				r.Set(k, nil)
+				i, ok := Lookup(r, k)
+				Expect(i).To(BeNil())
+				Expect(ok).To(BeTrue())
+			})
+		})
+		Context("When a Key that isn't there but is part of another is looked up", func() {
+			It("Then it shouldn't be found", func() {
+				_, ok := Lookup(r, k)
+				Expect(ok).To(BeFalse())
+				Expect(TryDelete(r, k)).To(Equal(ErrKeyNotFound))
+			})
+		})
+	})
+	Describe("Given a limited registry wrapped to be safe", func() {
+		Context("When a Key is rejected", func() {
+			It("Then the error should make it through the wrapper", func() {
+				r := NewSafeRegistry(NewLimitedRegistry(NewCacheRegistry(10), Limits{MaxLabelsPerKey: 1}, LimitReject))
+				Expect(r.TrySet(Key{"a": "1"}, 1)).To(Succeed())
+				err := r.TrySet(Key{"a": "1", "b": "2"}, 2)
+				Expect(errors.Is(err, ErrTooManyLabels)).To(BeTrue())
+				_, err = r.TryGet(Key{"a": "1", "b": "2"})
+				Expect(err).To(Equal(ErrKeyNotFound))
+			})
+		})
+	})
+})
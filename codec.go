@@ -0,0 +1,292 @@
+package registry
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"sync/atomic"
+)
+
+/*
+
+	A Value is an interface{} so there is no way to write one to disk without knowing what it
+	is. A ValueCodec turns a value into a type name and some bytes and back again. Anything
+	that stores a registry, like Snapshot, takes one so values it doesn't know about can still
+	be stored by plugging in a codec that does.
+
+	DefaultCodec handles nil, bools, strings, every int, uint and float type, and Counters,
+	Gauges and Histograms. Metrics come back as new metrics with the same state. Anything
+	Encode couldn't have written, like an int8 of 300 or a bool of 2, is corrupt instead of
+	being narrowed into some other value.
+
+*/
+
+var (
+	// ErrUnsupportedValue is returned when a ValueCodec doesn't know the value or type name
+	ErrUnsupportedValue = errors.New("Value can't be encoded")
+	// ErrCorruptData is returned when what is being decoded can't have been encoded
+	ErrCorruptData = errors.New("Data is corrupt")
+)
+
+// ValueCodec encodes and decodes registry values
+type ValueCodec interface {
+	// Name says which codec wrote something so it isn't read back with a different one
+	Name() string
+	// Encode returns the name of the value's type and the value as bytes
+	Encode(i interface{}) (typ string, data []byte, err error)
+	// Decode turns what Encode returned back into a value
+	Decode(typ string, data []byte) (interface{}, error)
+}
+
+// DefaultCodec encodes the basic Go types and the metrics in this package
+var DefaultCodec ValueCodec = defaultCodec{}
+
+type defaultCodec struct{}
+
+func (defaultCodec) Name() string {
+	return "default"
+}
+
+func (defaultCodec) Encode(i interface{}) (string, []byte, error) {
+	switch v := i.(type) {
+	case nil:
+		return "nil", nil, nil
+	case bool:
+		if v {
+			return "bool", []byte{1}, nil
+		}
+		return "bool", []byte{0}, nil
+	case string:
+		return "string", []byte(v), nil
+	case int:
+		return "int", appendVarint(nil, int64(v)), nil
+	case int8:
+		return "int8", appendVarint(nil, int64(v)), nil
+	case int16:
+		return "int16", appendVarint(nil, int64(v)), nil
+	case int32:
+		return "int32", appendVarint(nil, int64(v)), nil
+	case int64:
+		return "int64", appendVarint(nil, v), nil
+	case uint:
+		return "uint", appendUvarint(nil, uint64(v)), nil
+	case uint8:
+		return "uint8", appendUvarint(nil, uint64(v)), nil
+	case uint16:
+		return "uint16", appendUvarint(nil, uint64(v)), nil
+	case uint32:
+		return "uint32", appendUvarint(nil, uint64(v)), nil
+	case uint64:
+		return "uint64", appendUvarint(nil, v), nil
+	case float32:
+		return "float32", appendUvarint(nil, uint64(math.Float32bits(v))), nil
+	case float64:
+		return "float64", appendFloat64(nil, v), nil
+	case *Counter:
+		return "counter", appendUvarint(nil, v.Value()), nil
+	case *Gauge:
+		return "gauge", appendFloat64(nil, v.Value()), nil
+	case *Histogram:
+		return "histogram", encodeHistogram(v), nil
+	}
+	return "", nil, fmt.Errorf("%w: %T", ErrUnsupportedValue, i)
+}
+
+func (defaultCodec) Decode(typ string, data []byte) (interface{}, error) {
+	d := &decoder{data: data}
+	var i interface{}
+	switch typ {
+	case "nil":
+		return nil, nil
+	case "bool":
+		if len(data) != 1 || data[0] > 1 {
+			d.fail()
+		}
+		i = len(data) == 1 && data[0] == 1
+	case "string":
+		return string(data), nil
+	case "int":
+		i = int(d.intN(bits.UintSize))
+	case "int8":
+		i = int8(d.intN(8))
+	case "int16":
+		i = int16(d.intN(16))
+	case "int32":
+		i = int32(d.intN(32))
+	case "int64":
+		i = d.varint()
+	case "uint":
+		i = uint(d.uintN(bits.UintSize))
+	case "uint8":
+		i = uint8(d.uintN(8))
+	case "uint16":
+		i = uint16(d.uintN(16))
+	case "uint32":
+		i = uint32(d.uintN(32))
+	case "uint64":
+		i = d.uvarint()
+	case "float32":
+		i = math.Float32frombits(uint32(d.uintN(32)))
+	case "float64":
+		i = d.float64()
+	case "counter":
+		i = &Counter{value: d.uvarint()}
+	case "gauge":
+		g := NewGauge()
+		g.Set(d.float64())
+		i = g
+	case "histogram":
+		i = decodeHistogram(d)
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q", ErrUnsupportedValue, typ)
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("Can't decode %s: %w", typ, d.err)
+	}
+	return i, nil
+}
+
+// encodeHistogram writes the bucket bounds, the count in every bucket including +Inf and the sum
+func encodeHistogram(h *Histogram) []byte {
+	data := appendUvarint(nil, uint64(len(h.buckets)))
+	for _, b := range h.buckets {
+		data = appendFloat64(data, b)
+	}
+	for i := range h.counts {
+		data = appendUvarint(data, atomic.LoadUint64(&h.counts[i]))
+	}
+	return appendFloat64(data, math.Float64frombits(atomic.LoadUint64(&h.sumBits)))
+}
+
+// decodeHistogram reads what encodeHistogram wrote. Bounds have to be in order like NewHistogram leaves them
+// or Observe would put values in the wrong bucket
+func decodeHistogram(d *decoder) *Histogram {
+	n := d.uvarint()
+	if d.err != nil || n > uint64(len(d.data)) {
+		d.fail()
+		return nil
+	}
+	h := &Histogram{
+		buckets: make([]float64, n),
+		counts:  make([]uint64, n+1),
+	}
+	for i := range h.buckets {
+		b := d.float64()
+		if math.IsNaN(b) || math.IsInf(b, 1) || (i > 0 && b < h.buckets[i-1]) {
+			d.fail()
+			return nil
+		}
+		h.buckets[i] = b
+	}
+	for i := range h.counts {
+		h.counts[i] = d.uvarint()
+		h.count += h.counts[i]
+	}
+	h.sumBits = math.Float64bits(d.float64())
+	return h
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendFloat64(b []byte, f float64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], math.Float64bits(f))
+	return append(b, buf[:]...)
+}
+
+// appendBytes writes the length and then the bytes
+func appendBytes(b []byte, data []byte) []byte {
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// decoder reads what the append functions wrote. The first problem is kept in err
+// and everything after it returns zero values so callers only have to check once
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = ErrCorruptData
+	}
+	d.data = nil
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// intN reads a varint that has to fit in a signed int of the size, like one an int8 was encoded from
+func (d *decoder) intN(size int) int64 {
+	v := d.varint()
+	if max := int64(1)<<(size-1) - 1; v > max || v < -max-1 {
+		d.fail()
+		return 0
+	}
+	return v
+}
+
+// uintN reads a uvarint that has to fit in an unsigned int of the size
+func (d *decoder) uintN(size int) uint64 {
+	v := d.uvarint()
+	if size < 64 && v >= uint64(1)<<size {
+		d.fail()
+		return 0
+	}
+	return v
+}
+
+func (d *decoder) float64() float64 {
+	if len(d.data) < 8 {
+		d.fail()
+		return 0
+	}
+	f := math.Float64frombits(binary.BigEndian.Uint64(d.data))
+	d.data = d.data[8:]
+	return f
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil || n > uint64(len(d.data)) {
+		d.fail()
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
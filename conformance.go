@@ -0,0 +1,274 @@
+package registry
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+/*
+
+	RunConformanceTests checks the whole Registry contract so every implementation, including
+	ones outside of this package, can be held to the same rules. Call it from a test with a
+	func that returns a new, empty registry:
+
+		func TestMyRegistry(t *testing.T) {
+			registry.RunConformanceTests(t, func() registry.Registry { return NewMyRegistry() })
+		}
+
+	Every check runs as its own subtest against a fresh registry.
+
+*/
+
+// RunConformanceTests runs every Registry contract check against registries made by newRegistry
+func RunConformanceTests(t *testing.T, newRegistry func() Registry) {
+	for _, c := range conformanceChecks {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.check(newRegistry()); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+type conformanceCheck struct {
+	name  string
+	check func(r Registry) error
+}
+
+var (
+	conformanceKeyAB = Key{"a": "1", "b": "2"}
+	conformanceKeyAC = Key{"a": "1", "c": "3"}
+	conformanceKeyA  = Key{"a": "1"}
+	conformanceKeyD  = Key{"d": "4"}
+)
+
+// setConformanceEntries fills r with the same entries for each check
+func setConformanceEntries(r Registry) {
+	r.Set(conformanceKeyAB, "ab")
+	r.Set(conformanceKeyAC, "ac")
+	r.Set(conformanceKeyA, "a")
+	r.Set(conformanceKeyD, "d")
+}
+
+var conformanceChecks = []conformanceCheck{
+	{"Get returns the value of the exact Key", func(r Registry) error {
+		setConformanceEntries(r)
+		if err := expectValue(r, conformanceKeyAB, "ab"); err != nil {
+			return err
+		}
+		if err := expectValue(r, conformanceKeyA, "a"); err != nil {
+			return err
+		}
+		return expectValue(r, Key{"b": "2", "a": "1"}, "ab")
+	}},
+	{"Get returns nil for a Key that is not set", func(r Registry) error {
+		setConformanceEntries(r)
+		if err := expectValue(r, Key{"a": "2"}, nil); err != nil {
+			return err
+		}
+		if err := expectValue(r, Key{"b": "2"}, nil); err != nil {
+			return err
+		}
+		return expectValue(r, Key{"a": "1", "b": "2", "c": "3"}, nil)
+	}},
+	{"Filter returns every entry that contains the Key", func(r Registry) error {
+		setConformanceEntries(r)
+		if err := expectEntries(r, conformanceKeyA, Entry{conformanceKeyAB, "ab"}, Entry{conformanceKeyAC, "ac"}, Entry{conformanceKeyA, "a"}); err != nil {
+			return err
+		}
+		return expectEntries(r, Key{"c": "3"}, Entry{conformanceKeyAC, "ac"})
+	}},
+	{"Filter returns nothing when no entry contains the Key", func(r Registry) error {
+		setConformanceEntries(r)
+		if err := expectEntries(r, Key{"a": "2"}); err != nil {
+			return err
+		}
+		return expectEntries(r, Key{"a": "1", "d": "4"})
+	}},
+	{"Filter on an empty registry returns nothing", func(r Registry) error {
+		if err := expectEntries(r, Key{}); err != nil {
+			return err
+		}
+		return expectEntries(r, conformanceKeyA)
+	}},
+	{"Filter with the empty Key returns every entry", func(r Registry) error {
+		setConformanceEntries(r)
+		return expectEntries(r, Key{}, Entry{conformanceKeyAB, "ab"}, Entry{conformanceKeyAC, "ac"}, Entry{conformanceKeyA, "a"}, Entry{conformanceKeyD, "d"})
+	}},
+	{"Set overwrites the value of an existing Key", func(r Registry) error {
+		setConformanceEntries(r)
+		r.Set(Key{"b": "2", "a": "1"}, "new ab")
+		if err := expectValue(r, conformanceKeyAB, "new ab"); err != nil {
+			return err
+		}
+		return expectEntries(r, conformanceKeyAB, Entry{conformanceKeyAB, "new ab"})
+	}},
+	{"Delete removes only the exact Key", func(r Registry) error {
+		setConformanceEntries(r)
+		r.Delete(conformanceKeyA)
+		if err := expectValue(r, conformanceKeyA, nil); err != nil {
+			return err
+		}
+		if err := expectValue(r, conformanceKeyAB, "ab"); err != nil {
+			return err
+		}
+		return expectEntries(r, conformanceKeyA, Entry{conformanceKeyAB, "ab"}, Entry{conformanceKeyAC, "ac"})
+	}},
+	{"Delete of a Key that is not set changes nothing", func(r Registry) error {
+		setConformanceEntries(r)
+		r.Delete(Key{"a": "2"})
+		r.Delete(Key{"a": "1", "b": "2", "c": "3"})
+		return expectEntries(r, Key{}, Entry{conformanceKeyAB, "ab"}, Entry{conformanceKeyAC, "ac"}, Entry{conformanceKeyA, "a"}, Entry{conformanceKeyD, "d"})
+	}},
+	{"Filter after Delete leaves the deleted entry out", func(r Registry) error {
+		setConformanceEntries(r)
+		// Get and Filter first so any caches have the entry in them
+		r.Get(conformanceKeyAB)
+		r.Filter(conformanceKeyA)
+		r.Filter(Key{})
+		r.Delete(conformanceKeyAB)
+		if err := expectValue(r, conformanceKeyAB, nil); err != nil {
+			return err
+		}
+		if err := expectEntries(r, conformanceKeyA, Entry{conformanceKeyAC, "ac"}, Entry{conformanceKeyA, "a"}); err != nil {
+			return err
+		}
+		return expectEntries(r, Key{}, Entry{conformanceKeyAC, "ac"}, Entry{conformanceKeyA, "a"}, Entry{conformanceKeyD, "d"})
+	}},
+	{"Filter after Set of a new Key includes the new entry", func(r Registry) error {
+		setConformanceEntries(r)
+		// Filter first so any caches have the old results in them
+		r.Filter(conformanceKeyA)
+		r.Filter(Key{})
+		r.Filter(Key{"e": "5"})
+		k := Key{"a": "1", "e": "5"}
+		r.Set(k, "ae")
+		if err := expectEntries(r, conformanceKeyA, Entry{conformanceKeyAB, "ab"}, Entry{conformanceKeyAC, "ac"}, Entry{conformanceKeyA, "a"}, Entry{k, "ae"}); err != nil {
+			return err
+		}
+		if err := expectEntries(r, Key{"e": "5"}, Entry{k, "ae"}); err != nil {
+			return err
+		}
+		return expectEntries(r, Key{}, Entry{conformanceKeyAB, "ab"}, Entry{conformanceKeyAC, "ac"}, Entry{conformanceKeyA, "a"}, Entry{conformanceKeyD, "d"}, Entry{k, "ae"})
+	}},
+	{"Set after Delete adds the Key back", func(r Registry) error {
+		setConformanceEntries(r)
+		r.Delete(conformanceKeyAB)
+		r.Set(conformanceKeyAB, "ab again")
+		if err := expectValue(r, conformanceKeyAB, "ab again"); err != nil {
+			return err
+		}
+		return expectEntries(r, Key{"b": "2"}, Entry{conformanceKeyAB, "ab again"})
+	}},
+	{"The empty Key can be Set, Get and Deleted like any other", func(r Registry) error {
+		setConformanceEntries(r)
+		if err := expectValue(r, Key{}, nil); err != nil {
+			return err
+		}
+		r.Set(Key{}, "empty")
+		if err := expectValue(r, Key{}, "empty"); err != nil {
+			return err
+		}
+		if err := expectEntries(r, Key{}, Entry{Key{}, "empty"}, Entry{conformanceKeyAB, "ab"}, Entry{conformanceKeyAC, "ac"}, Entry{conformanceKeyA, "a"}, Entry{conformanceKeyD, "d"}); err != nil {
+			return err
+		}
+		if err := expectEntries(r, conformanceKeyD, Entry{conformanceKeyD, "d"}); err != nil {
+			return err
+		}
+		r.Delete(Key{})
+		if err := expectValue(r, Key{}, nil); err != nil {
+			return err
+		}
+		return expectEntries(r, Key{}, Entry{conformanceKeyAB, "ab"}, Entry{conformanceKeyAC, "ac"}, Entry{conformanceKeyA, "a"}, Entry{conformanceKeyD, "d"})
+	}},
+	{"A nil value is stored like any other value", func(r Registry) error {
+		r.Set(conformanceKeyAB, nil)
+		if err := expectValue(r, conformanceKeyAB, nil); err != nil {
+			return err
+		}
+		if err := expectEntries(r, conformanceKeyA, Entry{conformanceKeyAB, nil}); err != nil {
+			return err
+		}
+		r.Set(conformanceKeyAB, "ab")
+		if err := expectValue(r, conformanceKeyAB, "ab"); err != nil {
+			return err
+		}
+		r.Set(conformanceKeyAB, nil)
+		if err := expectEntries(r, Key{}, Entry{conformanceKeyAB, nil}); err != nil {
+			return err
+		}
+		r.Delete(conformanceKeyAB)
+		return expectEntries(r, Key{})
+	}},
+	{"Lookup and TryGet tell a nil value apart from a missing Key", func(r Registry) error {
+		r.Set(conformanceKeyAB, nil)
+		if i, ok := Lookup(r, conformanceKeyAB); i != nil || !ok {
+			return fmt.Errorf("Lookup(%v) = %v, %v, expected <nil>, true", conformanceKeyAB, i, ok)
+		}
+		if i, ok := Lookup(r, conformanceKeyA); i != nil || ok {
+			return fmt.Errorf("Lookup(%v) = %v, %v, expected <nil>, false", conformanceKeyA, i, ok)
+		}
+		if _, err := TryGet(r, conformanceKeyA); err != ErrKeyNotFound {
+			return fmt.Errorf("TryGet(%v) returned %v, expected %v", conformanceKeyA, err, ErrKeyNotFound)
+		}
+		if err := TrySet(r, conformanceKeyA, "a"); err != nil {
+			return fmt.Errorf("TrySet(%v) returned %v", conformanceKeyA, err)
+		}
+		if i, err := TryGet(r, conformanceKeyA); i != "a" || err != nil {
+			return fmt.Errorf("TryGet(%v) = %v, %v, expected a, <nil>", conformanceKeyA, i, err)
+		}
+		return nil
+	}},
+	{"TryDelete says when there was nothing to Delete", func(r Registry) error {
+		setConformanceEntries(r)
+		if err := TryDelete(r, conformanceKeyAB); err != nil {
+			return fmt.Errorf("TryDelete(%v) returned %v", conformanceKeyAB, err)
+		}
+		if err := TryDelete(r, conformanceKeyAB); err != ErrKeyNotFound {
+			return fmt.Errorf("TryDelete(%v) twice returned %v, expected %v", conformanceKeyAB, err, ErrKeyNotFound)
+		}
+		if err := TryDelete(r, Key{}); err != ErrKeyNotFound {
+			return fmt.Errorf("TryDelete(map[]) returned %v, expected %v", err, ErrKeyNotFound)
+		}
+		return expectEntries(r, Key{}, Entry{conformanceKeyAC, "ac"}, Entry{conformanceKeyA, "a"}, Entry{conformanceKeyD, "d"})
+	}},
+}
+
+func expectValue(r Registry, k Key, expected interface{}) error {
+	if i := r.Get(k); i != expected {
+		return fmt.Errorf("Get(%v) = %v, expected %v", k, i, expected)
+	}
+	return nil
+}
+
+func expectEntries(r Registry, k Key, expected ...Entry) error {
+	entries := r.Filter(k)
+	if !sameEntries(entries, expected) {
+		return fmt.Errorf("Filter(%v) = %v, expected %v", k, entries, expected)
+	}
+	return nil
+}
+
+// sameEntries checks both lists have the same entries, in any order
+func sameEntries(e1 []Entry, e2 []Entry) bool {
+	if len(e1) != len(e2) {
+		return false
+	}
+	s1, s2 := sortedEntries(e1), sortedEntries(e2)
+	for i := range s1 {
+		if !isEquals(s1[i].Key, s2[i].Key) || s1[i].Value != s2[i].Value {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedEntries(entries []Entry) []Entry {
+	sorted := append([]Entry{}, entries...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return toHashString(sorted[i].Key) < toHashString(sorted[j].Key)
+	})
+	return sorted
+}
@@ -0,0 +1,73 @@
+// +build all unit
+
+package registry
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// conformingRegistries are run through the same checks so they can't drift apart
+var conformingRegistries = map[string]func() Registry{
+	"simple":   func() Registry { return NewSimpleRegistry() },
+	"better":   func() Registry { return NewBetterRegistry() },
+	"cached":   func() Registry { return NewCacheRegistry(10) },
+	"safe":     func() Registry { return NewSafeRegistry(NewCacheRegistry(10)) },
+	"sharded":  func() Registry { return NewShardedRegistry(4) },
+	"expiring": func() Registry { return NewExpiringRegistry(NewCacheRegistry(10), time.Hour) },
+	"limited": func() Registry {
+		return NewLimitedRegistry(NewCacheRegistry(10), Limits{MaxEntries: 1000}, LimitReject)
+	},
+	"time series": func() Registry { return NewTimeSeriesRegistry(NewCacheRegistry(10), Retention{MaxSamples: 3}) },
+	"expiring limited": func() Registry {
+		return NewExpiringRegistry(NewLimitedRegistry(NewCacheRegistry(10), Limits{MaxEntries: 1000}, LimitReject), time.Hour)
+	},
+	"cached lfu":  func() Registry { return NewCacheRegistry(2, WithCachePolicy(LFUPolicy)) },
+	"cached arc":  func() Registry { return NewCacheRegistry(2, WithCachePolicy(ARCPolicy)) },
+	"cached weighted": func() Registry {
+		return NewCacheRegistry(10, WithGetCacheBudget(400, ByteWeigher), WithFilterCacheBudget(3, EntryWeigher))
+	},
+	"cached fingerprints": func() Registry { return NewCacheRegistry(2, WithFingerprintGets()) },
+	"cached tinylfu": func() Registry {
+		return NewCacheRegistry(2, WithGetCachePolicy(TinyLFUPolicy), WithFilterCachePolicy(TinyLFUPolicy))
+	},
+}
+
+var _ = Describe("Registry conformance", func() {
+	for name, newRegistry := range conformingRegistries {
+		newRegistry := newRegistry
+		Describe("Given a "+name+" registry", func() {
+			for _, c := range conformanceChecks {
+				c := c
+				It("Then "+c.name, func() {
+					Expect(c.check(newRegistry())).To(Succeed())
+				})
+			}
+		})
+	}
+
+	Describe("Given a WAL registry", func() {
+		for _, c := range conformanceChecks {
+			c := c
+			It("Then "+c.name, func() {
+				dir, err := os.MkdirTemp("", "wal")
+				Expect(err).ToNot(HaveOccurred())
+				defer os.RemoveAll(dir)
+				w, err := OpenWALRegistry(dir, NewCacheRegistry(10), WALOptions{})
+				Expect(err).ToNot(HaveOccurred())
+				defer w.Close()
+				Expect(c.check(w)).To(Succeed())
+			})
+		}
+	})
+})
+
+// TestRunConformanceTests runs the exported harness the way a registry outside of the package would
+func TestRunConformanceTests(t *testing.T) {
+	RunConformanceTests(t, func() Registry { return NewSimpleRegistry() })
+	RunConformanceTests(t, func() Registry { return NewSafeRegistry(NewCacheRegistry(10)) })
+}
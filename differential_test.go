@@ -0,0 +1,217 @@
+// +build all unit
+
+package registry
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+/*
+
+	SimpleRegistry is simple enough that we trust it, so it is used as the model every other
+	registry is checked against. Long random sequences of operations are run against both and
+	the first operation where they disagree fails the sequence. Failing sequences are shrunk
+	by throwing away operations until none can be removed without the failure going away,
+	which leaves a reproduction small enough to read.
+
+	Run with -ginkgo.seed to replay a failure.
+
+*/
+
+const (
+	differentialSequences      = 200 // How many random sequences of operations to run
+	differentialSequenceLength = 100 // How many operations are in each sequence
+)
+
+type operationType int
+
+const (
+	opSet operationType = iota
+	opSetAndReuseKey
+	opGet
+	opFilter
+	opFilterMatchers
+	opDelete
+	operationTypeCount
+)
+
+// operation is one call made against a registry
+type operation struct {
+	typ      operationType
+	key      Key
+	value    int
+	matchers []Matcher // Only used by opFilterMatchers
+}
+
+func (o operation) String() string {
+	switch o.typ {
+	case opSet:
+		return fmt.Sprintf("Set(%v, %d)", o.key, o.value)
+	case opSetAndReuseKey:
+		return fmt.Sprintf("Set(%v, %d) and then change the Key", o.key, o.value)
+	case opGet:
+		return fmt.Sprintf("Get(%v)", o.key)
+	case opFilter:
+		return fmt.Sprintf("Filter(%v)", o.key)
+	case opFilterMatchers:
+		return fmt.Sprintf("FilterMatchers(%v)", o.matchers)
+	}
+	return fmt.Sprintf("Delete(%v)", o.key)
+}
+
+// randomKey picks from a small set of labels and values so keys overlap a lot
+func randomKey(rnd *rand.Rand, maxLabels int) Key {
+	k := Key{}
+	for i := rnd.Intn(maxLabels + 1); i > 0; i-- {
+		k["l"+strconv.Itoa(rnd.Intn(3))] = "v" + strconv.Itoa(rnd.Intn(2))
+	}
+	return k
+}
+
+// randomMatchers returns up to three matchers of any type on the same labels and values randomKey uses
+func randomMatchers(rnd *rand.Rand) []Matcher {
+	values := []string{"v0", "v1", "", "v.*", "v[1-9]"}
+	ms := []Matcher{}
+	for i := rnd.Intn(4); i > 0; i-- {
+		m, err := NewMatcher(MatchType(rnd.Intn(6)), "l"+strconv.Itoa(rnd.Intn(3)), values[rnd.Intn(len(values))])
+		if err != nil {
+			panic(err)
+		}
+		ms = append(ms, m)
+	}
+	return ms
+}
+
+func randomOperations(rnd *rand.Rand, n int) []operation {
+	ops := make([]operation, n)
+	for i := range ops {
+		ops[i] = operation{
+			typ:      operationType(rnd.Intn(int(operationTypeCount))),
+			key:      randomKey(rnd, 3),
+			value:    rnd.Intn(10),
+			matchers: randomMatchers(rnd),
+		}
+	}
+	return ops
+}
+
+// checkAgainstSimple runs ops against r and a SimpleRegistry and returns an error at the first
+// operation where they don't agree
+func checkAgainstSimple(r Registry, ops []operation) error {
+	model := NewSimpleRegistry()
+	for i, op := range ops {
+		// every call gets its own copy of the Key so one registry can't change what the other sees
+		switch op.typ {
+		case opSet:
+			r.Set(copyKey(op.key), op.value)
+			model.Set(copyKey(op.key), op.value)
+		case opSetAndReuseKey:
+			k := copyKey(op.key)
+			r.Set(k, op.value)
+			k["reused"] = "yes"
+			model.Set(copyKey(op.key), op.value)
+		case opGet:
+			if actual, expected := r.Get(copyKey(op.key)), model.Get(copyKey(op.key)); actual != expected {
+				return fmt.Errorf("operation %d %v = %v, expected %v", i, op, actual, expected)
+			}
+		case opFilter:
+			if actual, expected := r.Filter(copyKey(op.key)), model.Filter(copyKey(op.key)); !sameEntries(actual, expected) {
+				return fmt.Errorf("operation %d %v = %v, expected %v", i, op, actual, expected)
+			}
+		case opFilterMatchers:
+			if actual, expected := FilterMatchers(r, op.matchers...), model.FilterMatchers(op.matchers...); !sameEntries(actual, expected) {
+				return fmt.Errorf("operation %d %v = %v, expected %v", i, op, actual, expected)
+			}
+		case opDelete:
+			r.Delete(copyKey(op.key))
+			model.Delete(copyKey(op.key))
+		}
+	}
+	// Whatever state we ended up in, everything should still be there
+	if actual, expected := r.Filter(Key{}), model.Filter(Key{}); !sameEntries(actual, expected) {
+		return fmt.Errorf("after all operations Filter(map[]) = %v, expected %v", actual, expected)
+	}
+	return nil
+}
+
+// shrink removes operations from a failing sequence, big chunks first, for as long as it keeps failing
+func shrink(newRegistry func() Registry, ops []operation) []operation {
+	for chunk := len(ops) / 2; chunk >= 1; chunk /= 2 {
+		for i := 0; i+chunk <= len(ops); {
+			candidate := append(append([]operation{}, ops[:i]...), ops[i+chunk:]...)
+			if checkAgainstSimple(newRegistry(), candidate) != nil {
+				ops = candidate
+				continue
+			}
+			i += chunk
+		}
+	}
+	return ops
+}
+
+// checkRandomSequences fails with the shrunk sequence of the first random sequence that doesn't agree with SimpleRegistry
+func checkRandomSequences(newRegistry func() Registry) {
+	rnd := rand.New(rand.NewSource(GinkgoRandomSeed()))
+	for i := 0; i < differentialSequences; i++ {
+		ops := randomOperations(rnd, differentialSequenceLength)
+		if err := checkAgainstSimple(newRegistry(), ops); err != nil {
+			ops = shrink(newRegistry, ops)
+			Fail(fmt.Sprintf("%v\nshrunk to %d operations: %v", checkAgainstSimple(newRegistry(), ops), len(ops), ops))
+		}
+	}
+}
+
+// forgetfulRegistry never deletes keys with more than one label so shrink has something to find
+type forgetfulRegistry struct {
+	*SimpleRegistry
+}
+
+func (f forgetfulRegistry) Delete(k Key) {
+	if len(k) < 2 {
+		f.SimpleRegistry.Delete(k)
+	}
+}
+
+var _ = Describe("Differential testing", func() {
+	Describe("Given random sequences of Set, Get, Filter and Delete", func() {
+		for name, newRegistry := range conformingRegistries {
+			name, newRegistry := name, newRegistry
+			It("Then the "+name+" registry should always agree with the simple registry", func() {
+				checkRandomSequences(newRegistry)
+			})
+		}
+		for _, cacheSize := range []int{1, 3} {
+			cacheSize := cacheSize
+			It(fmt.Sprintf("Then the cached registry with a cache size of %d should always agree with the simple registry", cacheSize), func() {
+				checkRandomSequences(func() Registry { return NewCacheRegistry(cacheSize) })
+			})
+		}
+	})
+	Describe("Given a failing sequence of operations", func() {
+		Context("When it is shrunk", func() {
+			It("Then only the operations needed to fail should be left", func() {
+				newRegistry := func() Registry { return forgetfulRegistry{NewSimpleRegistry()} }
+				k := Key{"a": "1", "b": "2"}
+				ops := []operation{
+					{typ: opSet, key: Key{"c": "3"}, value: 1},
+					{typ: opSet, key: k, value: 2},
+					{typ: opGet, key: k},
+					{typ: opFilter, key: Key{"c": "3"}},
+					{typ: opDelete, key: Key{"c": "3"}},
+					{typ: opDelete, key: k},
+					{typ: opSet, key: Key{"d": "4"}, value: 3},
+				}
+				Expect(checkAgainstSimple(newRegistry(), ops)).ToNot(Succeed())
+				Expect(shrink(newRegistry, ops)).To(Equal([]operation{
+					{typ: opSet, key: k, value: 2},
+					{typ: opDelete, key: k},
+				}))
+			})
+		})
+	})
+})
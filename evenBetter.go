@@ -1,157 +1,284 @@
-package registry
-
-import (
-	"reflect"
-)
-
-/*
-
-	As I was writing CachedRegistry, I realized that I should just rewrite Better Registry
-	with new specs and use that in CachedRegistry so things will be cleaner. This is
-	conceptually BetterRegistry with things moved around with better organization
-
-*/
-
-type EvenBetterRegistry struct {
-	registry map[string]map[string]hashEntries
-}
-
-// hashEntry is essentially a Entry with an array which includes all the hashes this Entry is in
-type hashEntry struct {
-	keys            Key
-	value           interface{}
-	getCacheKey     string   // A formed hash key (could be empty) for which this hashEntry is referred to in the cache
-	filterCacheKeys []string // List of form hash keys (string) for which this hashEntry is referred to in the cache
-}
-
-func NewEvenBetterRegistry() *EvenBetterRegistry {
-	return &EvenBetterRegistry{
-		registry: map[string]map[string]hashEntries{},
-	}
-}
-
-func (r *EvenBetterRegistry) Get(k Key) (*hashEntry, error) {
-	hashEntries := r.getHashEntriesForKey(k)
-	entries := findUnionOfHashEntries(hashEntries)
-	var hashEntry *hashEntry
-	for _, entry := range entries {
-		if len(entry.keys) == len(k) {
-			hashEntry = entry
-		}
-	}
-	if hashEntry == nil {
-		return nil, keyNotFound
-	}
-	hashEntry.getCacheKey = toHashString(k)
-	return hashEntry, nil
-}
-
-func (r *EvenBetterRegistry) Filter(k Key) hashEntries {
-	hashEntries := r.getHashEntriesForKey(k)
-	return findUnionOfHashEntries(hashEntries)
-}
-
-func (r *EvenBetterRegistry) Set(k Key, i interface{}) {
-	entry, err := r.Get(k)
-	if err != nil {
-		newEntry := &hashEntry{
-			keys:            k,
-			value:           i,
-			getCacheKey:     "",
-			filterCacheKeys: []string{},
-		}
-		r.addHashEntry(newEntry)
-		return
-	}
-	entry.value = i
-}
-
-func (r *EvenBetterRegistry) Delete(k Key) *hashEntry {
-	var entry *hashEntry
-	for key, value := range k {
-		e := r.removeEntryFromAKey(key, value, k)
-		if e == nil {
-			return nil
-		}
-		entry = e
-	}
-	return entry
-}
-
-func (r *EvenBetterRegistry) removeEntryFromAKey(key string, value string, completeKey Key) *hashEntry {
-	values, ok := r.registry[key]
-	if !ok {
-		return nil
-	}
-	hashEntries, ok := values[value]
-	if !ok {
-		return nil
-	}
-	hashEntries, entry := removeFromHashEntries(hashEntries, completeKey)
-	if entry == nil {
-		return nil
-	}
-	// Some clean up before leaving
-	if len(hashEntries) == 0 {
-		delete(values, value)
-	}
-	if len(values) == 0 {
-		delete(r.registry, key)
-	}
-	return entry
-}
-
-func removeFromHashEntries(entries hashEntries, k Key) (hashEntries, *hashEntry) {
-	for i, e := range entries {
-		if reflect.DeepEqual(e.keys, k) {
-			entries = append(entries[:i], entries[i+1:]...)
-			return entries, e
-		}
-	}
-	return entries, nil
-}
-
-// getHashEntriesForKey returns all hashKeys that contain Key (which means the Key can contain MORE than the given Key)
-func (r *EvenBetterRegistry) getHashEntriesForKey(k Key) map[string]hashEntries {
-	hashKeys := map[string]hashEntries{}
-	for key, value := range k {
-		_, ok := r.registry[key]
-		if !ok {
-			hashKeys[key] = hashEntries{}
-			continue
-		}
-		hashEntry, ok := r.registry[key][value]
-		if !ok {
-			hashKeys[key] = hashEntries{}
-			continue
-		}
-		hashKeys[key] = hashEntry
-	}
-	return hashKeys
-}
-
-func findUnionOfHashEntries(m map[string]hashEntries) hashEntries {
-	counter := map[*hashEntry]int{}
-	for _, entries := range m {
-		for _, entry := range entries {
-			counter[entry]++
-		}
-	}
-	entries := hashEntries{}
-	for entry, count := range counter {
-		if count == len(m) {
-			entries = append(entries, entry)
-		}
-	}
-	return entries
-}
-
-func (r *EvenBetterRegistry) addHashEntry(e *hashEntry) {
-	for key, value := range e.keys {
-		_, ok := r.registry[key]
-		if !ok {
-			r.registry[key] = map[string]hashEntries{}
-		}
-		r.registry[key][value] = append(r.registry[key][value], e)
-	}
-}
+package registry
+
+import (
+	"reflect"
+)
+
+/*
+
+	As I was writing CachedRegistry, I realized that I should just rewrite Better Registry
+	with new specs and use that in CachedRegistry so things will be cleaner. This is
+	conceptually BetterRegistry with things moved around with better organization
+
+	Get finds the entry with the exact Key by intersecting the entries under each of its
+	labels, which allocates and gets slower the more entries share a label. After
+	indexFingerprints it looks the Key's fingerprint up in a map instead and compares the
+	Keys of whatever is there, since different Keys can share a fingerprint.
+
+*/
+
+type EvenBetterRegistry struct {
+	registry   map[string]map[string]hashEntries
+	unlabelled *hashEntry // The hashEntry with the empty Key. It has no key value pairs to be found under in registry
+	// Every labelled hashEntry by the fingerprint of its Key, nil unless indexFingerprints was called
+	fingerprints map[uint64]hashEntries
+}
+
+// hashEntry is essentially a Entry with an array which includes all the hashes this Entry is in
+type hashEntry struct {
+	keys            Key
+	value           interface{}
+	getCacheKey     string   // A formed hash key (could be empty) for which this hashEntry is referred to in the cache
+	filterCacheKeys []string // List of form hash keys (string) for which this hashEntry is referred to in the cache
+}
+
+func NewEvenBetterRegistry() *EvenBetterRegistry {
+	return &EvenBetterRegistry{
+		registry: map[string]map[string]hashEntries{},
+	}
+}
+
+func (r *EvenBetterRegistry) Get(k Key) (*hashEntry, error) {
+	if len(k) == 0 {
+		if r.unlabelled == nil {
+			return nil, ErrKeyNotFound
+		}
+		return r.unlabelled, nil
+	}
+	if r.fingerprints != nil {
+		return r.getByFingerprint(k)
+	}
+	hashEntries := r.getHashEntriesForKey(k)
+	entries := findUnionOfHashEntries(hashEntries)
+	var hashEntry *hashEntry
+	for _, entry := range entries {
+		if len(entry.keys) == len(k) {
+			hashEntry = entry
+		}
+	}
+	if hashEntry == nil {
+		return nil, ErrKeyNotFound
+	}
+	return hashEntry, nil
+}
+
+// getByFingerprint returns the hashEntry with the exact Key from the fingerprint index
+func (r *EvenBetterRegistry) getByFingerprint(k Key) (*hashEntry, error) {
+	for _, entry := range r.fingerprints[keyFingerprint(k)] {
+		// Another Key can have the same fingerprint
+		if isEquals(entry.keys, k) {
+			return entry, nil
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+// indexFingerprints starts keeping every hashEntry by the fingerprint of its Key so Get is a single lookup
+func (r *EvenBetterRegistry) indexFingerprints() {
+	r.fingerprints = map[uint64]hashEntries{}
+	for _, entry := range r.all() {
+		if entry != r.unlabelled {
+			r.addFingerprint(entry)
+		}
+	}
+}
+
+func (r *EvenBetterRegistry) addFingerprint(entry *hashEntry) {
+	fingerprint := keyFingerprint(entry.keys)
+	r.fingerprints[fingerprint] = append(r.fingerprints[fingerprint], entry)
+}
+
+func (r *EvenBetterRegistry) removeFingerprint(entry *hashEntry) {
+	fingerprint := keyFingerprint(entry.keys)
+	entries := r.fingerprints[fingerprint]
+	for i, e := range entries {
+		if e == entry {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+	if len(entries) == 0 {
+		delete(r.fingerprints, fingerprint)
+		return
+	}
+	r.fingerprints[fingerprint] = entries
+}
+
+// Filter returns every hashEntry that contains Key. The empty Key is in every hashEntry so that returns all of them
+func (r *EvenBetterRegistry) Filter(k Key) hashEntries {
+	if len(k) == 0 {
+		return r.all()
+	}
+	hashEntries := r.getHashEntriesForKey(k)
+	return findUnionOfHashEntries(hashEntries)
+}
+
+// FilterMatchers returns every hashEntry whose Key satisfies all the matchers. Equal matchers are looked up
+// in the index, or if there are none, a Present matcher is. The rest are checked against what is left
+func (r *EvenBetterRegistry) FilterMatchers(ms ...Matcher) hashEntries {
+	k := equalKey(ms)
+	var candidates hashEntries
+	if name, ok := firstPresentName(ms); ok && len(k) == 0 {
+		// A hashEntry is only under one value of a key so there is nothing to dedupe
+		candidates = hashEntries{}
+		for _, hashEntriesWithKey := range r.registry[name] {
+			candidates = append(candidates, hashEntriesWithKey...)
+		}
+	} else {
+		candidates = r.Filter(k)
+	}
+	matched := hashEntries{}
+	for _, entry := range candidates {
+		if matchesAll(entry.keys, ms) {
+			matched = append(matched, entry)
+		}
+	}
+	return matched
+}
+
+// all returns every hashEntry once, even though each one is in the registry once per key
+func (r *EvenBetterRegistry) all() hashEntries {
+	seen := map[*hashEntry]bool{}
+	entries := hashEntries{}
+	if r.unlabelled != nil {
+		entries = append(entries, r.unlabelled)
+	}
+	for _, values := range r.registry {
+		for _, hashEntriesWithKey := range values {
+			for _, entry := range hashEntriesWithKey {
+				if !seen[entry] {
+					seen[entry] = true
+					entries = append(entries, entry)
+				}
+			}
+		}
+	}
+	return entries
+}
+
+func (r *EvenBetterRegistry) Set(k Key, i interface{}) {
+	entry, _ := r.getOrAdd(k)
+	entry.value = i
+}
+
+// getOrAdd returns the hashEntry with the exact Key, adding an empty one if there is none
+func (r *EvenBetterRegistry) getOrAdd(k Key) (*hashEntry, bool) {
+	entry, err := r.Get(k)
+	if err == nil {
+		return entry, false
+	}
+	entry = &hashEntry{
+		keys:            copyKey(k),
+		getCacheKey:     "",
+		filterCacheKeys: []string{},
+	}
+	r.addHashEntry(entry)
+	return entry, true
+}
+
+func (r *EvenBetterRegistry) Delete(k Key) *hashEntry {
+	if len(k) == 0 {
+		entry := r.unlabelled
+		r.unlabelled = nil
+		return entry
+	}
+	// Find the entry first so it is either removed from every key or not touched at all
+	entry, err := r.Get(k)
+	if err != nil {
+		return nil
+	}
+	for key, value := range entry.keys {
+		r.removeEntryFromAKey(key, value, entry)
+	}
+	if r.fingerprints != nil {
+		r.removeFingerprint(entry)
+	}
+	return entry
+}
+
+func (r *EvenBetterRegistry) removeEntryFromAKey(key string, value string, entry *hashEntry) {
+	values, ok := r.registry[key]
+	if !ok {
+		return
+	}
+	hashEntries, ok := values[value]
+	if !ok {
+		return
+	}
+	for i, e := range hashEntries {
+		if e == entry {
+			hashEntries = append(hashEntries[:i], hashEntries[i+1:]...)
+			break
+		}
+	}
+	values[value] = hashEntries
+	// Some clean up before leaving
+	if len(hashEntries) == 0 {
+		delete(values, value)
+	}
+	if len(values) == 0 {
+		delete(r.registry, key)
+	}
+}
+
+func removeFromHashEntries(entries hashEntries, k Key) (hashEntries, *hashEntry) {
+	for i, e := range entries {
+		if reflect.DeepEqual(e.keys, k) {
+			entries = append(entries[:i], entries[i+1:]...)
+			return entries, e
+		}
+	}
+	return entries, nil
+}
+
+// getHashEntriesForKey returns all hashKeys that contain Key (which means the Key can contain MORE than the given Key)
+func (r *EvenBetterRegistry) getHashEntriesForKey(k Key) map[string]hashEntries {
+	hashKeys := map[string]hashEntries{}
+	for key, value := range k {
+		_, ok := r.registry[key]
+		if !ok {
+			hashKeys[key] = hashEntries{}
+			continue
+		}
+		hashEntry, ok := r.registry[key][value]
+		if !ok {
+			hashKeys[key] = hashEntries{}
+			continue
+		}
+		hashKeys[key] = hashEntry
+	}
+	return hashKeys
+}
+
+func findUnionOfHashEntries(m map[string]hashEntries) hashEntries {
+	counter := map[*hashEntry]int{}
+	for _, entries := range m {
+		for _, entry := range entries {
+			counter[entry]++
+		}
+	}
+	entries := hashEntries{}
+	for entry, count := range counter {
+		if count == len(m) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (r *EvenBetterRegistry) addHashEntry(e *hashEntry) {
+	if len(e.keys) == 0 {
+		r.unlabelled = e
+		return
+	}
+	if r.fingerprints != nil {
+		r.addFingerprint(e)
+	}
+	for key, value := range e.keys {
+		_, ok := r.registry[key]
+		if !ok {
+			r.registry[key] = map[string]hashEntries{}
+		}
+		r.registry[key][value] = append(r.registry[key][value], e)
+	}
+}
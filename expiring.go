@@ -0,0 +1,345 @@
+package registry
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+
+	Entries stay in a registry until someone Deletes them, so series from things that have
+	gone away pile up and make every Filter slower. ExpiringRegistry wraps a registry and
+	remembers when each Key was last written. Set, Update and GetOrCreate all count as a
+	write, since a Counter registered with GetOrCreate is updated without ever being Set
+	again, but only once the wrapped registry has stored the value: a Key a LimitedRegistry
+	turned away has nothing to expire. A Key that hasn't been written for its TTL is expired.
+
+	Expired entries are removed with Delete on the wrapped registry, so a CachedRegistry
+	cleans up its caches like it would for any other Delete. Get and Filter never return an
+	expired entry: they remove the ones they come across. Entries nobody asks for are only
+	removed by Expire, which the janitor started with Start calls every interval.
+
+	Since the janitor runs on its own goroutine, ExpiringRegistry has a lock of its own,
+	unlike the other registries. The OnExpire hook is called after the lock is released so
+	it can use the registry. Update and GetOrCreate call back into the caller with the lock
+	held, so they release it in a defer and a panic in the callback doesn't leave it locked.
+
+*/
+
+var (
+	intervalNotPositive = errors.New("Interval must be more than zero")
+)
+
+// ExpiringRegistry removes entries that haven't been written to for a while
+type ExpiringRegistry struct {
+	lock     sync.Mutex
+	registry Registry
+	ttl      time.Duration
+	expiries map[string]*expiry // Keyed by the hash of the Key
+	onExpire func(e Entry)
+	now      func() time.Time
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+type expiry struct {
+	key      Key
+	ttl      time.Duration
+	deadline time.Time // Zero for entries that never expire
+}
+
+// NewExpiringRegistry wraps r, which should be empty, so entries expire ttl after they were last written
+// A ttl of zero or less means entries only expire if they are Set with their own TTL
+func NewExpiringRegistry(r Registry, ttl time.Duration) *ExpiringRegistry {
+	return &ExpiringRegistry{
+		registry: r,
+		ttl:      ttl,
+		expiries: map[string]*expiry{},
+		now:      time.Now,
+	}
+}
+
+// OnExpire sets a function to call with every entry that expires
+func (e *ExpiringRegistry) OnExpire(fn func(e Entry)) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.onExpire = fn
+}
+
+// Get returns the value that matches the key exactly, nil if it has expired
+func (e *ExpiringRegistry) Get(k Key) interface{} {
+	e.lock.Lock()
+	if expired := e.expireKey(k); len(expired) > 0 {
+		e.unlockAndNotify(expired)
+		return nil
+	}
+	defer e.lock.Unlock()
+	return e.registry.Get(k)
+}
+
+// Lookup returns the value at k and whether there is an entry at k that hasn't expired
+func (e *ExpiringRegistry) Lookup(k Key) (interface{}, bool) {
+	e.lock.Lock()
+	if expired := e.expireKey(k); len(expired) > 0 {
+		e.unlockAndNotify(expired)
+		return nil, false
+	}
+	defer e.lock.Unlock()
+	return Lookup(e.registry, k)
+}
+
+// TryGet returns the value at k or ErrKeyNotFound if there is none or it has expired
+func (e *ExpiringRegistry) TryGet(k Key) (interface{}, error) {
+	i, ok := e.Lookup(k)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return i, nil
+}
+
+// Filter returns a list of entries that contain the key and haven't expired
+func (e *ExpiringRegistry) Filter(k Key) []Entry {
+	e.lock.Lock()
+	entries, expired := e.withoutExpired(e.registry.Filter(k))
+	e.unlockAndNotify(expired)
+	return entries
+}
+
+// FilterMatchers returns a list of entries whose Key satisfies all the matchers and haven't expired
+func (e *ExpiringRegistry) FilterMatchers(ms ...Matcher) []Entry {
+	e.lock.Lock()
+	entries, expired := e.withoutExpired(FilterMatchers(e.registry, ms...))
+	e.unlockAndNotify(expired)
+	return entries
+}
+
+// Set replaces or creates new entry with key and value that expires after the registry's TTL
+func (e *ExpiringRegistry) Set(k Key, i interface{}) {
+	e.SetWithTTL(k, i, e.ttl)
+}
+
+// SetWithTTL replaces or creates new entry with key and value that expires after ttl
+// A ttl of zero or less means the entry never expires
+func (e *ExpiringRegistry) SetWithTTL(k Key, i interface{}, ttl time.Duration) {
+	e.TrySetWithTTL(k, i, ttl)
+}
+
+// TrySet is Set but returns why the wrapped registry couldn't store the value
+func (e *ExpiringRegistry) TrySet(k Key, i interface{}) error {
+	return e.TrySetWithTTL(k, i, e.ttl)
+}
+
+// TrySetWithTTL is SetWithTTL but returns why the wrapped registry couldn't store the value
+func (e *ExpiringRegistry) TrySetWithTTL(k Key, i interface{}, ttl time.Duration) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if err := TrySet(e.registry, k, i); err != nil {
+		return err
+	}
+	e.touch(k, ttl)
+	return nil
+}
+
+// Update replaces the value at k with what fn returns and refreshes its TTL
+func (e *ExpiringRegistry) Update(k Key, fn func(old interface{}) interface{}) {
+	var n notification
+	defer n.send()
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	n = e.notification(e.expireKey(k))
+	Update(e.registry, k, fn)
+	// Update can't say if the wrapped registry stored the value
+	if _, ok := Lookup(e.registry, k); ok {
+		e.refresh(k)
+	}
+}
+
+// GetOrCreate returns the value at k or Sets the value from create, either way its TTL is refreshed
+func (e *ExpiringRegistry) GetOrCreate(k Key, create func() interface{}) (interface{}, bool) {
+	i, created, _ := e.TryGetOrCreate(k, create)
+	return i, created
+}
+
+// TryGetOrCreate is GetOrCreate but returns why the wrapped registry couldn't store the value from create
+func (e *ExpiringRegistry) TryGetOrCreate(k Key, create func() interface{}) (interface{}, bool, error) {
+	var n notification
+	defer n.send()
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	n = e.notification(e.expireKey(k))
+	i, created, err := TryGetOrCreate(e.registry, k, create)
+	if err != nil {
+		return nil, false, err
+	}
+	e.refresh(k)
+	return i, created, nil
+}
+
+// Delete removes an entry from the registry
+func (e *ExpiringRegistry) Delete(k Key) {
+	e.TryDelete(k)
+}
+
+// TryDelete removes an entry from the registry or returns ErrKeyNotFound if there is none
+func (e *ExpiringRegistry) TryDelete(k Key) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	delete(e.expiries, toHashString(k))
+	return TryDelete(e.registry, k)
+}
+
+// Expire removes every entry past its TTL and returns how many there were
+func (e *ExpiringRegistry) Expire() int {
+	e.lock.Lock()
+	now := e.now()
+	expired := []Entry{}
+	for hash := range e.expiries {
+		if entry := e.expireIfPast(hash, now); entry != nil {
+			expired = append(expired, *entry)
+		}
+	}
+	e.unlockAndNotify(expired)
+	return len(expired)
+}
+
+// Start runs Expire every interval on its own goroutine until Stop is called
+// It fails if the interval isn't more than zero and does nothing if the janitor is already running
+func (e *ExpiringRegistry) Start(interval time.Duration) error {
+	if interval <= 0 {
+		return intervalNotPositive
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.stop != nil {
+		return nil
+	}
+	e.stop = make(chan struct{})
+	e.stopped = make(chan struct{})
+	go e.janitor(interval, e.stop, e.stopped)
+	return nil
+}
+
+// Stop stops the janitor and waits for it to finish
+func (e *ExpiringRegistry) Stop() {
+	e.lock.Lock()
+	stop, stopped := e.stop, e.stopped
+	e.stop, e.stopped = nil, nil
+	e.lock.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-stopped
+}
+
+func (e *ExpiringRegistry) janitor(interval time.Duration, stop chan struct{}, stopped chan struct{}) {
+	defer close(stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.Expire()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// touch gives the key a new ttl and moves its deadline to ttl from now
+func (e *ExpiringRegistry) touch(k Key, ttl time.Duration) {
+	hash := toHashString(k)
+	exp, ok := e.expiries[hash]
+	if !ok {
+		exp = &expiry{key: copyKey(k)}
+		e.expiries[hash] = exp
+	}
+	exp.ttl = ttl
+	exp.deadline = time.Time{}
+	if ttl > 0 {
+		exp.deadline = e.now().Add(ttl)
+	}
+}
+
+// refresh moves the key's deadline keeping the ttl it was Set with, new keys get the registry's TTL
+func (e *ExpiringRegistry) refresh(k Key) {
+	ttl := e.ttl
+	if exp, ok := e.expiries[toHashString(k)]; ok {
+		ttl = exp.ttl
+	}
+	e.touch(k, ttl)
+}
+
+// expireKey expires the key if its deadline has passed
+func (e *ExpiringRegistry) expireKey(k Key) []Entry {
+	if entry := e.expireIfPast(toHashString(k), e.now()); entry != nil {
+		return []Entry{*entry}
+	}
+	return nil
+}
+
+// expireIfPast Deletes the key with the hash if its deadline has passed and returns what was removed
+// A key the wrapped registry doesn't have, like one a LimitDrop threw away, is forgotten without a notification
+func (e *ExpiringRegistry) expireIfPast(hash string, now time.Time) *Entry {
+	exp, ok := e.expiries[hash]
+	if !ok || exp.deadline.IsZero() || now.Before(exp.deadline) {
+		return nil
+	}
+	delete(e.expiries, hash)
+	value, ok := Lookup(e.registry, exp.key)
+	if !ok {
+		return nil
+	}
+	e.registry.Delete(exp.key)
+	return &Entry{
+		Key:   exp.key,
+		Value: value,
+	}
+}
+
+// withoutExpired removes the expired entries from the registry and the list
+func (e *ExpiringRegistry) withoutExpired(entries []Entry) ([]Entry, []Entry) {
+	now := e.now()
+	live := make([]Entry, 0, len(entries))
+	expired := []Entry{}
+	for _, entry := range entries {
+		if gone := e.expireIfPast(toHashString(entry.Key), now); gone != nil {
+			expired = append(expired, *gone)
+			continue
+		}
+		live = append(live, entry)
+	}
+	return live, expired
+}
+
+// unlockAndNotify releases the lock and then calls the OnExpire hook with every expired entry
+func (e *ExpiringRegistry) unlockAndNotify(expired []Entry) {
+	n := e.notification(expired)
+	e.lock.Unlock()
+	n.send()
+}
+
+// notification is what to tell the OnExpire hook once the lock is released
+type notification struct {
+	onExpire func(e Entry)
+	expired  []Entry
+}
+
+// notification captures the hook for the expired entries, the lock has to be held
+func (e *ExpiringRegistry) notification(expired []Entry) notification {
+	return notification{
+		onExpire: e.onExpire,
+		expired:  expired,
+	}
+}
+
+// send calls the hook with every expired entry
+func (n *notification) send() {
+	if n.onExpire == nil {
+		return
+	}
+	for _, entry := range n.expired {
+		n.onExpire(entry)
+	}
+}
@@ -0,0 +1,220 @@
+// +build all unit
+
+package registry
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Expiring registry", func() {
+	var inner *CachedRegistry
+	var e *ExpiringRegistry
+	var now time.Time
+	var expired []Entry
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	api := Key{"service": "api", "pod": "a"}
+	db := Key{"service": "db", "pod": "b"}
+
+	// after moves the clock to t seconds after start
+	after := func(seconds int) {
+		now = start.Add(time.Duration(seconds) * time.Second)
+	}
+
+	BeforeEach(func() {
+		inner = NewCacheRegistry(10)
+		e = NewExpiringRegistry(inner, time.Minute)
+		now = start
+		e.now = func() time.Time { return now }
+		expired = []Entry{}
+		e.OnExpire(func(entry Entry) {
+			expired = append(expired, entry)
+		})
+		e.Set(api, 1)
+		e.Set(db, 2)
+	})
+
+	Describe("Given entries that haven't been written for longer than the TTL", func() {
+		BeforeEach(func() {
+			after(30)
+			e.Set(db, 3)
+			after(61)
+		})
+		Context("When they are Get", func() {
+			It("Then they should be gone and the hook should be called", func() {
+				Expect(e.Get(api)).To(BeNil())
+				Expect(e.Get(db)).To(Equal(3))
+				Expect(expired).To(Equal([]Entry{{api, 1}}))
+			})
+		})
+		Context("When they are Filtered", func() {
+			It("Then they should be left out and removed from the wrapped registry", func() {
+				Expect(e.Filter(Key{})).To(ConsistOf(Entry{db, 3}))
+				Expect(inner.Filter(Key{})).To(ConsistOf(Entry{db, 3}))
+				Expect(expired).To(Equal([]Entry{{api, 1}}))
+			})
+		})
+		Context("When Expire is called", func() {
+			It("Then only the expired ones should be deleted", func() {
+				Expect(e.Expire()).To(Equal(1))
+				Expect(inner.Get(api)).To(BeNil())
+				Expect(inner.Get(db)).To(Equal(3))
+				Expect(e.Expire()).To(Equal(0))
+			})
+			It("Then the caches of the wrapped registry should be cleaned up too", func() {
+				Expect(inner.Filter(Key{"service": "api"})).To(HaveLen(1))
+				e.Expire()
+				Expect(inner.Filter(Key{"service": "api"})).To(BeEmpty())
+			})
+		})
+		Context("When they are Set again", func() {
+			It("Then they should be new entries", func() {
+				e.Set(api, 4)
+				Expect(e.Get(api)).To(Equal(4))
+				after(120)
+				Expect(e.Get(api)).To(Equal(4))
+			})
+		})
+	})
+	Describe("Given a Counter registered with GetOrCreate", func() {
+		Context("When it keeps being looked up", func() {
+			It("Then it shouldn't expire", func() {
+				k := Key{"__name__": "requests_total"}
+				c, err := GetOrRegisterCounter(e, k)
+				Expect(err).To(BeNil())
+				for i := 1; i <= 3; i++ {
+					after(i * 50)
+					same, err := GetOrRegisterCounter(e, k)
+					Expect(err).To(BeNil())
+					Expect(same).To(BeIdenticalTo(c))
+				}
+				after(211)
+				Expect(e.Get(k)).To(BeNil())
+			})
+		})
+	})
+	Describe("Given a wrapped registry that turns Keys away", func() {
+		var full *ExpiringRegistry
+		over := Key{"service": "over"}
+		for name, policy := range map[string]LimitPolicy{"LimitReject": LimitReject, "LimitDrop": LimitDrop} {
+			policy := policy
+			Context("When a Key over the limit is written with "+name, func() {
+				It("Then it shouldn't be expired later since it was never stored", func() {
+					full = NewExpiringRegistry(NewLimitedRegistry(NewCacheRegistry(10), Limits{MaxEntries: 1}, policy), time.Minute)
+					full.now = func() time.Time { return now }
+					notified := []Entry{}
+					full.OnExpire(func(entry Entry) {
+						notified = append(notified, entry)
+					})
+					full.Set(api, 1)
+					full.Set(over, 1)
+					full.Update(over, func(interface{}) interface{} { return 2 })
+					full.GetOrCreate(over, func() interface{} { return 3 })
+					after(61)
+					Expect(full.Expire()).To(Equal(1))
+					Expect(notified).To(Equal([]Entry{{api, 1}}))
+				})
+			})
+		}
+	})
+	Describe("Given an entry Set with its own TTL", func() {
+		BeforeEach(func() {
+			e.SetWithTTL(api, 5, 10*time.Second)
+			e.SetWithTTL(db, 6, 0)
+		})
+		Context("When its TTL has passed", func() {
+			It("Then it should expire even though the registry's TTL hasn't", func() {
+				after(11)
+				Expect(e.Get(api)).To(BeNil())
+			})
+		})
+		Context("When it is updated", func() {
+			It("Then it should keep its own TTL", func() {
+				after(5)
+				Update(e, api, func(old interface{}) interface{} { return old.(int) + 1 })
+				after(14)
+				Expect(e.Get(api)).To(Equal(6))
+				after(16)
+				Expect(e.Get(api)).To(BeNil())
+			})
+		})
+		Context("When the TTL is zero", func() {
+			It("Then it should never expire", func() {
+				after(1000000)
+				Expect(e.Expire()).To(Equal(1))
+				Expect(e.Get(db)).To(Equal(6))
+			})
+		})
+	})
+	Describe("Given a deleted entry", func() {
+		Context("When its TTL would have passed", func() {
+			It("Then it shouldn't expire again", func() {
+				e.Delete(api)
+				after(61)
+				Expect(e.Expire()).To(Equal(1))
+				Expect(expired).To(Equal([]Entry{{db, 2}}))
+			})
+		})
+	})
+	Describe("Given a hook that uses the registry", func() {
+		Context("When an entry expires", func() {
+			It("Then it shouldn't deadlock", func() {
+				e.OnExpire(func(entry Entry) {
+					e.Set(Key{"expired": entry.Key["service"]}, entry.Value)
+				})
+				after(61)
+				Expect(e.Expire()).To(Equal(2))
+				Expect(e.Filter(Key{})).To(HaveLen(2))
+			})
+		})
+	})
+	Describe("Given a callback that panics", func() {
+		Context("When it is called by Update or GetOrCreate", func() {
+			It("Then the lock should be released and expired entries still reported", func() {
+				after(61)
+				Expect(func() {
+					e.Update(api, func(interface{}) interface{} { panic("update") })
+				}).To(Panic())
+				Expect(expired).To(Equal([]Entry{{api, 1}}))
+				Expect(func() {
+					e.GetOrCreate(Key{"service": "new"}, func() interface{} { panic("create") })
+				}).To(Panic())
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					e.Set(api, 3)
+					e.Expire()
+				}()
+				Eventually(done).Should(BeClosed())
+				Expect(e.Get(api)).To(Equal(3))
+			})
+		})
+	})
+	Describe("Given the janitor is started", func() {
+		Context("When entries expire", func() {
+			It("Then they should be removed without anyone asking for them", func() {
+				removed := make(chan Entry, 2)
+				e.OnExpire(func(entry Entry) {
+					removed <- entry
+				})
+				after(61)
+				Expect(e.Start(time.Millisecond)).To(Succeed())
+				Expect(e.Start(time.Millisecond)).To(Succeed())
+				Eventually(removed).Should(Receive())
+				Eventually(removed).Should(Receive())
+				e.Stop()
+				e.Stop()
+				Expect(e.Filter(Key{})).To(BeEmpty())
+			})
+		})
+		Context("When the interval isn't more than zero", func() {
+			It("Then it should fail instead of starting", func() {
+				Expect(e.Start(0)).To(Equal(intervalNotPositive))
+				Expect(e.Start(-time.Second)).To(Equal(intervalNotPositive))
+				Expect(e.stop).To(BeNil())
+			})
+		})
+	})
+})
@@ -0,0 +1,97 @@
+package registry
+
+/*
+
+	Every cache and most wrappers find an entry by the hash string of its complete Key, so
+	it is built on every CachedRegistry Get and Filter. toHashString used to base64 every label
+	name and value and glue them together one concatenation at a time. Now it writes the
+	sorted labels into a buffer on the stack and the only allocation is the string it returns.
+	CachedRegistry calls appendKeyHash with a buffer it keeps instead, so a hit allocates nothing.
+
+	Each name and value is written as its bytes followed by 0x00 0x01, with any 0x00 inside it
+	written as 0x00 0xff. No label can end early or run into the next one, so two Keys only
+	get the same hash if they are the same Key, and comparing two hashes byte by byte orders
+	them the same way as comparing their sorted labels.
+
+	keyFingerprint runs the same bytes through 64 bit FNV-1a without writing them anywhere, so
+	it doesn't allocate at all for Keys with up to keyScratchNames labels. Different Keys can
+	share a fingerprint, so whatever looks an entry up by fingerprint has to compare the Keys
+	of what it finds (see EvenBetterRegistry.indexFingerprints).
+
+*/
+
+const (
+	keyEscape     = 0x00 // Starts a two byte sequence in a hash
+	keyEscaped    = 0xff // After keyEscape, a 0x00 that was in the name or value
+	keyTerminator = 0x01 // After keyEscape, the end of a name or value
+
+	keyScratchNames = 16  // How many label names fit in the stack buffer used to sort them
+	keyScratchBytes = 256 // How many bytes of hash fit in the stack buffer toHashString writes into
+
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// toHashString returns the canonical encoding of k, the same for equal Keys and different for different ones
+func toHashString(k Key) string {
+	var buf [keyScratchBytes]byte
+	return string(appendKeyHash(buf[:0], k))
+}
+
+// appendKeyHash appends the canonical encoding of k to b
+func appendKeyHash(b []byte, k Key) []byte {
+	var scratch [keyScratchNames]string
+	for _, name := range sortNames(k, scratch[:0]) {
+		b = appendKeyString(b, name)
+		b = appendKeyString(b, k[name])
+	}
+	return b
+}
+
+// appendKeyString appends s with its 0x00 bytes escaped and a terminator
+func appendKeyString(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == keyEscape {
+			b = append(b, keyEscape, keyEscaped)
+			continue
+		}
+		b = append(b, s[i])
+	}
+	return append(b, keyEscape, keyTerminator)
+}
+
+// keyFingerprint returns the 64 bit FNV-1a hash of the canonical encoding of k
+func keyFingerprint(k Key) uint64 {
+	var scratch [keyScratchNames]string
+	h := uint64(fnvOffset64)
+	for _, name := range sortNames(k, scratch[:0]) {
+		h = fingerprintString(h, name)
+		h = fingerprintString(h, k[name])
+	}
+	return h
+}
+
+// fingerprintString adds s to h the way appendKeyString would write it
+func fingerprintString(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		if s[i] == keyEscape {
+			h = (h ^ keyEscape) * fnvPrime64
+			h = (h ^ keyEscaped) * fnvPrime64
+			continue
+		}
+		h = (h ^ uint64(s[i])) * fnvPrime64
+	}
+	h = (h ^ keyEscape) * fnvPrime64
+	return (h ^ keyTerminator) * fnvPrime64
+}
+
+// sortNames appends the label names of k to names in order. Keys are small so an insertion sort beats sort.Strings
+func sortNames(k Key, names []string) []string {
+	for name := range k {
+		names = append(names, name)
+		for i := len(names) - 1; i > 0 && names[i] < names[i-1]; i-- {
+			names[i], names[i-1] = names[i-1], names[i]
+		}
+	}
+	return names
+}
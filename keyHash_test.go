@@ -0,0 +1,158 @@
+// +build all unit
+
+package registry
+
+import (
+	"hash/fnv"
+	"sort"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Key hashing", func() {
+	Describe("Given Keys that only differ in where a label starts and ends", func() {
+		Context("When they are hashed", func() {
+			It("Then every one should get its own hash", func() {
+				keys := []Key{
+					{},
+					{"": ""},
+					{"ab": "c"},
+					{"a": "bc"},
+					{"a": "b", "c": ""},
+					{"a": "b\x00\x01c\x00\x01"},
+					{"a\x00": "b"},
+					{"a": "\x00b"},
+				}
+				hashes := map[string]Key{}
+				fingerprints := map[uint64]Key{}
+				for _, k := range keys {
+					Expect(hashes).ToNot(HaveKey(toHashString(k)), "%q", k)
+					hashes[toHashString(k)] = k
+					fingerprints[keyFingerprint(k)] = k
+				}
+				Expect(fingerprints).To(HaveLen(len(keys)))
+			})
+		})
+	})
+
+	Describe("Given Keys in order of their sorted labels", func() {
+		Context("When their hashes are sorted", func() {
+			It("Then they should stay in the same order", func() {
+				keys := []Key{
+					{"a": "1"},
+					{"a": "1", "b": "0"},
+					{"a": "10"},
+					{"a": "2"},
+					{"a\x00": "0"},
+					{"b": ""},
+				}
+				hashes := make([]string, len(keys))
+				for i, k := range keys {
+					hashes[i] = toHashString(k)
+				}
+				Expect(sort.StringsAreSorted(hashes)).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("Given a Key with a label bigger than the stack buffers", func() {
+		Context("When it is fingerprinted", func() {
+			It("Then the fingerprint should be the FNV-1a hash of its hash string", func() {
+				k := Key{"a": string(make([]byte, keyScratchBytes)), "b": "\x00"}
+				for i := 0; i < keyScratchNames+1; i++ {
+					k[string(rune('c'+i))] = "v"
+				}
+				h := fnv.New64a()
+				h.Write([]byte(toHashString(k)))
+				Expect(keyFingerprint(k)).To(Equal(h.Sum64()))
+			})
+		})
+	})
+
+	Describe("Given a Key of a usual size", func() {
+		k := Key{"__name__": "http_requests_total", "method": "GET", "code": "200"}
+		Context("When it is hashed", func() {
+			It("Then only the hash string should be allocated", func() {
+				Expect(testing.AllocsPerRun(100, func() { toHashString(k) })).To(Equal(float64(1)))
+			})
+		})
+		Context("When it is fingerprinted", func() {
+			It("Then nothing should be allocated", func() {
+				Expect(testing.AllocsPerRun(100, func() { keyFingerprint(k) })).To(BeZero())
+			})
+		})
+	})
+
+	Describe("Given a registry indexed by fingerprint", func() {
+		var r *EvenBetterRegistry
+		a := Key{"a": "1"}
+		b := Key{"b": "2"}
+		BeforeEach(func() {
+			r = NewEvenBetterRegistry()
+			r.Set(a, 1)
+			r.Set(Key{}, 0)
+			r.indexFingerprints()
+			r.Set(b, 2)
+		})
+		Context("When it was indexed after entries were set", func() {
+			It("Then they should be found along with the ones set after", func() {
+				Expect(r.fingerprints).To(HaveLen(2))
+				for value, k := range []Key{{}, a, b} {
+					entry, err := r.Get(k)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(entry.value).To(Equal(value))
+				}
+			})
+		})
+		Context("When two Keys have the same fingerprint", func() {
+			It("Then each should only find its own entry", func() {
+				entryB, _ := r.Get(b)
+				fingerprint := keyFingerprint(a)
+				r.fingerprints[fingerprint] = append(hashEntries{entryB}, r.fingerprints[fingerprint]...)
+				entry, err := r.Get(a)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(entry.value).To(Equal(1))
+				r.Delete(a)
+				_, err = r.Get(a)
+				Expect(err).To(Equal(ErrKeyNotFound))
+				Expect(r.fingerprints[fingerprint]).To(Equal(hashEntries{entryB}))
+			})
+		})
+		Context("When an entry is deleted", func() {
+			It("Then its fingerprint should be dropped", func() {
+				r.Delete(b)
+				Expect(r.fingerprints).To(HaveLen(1))
+				_, err := r.Get(b)
+				Expect(err).To(Equal(ErrKeyNotFound))
+			})
+		})
+	})
+
+	Describe("Given a cached registry with fingerprint gets", func() {
+		var r *CachedRegistry
+		k := Key{"a": "1", "b": "2"}
+		BeforeEach(func() {
+			r = NewCacheRegistry(10, WithFingerprintGets())
+			r.Set(k, 1)
+		})
+		Context("When a Key is got", func() {
+			It("Then it should come from the registry without going through the get cache or allocating", func() {
+				Expect(r.Get(k)).To(Equal(1))
+				_, err := r.TryGet(Key{"a": "1"})
+				Expect(err).To(Equal(ErrKeyNotFound))
+				Expect(testing.AllocsPerRun(100, func() { r.Get(k) })).To(BeZero())
+				Expect(r.Stats().Get).To(Equal(CacheUsage{}))
+				Expect(hasHash(r.getCache, toHashString(k))).To(BeFalse())
+			})
+		})
+		Context("When a Key is deleted", func() {
+			It("Then it shouldn't be found anymore", func() {
+				Expect(r.TryDelete(k)).To(Succeed())
+				Expect(r.Get(k)).To(BeNil())
+				Expect(r.registry.fingerprints).To(BeEmpty())
+			})
+		})
+	})
+})
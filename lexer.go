@@ -0,0 +1,218 @@
+package registry
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+
+	The lexer splits a selector like http_requests_total{code=~"5..", env!='dev'} into tokens
+	for the parser. Every token remembers where it started so errors can point at the exact
+	spot in the query. Strings can be quoted with ", ' or ` like in PromQL. The first two
+	understand Go escapes, backticks are raw.
+
+*/
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdentifier
+	tokenString
+	tokenLeftBrace
+	tokenRightBrace
+	tokenComma
+	tokenEqual
+	tokenNotEqual
+	tokenRegex
+	tokenNotRegex
+)
+
+var tokenNames = map[tokenType]string{
+	tokenEOF:        "end of query",
+	tokenIdentifier: "name",
+	tokenString:     "quoted string",
+	tokenLeftBrace:  "'{'",
+	tokenRightBrace: "'}'",
+	tokenComma:      "','",
+	tokenEqual:      "'='",
+	tokenNotEqual:   "'!='",
+	tokenRegex:      "'=~'",
+	tokenNotRegex:   "'!~'",
+}
+
+func (t tokenType) String() string {
+	return tokenNames[t]
+}
+
+// Position is where something is in a query. Offset is in bytes, Line and Column start at 1
+type Position struct {
+	Offset int
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// ParseError is returned when a query can't be parsed
+type ParseError struct {
+	Pos Position
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("Invalid query at %s: %s", e.Pos, e.Msg)
+}
+
+type token struct {
+	typ   tokenType
+	pos   Position
+	value string // The name or the unquoted string
+}
+
+func (t token) String() string {
+	switch t.typ {
+	case tokenIdentifier:
+		return fmt.Sprintf("name %q", t.value)
+	case tokenString:
+		return fmt.Sprintf("string %q", t.value)
+	}
+	return t.typ.String()
+}
+
+type lexer struct {
+	input  string
+	offset int
+	line   int
+	column int
+}
+
+func newLexer(input string) *lexer {
+	return &lexer{
+		input:  input,
+		line:   1,
+		column: 1,
+	}
+}
+
+// next returns the next token in the input or a ParseError for anything it doesn't understand
+func (l *lexer) next() (token, error) {
+	l.skipSpace()
+	pos := l.position()
+	if l.offset >= len(l.input) {
+		return token{typ: tokenEOF, pos: pos}, nil
+	}
+	r, _ := utf8.DecodeRuneInString(l.input[l.offset:])
+	switch {
+	case r == '{':
+		l.advance(1)
+		return token{typ: tokenLeftBrace, pos: pos}, nil
+	case r == '}':
+		l.advance(1)
+		return token{typ: tokenRightBrace, pos: pos}, nil
+	case r == ',':
+		l.advance(1)
+		return token{typ: tokenComma, pos: pos}, nil
+	case r == '=' || r == '!':
+		return l.operator(pos)
+	case r == '"' || r == '\'' || r == '`':
+		return l.quoted(pos, r)
+	case isIdentifierRune(r):
+		start := l.offset
+		for l.offset < len(l.input) && isIdentifierRune(rune(l.input[l.offset])) {
+			l.advance(1)
+		}
+		return token{typ: tokenIdentifier, pos: pos, value: l.input[start:l.offset]}, nil
+	}
+	return token{}, &ParseError{Pos: pos, Msg: fmt.Sprintf("unexpected character %q", r)}
+}
+
+func (l *lexer) operator(pos Position) (token, error) {
+	for _, op := range []struct {
+		text string
+		typ  tokenType
+	}{
+		{"=~", tokenRegex},
+		{"!~", tokenNotRegex},
+		{"!=", tokenNotEqual},
+		{"=", tokenEqual},
+	} {
+		if strings.HasPrefix(l.input[l.offset:], op.text) {
+			l.advance(len(op.text))
+			return token{typ: op.typ, pos: pos}, nil
+		}
+	}
+	return token{}, &ParseError{Pos: pos, Msg: "expected '!=' or '!~'"}
+}
+
+// quoted reads a string up to the closing quote and unescapes it
+func (l *lexer) quoted(pos Position, quote rune) (token, error) {
+	l.advance(1)
+	if quote == '`' {
+		end := strings.IndexRune(l.input[l.offset:], '`')
+		if end < 0 {
+			return token{}, &ParseError{Pos: pos, Msg: "unterminated quoted string"}
+		}
+		value := l.input[l.offset : l.offset+end]
+		l.advance(end + 1)
+		return token{typ: tokenString, pos: pos, value: value}, nil
+	}
+	var value strings.Builder
+	for {
+		rest := l.input[l.offset:]
+		if rest == "" || rest[0] == '\n' {
+			return token{}, &ParseError{Pos: pos, Msg: "unterminated quoted string"}
+		}
+		if rune(rest[0]) == quote {
+			l.advance(1)
+			return token{typ: tokenString, pos: pos, value: value.String()}, nil
+		}
+		escapePos := l.position()
+		r, _, tail, err := strconv.UnquoteChar(rest, byte(quote))
+		if err != nil {
+			return token{}, &ParseError{Pos: escapePos, Msg: "invalid escape sequence in quoted string"}
+		}
+		value.WriteRune(r)
+		l.advance(len(rest) - len(tail))
+	}
+}
+
+// advance moves n bytes forward keeping track of the line and column
+func (l *lexer) advance(n int) {
+	for _, r := range l.input[l.offset : l.offset+n] {
+		if r == '\n' {
+			l.line++
+			l.column = 1
+		} else {
+			l.column++
+		}
+	}
+	l.offset += n
+}
+
+func (l *lexer) skipSpace() {
+	for l.offset < len(l.input) && strings.ContainsRune(" \t\n\r", rune(l.input[l.offset])) {
+		l.advance(1)
+	}
+}
+
+func (l *lexer) position() Position {
+	return Position{
+		Offset: l.offset,
+		Line:   l.line,
+		Column: l.column,
+	}
+}
+
+// isIdentifierRune includes ':' so metric names lex as one token, the parser checks what is allowed where
+func isIdentifierRune(r rune) bool {
+	return r == '_' || r == ':' ||
+		(r >= 'a' && r <= 'z') ||
+		(r >= 'A' && r <= 'Z') ||
+		(r >= '0' && r <= '9')
+}
@@ -0,0 +1,145 @@
+package registry
+
+import "container/list"
+
+/*
+
+	LFUCache evicts the item that was used the least. The items are kept in a list for every
+	use count, each with the most recently used at the front, and the cache remembers the
+	lowest count that has items. A Get moves an item to the front of the next count's list and
+	eviction takes the back of the lowest count's list, so both are O(1) and a tie goes to the
+	item that was used the longest ago.
+
+	Counts never go down, so something that was popular once stays cached long after it stops
+	being used. TinyLFUCache ages its counts if that is a problem.
+
+*/
+
+// LFUCache is a Cache that evicts the least frequently used item
+type LFUCache struct {
+	items    map[string]*cacheItem // Every item by hash
+	counts   map[int]*list.List    // cacheItems by how many times they were got, most recently used at the front
+	minCount int                   // The lowest count in counts, found again when it is stale
+	maxSize  int                   // Max size of cache
+	stats    CacheStats
+}
+
+func NewLFUCache(maxSize int) *LFUCache {
+	return &LFUCache{
+		items:   map[string]*cacheItem{},
+		counts:  map[int]*list.List{},
+		maxSize: maxSize,
+	}
+}
+
+// GetWithKey gets a value from the cache that matches complete key
+func (c *LFUCache) GetWithKey(k Key) (interface{}, error) {
+	return c.GetWithHash(toHashString(k))
+}
+
+// GetWithHash gets a value from the cache that matches the hashstring and counts it as a use
+func (c *LFUCache) GetWithHash(h string) (interface{}, error) {
+	item, ok := c.items[h]
+	c.stats.record(ok)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	c.take(item)
+	if item.count == c.minCount && c.counts[item.count] == nil {
+		c.minCount = item.count + 1
+	}
+	item.count++
+	c.put(item)
+	return item.value, nil
+}
+
+// hitWithHashBytes gets a value the cache has and counts it as a use without making a string of the hash
+func (c *LFUCache) hitWithHashBytes(h []byte) (interface{}, bool) {
+	item, ok := c.items[string(h)]
+	if !ok {
+		return nil, false
+	}
+	i, err := c.GetWithHash(item.hash)
+	return i, err == nil
+}
+
+// PeekWithHash gets a value from the cache without counting it as a use or in the stats
+func (c *LFUCache) PeekWithHash(h string) (interface{}, error) {
+	if item, ok := c.items[h]; ok {
+		return item.value, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// UpdateWithKey adds a value to the cache. If cache size will be exceed, the least frequently used value is removed and also returned
+func (c *LFUCache) UpdateWithKey(k Key, i interface{}) (cacheItemRemoved bool, cacheKeyRemoved string, cacheValueRemoved interface{}) {
+	return c.UpdateWithHash(toHashString(k), i)
+}
+
+// UpdateWithHash adds a value to the cache. If cache size will be exceed, the least frequently used value is removed and also returned
+// Updating an item that is already there only replaces its value
+func (c *LFUCache) UpdateWithHash(h string, i interface{}) (cacheItemRemoved bool, cacheKeyRemoved string, cacheValueRemoved interface{}) {
+	if item, ok := c.items[h]; ok {
+		item.value = i
+		return false, "", nil
+	}
+	if c.maxSize <= 0 {
+		return true, h, i
+	}
+	// Make room first so the new item, which has the lowest count there is, isn't the one evicted
+	if len(c.items) >= c.maxSize {
+		victim := c.lowest().Back().Value.(*cacheItem)
+		c.RemoveWithHash(victim.hash)
+		cacheItemRemoved, cacheKeyRemoved, cacheValueRemoved = true, victim.hash, victim.value
+	}
+	item := &cacheItem{hash: h, value: i, count: 1}
+	c.items[h] = item
+	c.minCount = 1
+	c.put(item)
+	return cacheItemRemoved, cacheKeyRemoved, cacheValueRemoved
+}
+
+// Stats returns how many Gets were hits and misses
+func (c *LFUCache) Stats() CacheStats {
+	return c.stats
+}
+
+func (c *LFUCache) RemoveWithHash(h string) {
+	if item, ok := c.items[h]; ok {
+		c.take(item)
+		delete(c.items, h)
+	}
+}
+
+// put adds the item to the front of the list for its count
+func (c *LFUCache) put(item *cacheItem) {
+	l, ok := c.counts[item.count]
+	if !ok {
+		l = list.New()
+		c.counts[item.count] = l
+	}
+	moveToFront(item, l)
+}
+
+// take removes the item from the list for its count and drops the list if it is empty
+func (c *LFUCache) take(item *cacheItem) {
+	l := item.list
+	removeFromList(item)
+	if l.Len() == 0 {
+		delete(c.counts, item.count)
+	}
+}
+
+// lowest returns the list for the lowest count, finding the count again if a remove took its last item
+func (c *LFUCache) lowest() *list.List {
+	if l, ok := c.counts[c.minCount]; ok {
+		return l
+	}
+	c.minCount = 0
+	for count := range c.counts {
+		if c.minCount == 0 || count < c.minCount {
+			c.minCount = count
+		}
+	}
+	return c.counts[c.minCount]
+}
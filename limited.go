@@ -0,0 +1,268 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+/*
+
+	Every new label value makes a new entry, and in the registries with an index a new list
+	in the index too. A label like a request ID grows both without bound. LimitedRegistry
+	wraps a registry and checks every new Key against Limits before it is added: how many
+	entries there can be in total, how many different values a label can have and how many
+	labels a Key can have. Keys that are already there can always be written to.
+
+	What happens to a Key over a limit depends on the LimitPolicy. LimitReject makes TrySet
+	return an error (Set can't return one so it is the same as dropping), LimitDrop throws the
+	value away and LimitOverflow writes it to the overflow Key instead, so there is one entry
+	that says something was cut off. The overflow Key doesn't count towards the limits.
+
+	Stats counts every Key that hit a limit so there is something to alert on. The counters
+	are atomic so Stats can be read while another goroutine holds the registry's lock.
+
+*/
+
+var (
+	// ErrTooManyEntries is returned when a new Key would go over Limits.MaxEntries
+	ErrTooManyEntries = errors.New("Registry has too many entries")
+	// ErrTooManyLabelValues is returned when a new Key would go over Limits.MaxValuesPerLabel
+	ErrTooManyLabelValues = errors.New("Label has too many values")
+	// ErrTooManyLabels is returned when a new Key would go over Limits.MaxLabelsPerKey
+	ErrTooManyLabels = errors.New("Key has too many labels")
+)
+
+// OverflowKey is where LimitOverflow writes values when Limits doesn't say otherwise
+var OverflowKey = Key{"overflow": "true"}
+
+// Limits caps the cardinality of a LimitedRegistry. Zero means no limit
+type Limits struct {
+	MaxEntries        int // How many entries there can be
+	MaxValuesPerLabel int // How many different values one label name can have across all Keys
+	MaxLabelsPerKey   int // How many labels a Key can have
+	Overflow          Key // Where LimitOverflow writes values, OverflowKey if nil
+}
+
+// LimitPolicy is what a LimitedRegistry does with a Key that would go over a limit
+type LimitPolicy int
+
+const (
+	// LimitReject returns an error from TrySet
+	LimitReject LimitPolicy = iota
+	// LimitDrop throws the value away
+	LimitDrop
+	// LimitOverflow writes the value to the overflow Key
+	LimitOverflow
+)
+
+// LimitStats counts the Keys that went over a limit
+type LimitStats struct {
+	Rejected   uint64
+	Dropped    uint64
+	Overflowed uint64
+}
+
+// LimitedRegistry stops new Keys from being added once they would go over its Limits
+type LimitedRegistry struct {
+	registry    Registry
+	limits      Limits
+	policy      LimitPolicy
+	keys        map[string]Key            // Every Key in the registry by its hash
+	labelValues map[string]map[string]int // How many Keys use each value of each label
+	stats       LimitStats
+}
+
+// NewLimitedRegistry wraps r, which should be empty, so it stays within limits
+func NewLimitedRegistry(r Registry, limits Limits, policy LimitPolicy) *LimitedRegistry {
+	if limits.Overflow == nil {
+		limits.Overflow = OverflowKey
+	}
+	limits.Overflow = copyKey(limits.Overflow)
+	return &LimitedRegistry{
+		registry:    r,
+		limits:      limits,
+		policy:      policy,
+		keys:        map[string]Key{},
+		labelValues: map[string]map[string]int{},
+	}
+}
+
+// Get returns the value that matches the key exactly
+func (l *LimitedRegistry) Get(k Key) interface{} {
+	return l.registry.Get(k)
+}
+
+// Lookup returns the value at k and whether there is an entry at k
+func (l *LimitedRegistry) Lookup(k Key) (interface{}, bool) {
+	return Lookup(l.registry, k)
+}
+
+// TryGet returns the value at k or ErrKeyNotFound
+func (l *LimitedRegistry) TryGet(k Key) (interface{}, error) {
+	return TryGet(l.registry, k)
+}
+
+// Filter returns a list of entries that contain the key
+func (l *LimitedRegistry) Filter(k Key) []Entry {
+	return l.registry.Filter(k)
+}
+
+// FilterMatchers returns a list of entries whose Key satisfies all the matchers
+func (l *LimitedRegistry) FilterMatchers(ms ...Matcher) []Entry {
+	return FilterMatchers(l.registry, ms...)
+}
+
+// Set replaces or creates new entry with key and value. A Key over the limits is handled by the policy
+func (l *LimitedRegistry) Set(k Key, i interface{}) {
+	l.TrySet(k, i)
+}
+
+// TrySet is Set but returns an error when the Key is rejected
+func (l *LimitedRegistry) TrySet(k Key, i interface{}) error {
+	k, added, err := l.admit(k)
+	if k == nil && l.policy == LimitDrop {
+		return nil
+	}
+	if k == nil {
+		return err
+	}
+	if err := TrySet(l.registry, k, i); err != nil {
+		l.forgetIf(added, k)
+		return err
+	}
+	return nil
+}
+
+// Update replaces the value at k with what fn returns. A Key over the limits is handled by the policy
+func (l *LimitedRegistry) Update(k Key, fn func(old interface{}) interface{}) {
+	k, added, _ := l.admit(k)
+	if k == nil {
+		return
+	}
+	Update(l.registry, k, fn)
+	if added {
+		// Update can't say if the wrapped registry stored the value
+		_, ok := Lookup(l.registry, k)
+		l.forgetIf(!ok, k)
+	}
+}
+
+// GetOrCreate returns the value at k or Sets the value from create. A Key over the limits is handled by
+// the policy, and when nothing is stored it returns nil, false. Use TryGetOrCreate to know why
+func (l *LimitedRegistry) GetOrCreate(k Key, create func() interface{}) (interface{}, bool) {
+	i, created, _ := l.TryGetOrCreate(k, create)
+	return i, created
+}
+
+// TryGetOrCreate is GetOrCreate but returns why a Key over the limits wasn't stored, with LimitDrop too
+// since the caller would otherwise hold on to a value that isn't in the registry
+func (l *LimitedRegistry) TryGetOrCreate(k Key, create func() interface{}) (interface{}, bool, error) {
+	k, added, err := l.admit(k)
+	if k == nil {
+		return nil, false, err
+	}
+	i, created, err := TryGetOrCreate(l.registry, k, create)
+	if err != nil {
+		l.forgetIf(added, k)
+	}
+	return i, created, err
+}
+
+// Delete removes an entry from the registry
+func (l *LimitedRegistry) Delete(k Key) {
+	l.TryDelete(k)
+}
+
+// TryDelete removes an entry from the registry or returns ErrKeyNotFound if there is none
+func (l *LimitedRegistry) TryDelete(k Key) error {
+	err := TryDelete(l.registry, k)
+	l.forget(k)
+	return err
+}
+
+// forget stops counting the key towards the limits
+func (l *LimitedRegistry) forget(k Key) {
+	hash := toHashString(k)
+	if _, ok := l.keys[hash]; !ok {
+		return
+	}
+	delete(l.keys, hash)
+	for name, value := range k {
+		values := l.labelValues[name]
+		values[value]--
+		if values[value] == 0 {
+			delete(values, value)
+		}
+		if len(values) == 0 {
+			delete(l.labelValues, name)
+		}
+	}
+}
+
+// forgetIf forgets a Key admit just added when the wrapped registry didn't store it after all
+func (l *LimitedRegistry) forgetIf(added bool, k Key) {
+	if added {
+		l.forget(k)
+	}
+}
+
+// Stats returns how many Keys went over a limit so far
+func (l *LimitedRegistry) Stats() LimitStats {
+	return LimitStats{
+		Rejected:   atomic.LoadUint64(&l.stats.Rejected),
+		Dropped:    atomic.LoadUint64(&l.stats.Dropped),
+		Overflowed: atomic.LoadUint64(&l.stats.Overflowed),
+	}
+}
+
+// admit returns the Key to write to, which is the overflow Key if k is over a limit with LimitOverflow,
+// and whether k was added to the counts so it can be forgotten if the write fails
+// It returns nil when nothing should be written along with the limit the Key went over
+func (l *LimitedRegistry) admit(k Key) (Key, bool, error) {
+	hash := toHashString(k)
+	if _, ok := l.keys[hash]; ok || isEquals(k, l.limits.Overflow) {
+		return k, false, nil
+	}
+	if err := l.check(k); err != nil {
+		switch l.policy {
+		case LimitDrop:
+			atomic.AddUint64(&l.stats.Dropped, 1)
+			return nil, false, err
+		case LimitOverflow:
+			atomic.AddUint64(&l.stats.Overflowed, 1)
+			return l.limits.Overflow, false, nil
+		}
+		atomic.AddUint64(&l.stats.Rejected, 1)
+		return nil, false, err
+	}
+	l.keys[hash] = copyKey(k)
+	for name, value := range k {
+		values, ok := l.labelValues[name]
+		if !ok {
+			values = map[string]int{}
+			l.labelValues[name] = values
+		}
+		values[value]++
+	}
+	return k, true, nil
+}
+
+// check returns why a new Key can't be added, if it can't
+func (l *LimitedRegistry) check(k Key) error {
+	if l.limits.MaxLabelsPerKey > 0 && len(k) > l.limits.MaxLabelsPerKey {
+		return fmt.Errorf("%w: %v has %d, the limit is %d", ErrTooManyLabels, k, len(k), l.limits.MaxLabelsPerKey)
+	}
+	if l.limits.MaxEntries > 0 && len(l.keys) >= l.limits.MaxEntries {
+		return fmt.Errorf("%w: adding %v would go over the limit of %d", ErrTooManyEntries, k, l.limits.MaxEntries)
+	}
+	if l.limits.MaxValuesPerLabel > 0 {
+		for _, name := range sortedKeys(k) {
+			values := l.labelValues[name]
+			if _, ok := values[k[name]]; !ok && len(values) >= l.limits.MaxValuesPerLabel {
+				return fmt.Errorf("%w: %s=%q would go over the limit of %d", ErrTooManyLabelValues, name, k[name], l.limits.MaxValuesPerLabel)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// +build all unit
+
+package registry
+
+import (
+	"errors"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Limited registry", func() {
+	var l *LimitedRegistry
+	request := func(i int) Key {
+		return Key{"service": "api", "request": strconv.Itoa(i)}
+	}
+
+	Describe("Given a limit on the number of entries", func() {
+		BeforeEach(func() {
+			l = NewLimitedRegistry(NewCacheRegistry(10), Limits{MaxEntries: 2}, LimitReject)
+			Expect(l.TrySet(request(1), 1)).To(Succeed())
+			Expect(l.TrySet(request(2), 2)).To(Succeed())
+		})
+		Context("When a new Key would go over it", func() {
+			It("Then it should be rejected with an error", func() {
+				err := l.TrySet(request(3), 3)
+				Expect(errors.Is(err, ErrTooManyEntries)).To(BeTrue())
+				Expect(err.Error()).To(ContainSubstring("limit of 2"))
+				Expect(l.Get(request(3))).To(BeNil())
+				Expect(l.Stats()).To(Equal(LimitStats{Rejected: 1}))
+			})
+		})
+		Context("When a Key that is already there is Set", func() {
+			It("Then it should still be written", func() {
+				Expect(l.TrySet(request(1), 10)).To(Succeed())
+				Expect(l.Get(request(1))).To(Equal(10))
+			})
+		})
+		Context("When an entry is deleted", func() {
+			It("Then there should be room for a new one", func() {
+				l.Delete(request(1))
+				l.Delete(request(1))
+				Expect(l.TrySet(request(3), 3)).To(Succeed())
+				Expect(l.TrySet(request(4), 4)).ToNot(Succeed())
+			})
+		})
+	})
+	Describe("Given a wrapped registry that rejects Keys this one lets through", func() {
+		BeforeEach(func() {
+			inner := NewLimitedRegistry(NewCacheRegistry(10), Limits{MaxLabelsPerKey: 2}, LimitReject)
+			l = NewLimitedRegistry(inner, Limits{MaxEntries: 2}, LimitReject)
+			Expect(l.TrySet(request(1), 1)).To(Succeed())
+		})
+		Context("When those Keys are written", func() {
+			It("Then they shouldn't take up room under the limits", func() {
+				wide := func(i int) Key {
+					k := request(i)
+					k["extra"] = "x"
+					return k
+				}
+				Expect(errors.Is(l.TrySet(wide(2), 2), ErrTooManyLabels)).To(BeTrue())
+				_, _, err := l.TryGetOrCreate(wide(3), func() interface{} { return 3 })
+				Expect(errors.Is(err, ErrTooManyLabels)).To(BeTrue())
+				l.Update(wide(4), func(interface{}) interface{} { return 4 })
+				Expect(l.labelValues).ToNot(HaveKey("extra"))
+				Expect(l.TrySet(request(5), 5)).To(Succeed())
+			})
+		})
+	})
+
+	Describe("Given a limit on the number of values per label", func() {
+		BeforeEach(func() {
+			l = NewLimitedRegistry(NewCacheRegistry(10), Limits{MaxValuesPerLabel: 2}, LimitReject)
+			Expect(l.TrySet(request(1), 1)).To(Succeed())
+			Expect(l.TrySet(request(2), 2)).To(Succeed())
+		})
+		Context("When a Key has a new value for the label", func() {
+			It("Then it should be rejected", func() {
+				err := l.TrySet(request(3), 3)
+				Expect(errors.Is(err, ErrTooManyLabelValues)).To(BeTrue())
+				Expect(err.Error()).To(ContainSubstring(`request="3"`))
+			})
+		})
+		Context("When a new Key reuses values that are already there", func() {
+			It("Then it should be added", func() {
+				Expect(l.TrySet(Key{"request": "1"}, 1)).To(Succeed())
+			})
+		})
+		Context("When every Key with a value is deleted", func() {
+			It("Then the value shouldn't count any more", func() {
+				l.Delete(request(2))
+				Expect(l.TrySet(request(3), 3)).To(Succeed())
+			})
+		})
+	})
+	Describe("Given a full registry that rejects new Keys", func() {
+		BeforeEach(func() {
+			l = NewLimitedRegistry(NewCacheRegistry(10), Limits{MaxEntries: 1}, LimitReject)
+			_, err := GetOrRegisterCounter(l, request(1))
+			Expect(err).ToNot(HaveOccurred())
+		})
+		Context("When a Counter is registered over the limit", func() {
+			It("Then the rejection should be returned, even through a SafeRegistry", func() {
+				_, err := GetOrRegisterCounter(l, request(2))
+				Expect(errors.Is(err, ErrTooManyEntries)).To(BeTrue())
+				_, err = GetOrRegisterCounter(NewSafeRegistry(l), request(2))
+				Expect(errors.Is(err, ErrTooManyEntries)).To(BeTrue())
+				Expect(l.Stats()).To(Equal(LimitStats{Rejected: 2}))
+			})
+		})
+		Context("When a Counter that is already there is registered again", func() {
+			It("Then it should be returned", func() {
+				c, err := GetOrRegisterCounter(l, request(1))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(c).To(BeIdenticalTo(l.Get(request(1))))
+			})
+		})
+	})
+	Describe("Given a limit on the number of labels per Key", func() {
+		Context("When a Key has too many", func() {
+			It("Then it should be rejected", func() {
+				l = NewLimitedRegistry(NewCacheRegistry(10), Limits{MaxLabelsPerKey: 1}, LimitReject)
+				Expect(l.TrySet(Key{"service": "api"}, 1)).To(Succeed())
+				Expect(errors.Is(l.TrySet(request(1), 1), ErrTooManyLabels)).To(BeTrue())
+			})
+		})
+	})
+	Describe("Given the drop policy", func() {
+		BeforeEach(func() {
+			l = NewLimitedRegistry(NewCacheRegistry(10), Limits{MaxEntries: 1}, LimitDrop)
+			l.Set(request(1), 1)
+		})
+		Context("When a Key goes over a limit", func() {
+			It("Then it should be thrown away without an error", func() {
+				Expect(l.TrySet(request(2), 2)).To(Succeed())
+				Update(l, request(3), func(old interface{}) interface{} { return 3 })
+				Expect(l.Filter(Key{})).To(ConsistOf(Entry{request(1), 1}))
+				Expect(l.Stats()).To(Equal(LimitStats{Dropped: 2}))
+			})
+		})
+		Context("When a Counter is registered over a limit", func() {
+			It("Then registering should fail instead of handing back a Counter that isn't stored", func() {
+				c, err := GetOrRegisterCounter(l, request(2))
+				Expect(errors.Is(err, ErrTooManyEntries)).To(BeTrue())
+				Expect(c).To(BeNil())
+				i, created := l.GetOrCreate(request(2), func() interface{} { return 2 })
+				Expect(i).To(BeNil())
+				Expect(created).To(BeFalse())
+				Expect(l.Get(request(2))).To(BeNil())
+			})
+		})
+	})
+	Describe("Given the overflow policy", func() {
+		BeforeEach(func() {
+			l = NewLimitedRegistry(NewCacheRegistry(10), Limits{MaxValuesPerLabel: 2}, LimitOverflow)
+		})
+		Context("When Counters are registered over a limit", func() {
+			It("Then they should all share the overflow Counter", func() {
+				for i := 0; i < 5; i++ {
+					c, err := GetOrRegisterCounter(l, request(i))
+					Expect(err).To(BeNil())
+					c.Inc()
+				}
+				Expect(l.Filter(Key{"service": "api"})).To(HaveLen(2))
+				Expect(l.Get(OverflowKey).(*Counter).Value()).To(Equal(uint64(3)))
+				Expect(l.Stats()).To(Equal(LimitStats{Overflowed: 3}))
+			})
+		})
+		Context("When the overflow Key is set", func() {
+			It("Then it should be used instead", func() {
+				overflow := Key{"service": "api", "request": "other"}
+				l = NewLimitedRegistry(NewCacheRegistry(10), Limits{MaxValuesPerLabel: 1, Overflow: overflow}, LimitOverflow)
+				l.Set(request(1), 1)
+				l.Set(request(2), 2)
+				Expect(l.Filter(Key{"service": "api"})).To(ConsistOf(Entry{request(1), 1}, Entry{overflow, 2}))
+			})
+		})
+	})
+})
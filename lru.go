@@ -0,0 +1,101 @@
+package registry
+
+import "container/list"
+
+/*
+
+	SimpleCache keeps recency in a slice, so every update and remove scans the whole slice and
+	a Get doesn't count as a use, which makes it first in first out. LRUCache keeps the items in
+	a doubly linked list with the most recently used at the front and a map from the hash to the
+	list element, so getting, updating and evicting are all O(1) and the item evicted is the one
+	that went unused the longest.
+
+*/
+
+// LRUCache is a Cache that evicts the least recently used item
+type LRUCache struct {
+	items   map[string]*list.Element // The list element of every item by hash
+	recency *list.List               // lruItems with the most recently used at the front
+	maxSize int                      // Max size of cache
+	stats   CacheStats
+}
+
+type lruItem struct {
+	hash  string
+	value interface{}
+}
+
+func NewLRUCache(maxSize int) *LRUCache {
+	return &LRUCache{
+		items:   map[string]*list.Element{},
+		recency: list.New(),
+		maxSize: maxSize,
+	}
+}
+
+// GetWithKey gets a value from the cache that matches complete key
+func (c *LRUCache) GetWithKey(k Key) (interface{}, error) {
+	return c.GetWithHash(toHashString(k))
+}
+
+// GetWithHash gets a value from the cache that matches the hashstring and marks it as used
+func (c *LRUCache) GetWithHash(h string) (interface{}, error) {
+	element, ok := c.items[h]
+	c.stats.record(ok)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	c.recency.MoveToFront(element)
+	return element.Value.(*lruItem).value, nil
+}
+
+// hitWithHashBytes gets a value the cache has and marks it as used without making a string of the hash
+func (c *LRUCache) hitWithHashBytes(h []byte) (interface{}, bool) {
+	element, ok := c.items[string(h)]
+	if !ok {
+		return nil, false
+	}
+	i, err := c.GetWithHash(element.Value.(*lruItem).hash)
+	return i, err == nil
+}
+
+// PeekWithHash gets a value from the cache without marking it as used or counting it in the stats
+func (c *LRUCache) PeekWithHash(h string) (interface{}, error) {
+	if element, ok := c.items[h]; ok {
+		return element.Value.(*lruItem).value, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// UpdateWithKey adds a value to the cache. If cache size will be exceed, the least recently used value is removed and also returned
+func (c *LRUCache) UpdateWithKey(k Key, i interface{}) (cacheItemRemoved bool, cacheKeyRemoved string, cacheValueRemoved interface{}) {
+	return c.UpdateWithHash(toHashString(k), i)
+}
+
+// UpdateWithHash adds a value to the cache. If cache size will be exceed, the least recently used value is removed and also returned
+func (c *LRUCache) UpdateWithHash(h string, i interface{}) (cacheItemRemoved bool, cacheKeyRemoved string, cacheValueRemoved interface{}) {
+	if element, ok := c.items[h]; ok {
+		element.Value.(*lruItem).value = i
+		c.recency.MoveToFront(element)
+		return false, "", nil
+	}
+	c.items[h] = c.recency.PushFront(&lruItem{hash: h, value: i})
+	if len(c.items) <= c.maxSize {
+		return false, "", nil
+	}
+	oldest := c.recency.Back().Value.(*lruItem)
+	c.RemoveWithHash(oldest.hash)
+	return true, oldest.hash, oldest.value
+}
+
+// Stats returns how many Gets were hits and misses
+func (c *LRUCache) Stats() CacheStats {
+	return c.stats
+}
+
+func (c *LRUCache) RemoveWithHash(h string) {
+	if element, ok := c.items[h]; ok {
+		c.recency.Remove(element)
+		delete(c.items, h)
+	}
+}
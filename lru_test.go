@@ -0,0 +1,62 @@
+// +build all unit
+
+package registry
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LRU cache", func() {
+	var c *LRUCache
+	BeforeEach(func() {
+		c = NewLRUCache(2)
+		c.UpdateWithHash("a", 1)
+		c.UpdateWithHash("b", 2)
+	})
+
+	Describe("Given a full cache", func() {
+		Context("When a new item is added", func() {
+			It("Then the least recently used item should be removed and returned", func() {
+				removed, hash, value := c.UpdateWithHash("c", 3)
+				Expect(removed).To(BeTrue())
+				Expect(hash).To(Equal("a"))
+				Expect(value).To(Equal(1))
+				_, err := c.GetWithHash("a")
+				Expect(err).To(Equal(ErrKeyNotFound))
+				Expect(c.items).To(HaveLen(2))
+				Expect(c.recency.Len()).To(Equal(2))
+			})
+		})
+		Context("When the oldest item was read before a new item is added", func() {
+			It("Then the item read should be kept", func() {
+				i, err := c.GetWithHash("a")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(i).To(Equal(1))
+				_, hash, _ := c.UpdateWithHash("c", 3)
+				Expect(hash).To(Equal("b"))
+				Expect(c.GetWithHash("a")).To(Equal(1))
+			})
+		})
+		Context("When an item that is already there is updated", func() {
+			It("Then nothing should be removed and the item should be the most recently used", func() {
+				removed, _, _ := c.UpdateWithHash("a", 10)
+				Expect(removed).To(BeFalse())
+				Expect(c.GetWithHash("a")).To(Equal(10))
+				_, hash, _ := c.UpdateWithKey(Key{"c": "3"}, 3)
+				Expect(hash).To(Equal("b"))
+			})
+		})
+		Context("When an item is removed", func() {
+			It("Then there should be room without removing anything else", func() {
+				c.RemoveWithHash("a")
+				c.RemoveWithHash("missing")
+				removed, _, _ := c.UpdateWithHash("c", 3)
+				Expect(removed).To(BeFalse())
+				Expect(c.GetWithHash("b")).To(Equal(2))
+				_, err := c.GetWithKey(Key{})
+				Expect(err).To(Equal(ErrKeyNotFound))
+			})
+		})
+	})
+})
@@ -0,0 +1,240 @@
+package registry
+
+import (
+	"fmt"
+	"regexp"
+)
+
+/*
+
+	A Key can only say "this label has this value". Matchers can also say "this label is
+	there with any value" and "this label is not there". A Key is the same as a list of
+	Equal matchers, one for each of its key value pairs, so everything that takes a Key can
+	be written in terms of matchers.
+
+	Equal, NotEqual, Regex and NotRegex work like they do in PromQL selectors: a label that
+	isn't there is treated as if it had the empty value, so env!="dev" also matches Keys
+	without an env label and env="" matches them too. Regexes have to match the whole value.
+
+	Registries that have an index (EvenBetterRegistry and everything built on it) answer
+	Equal and Present matchers straight from the index and only check the rest against the
+	entries that are left.
+
+*/
+
+// MatchType is the way a Matcher compares a label
+type MatchType int
+
+const (
+	// MatchEqual matches when the label has exactly the value, a label that isn't there has the empty value
+	MatchEqual MatchType = iota
+	// MatchPresent matches when the label is there with any value
+	MatchPresent
+	// MatchAbsent matches when the label is not there
+	MatchAbsent
+	// MatchNotEqual matches when the label does not have the value
+	MatchNotEqual
+	// MatchRegex matches when the label's value matches the regex
+	MatchRegex
+	// MatchNotRegex matches when the label's value does not match the regex
+	MatchNotRegex
+)
+
+// Matcher matches a single label of a Key
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string         // The value or regex, not used by MatchPresent and MatchAbsent
+	re    *regexp.Regexp // Compiled Value for MatchRegex and MatchNotRegex
+}
+
+// MatcherFilterer is implemented by registries that can filter on Matchers themselves
+type MatcherFilterer interface {
+	// FilterMatchers returns every entry whose Key satisfies all of the matchers
+	FilterMatchers(ms ...Matcher) []Entry
+}
+
+// LabelEqual returns a Matcher for Keys that have the label name with the value, or don't have it if the value is empty
+func LabelEqual(name string, value string) Matcher {
+	return Matcher{
+		Type:  MatchEqual,
+		Name:  name,
+		Value: value,
+	}
+}
+
+// LabelNotEqual returns a Matcher for Keys that don't have the label name with the value
+func LabelNotEqual(name string, value string) Matcher {
+	return Matcher{
+		Type:  MatchNotEqual,
+		Name:  name,
+		Value: value,
+	}
+}
+
+// LabelRegex returns a Matcher for Keys where the value of the label name matches the regex
+func LabelRegex(name string, regex string) (Matcher, error) {
+	return NewMatcher(MatchRegex, name, regex)
+}
+
+// LabelNotRegex returns a Matcher for Keys where the value of the label name does not match the regex
+func LabelNotRegex(name string, regex string) (Matcher, error) {
+	return NewMatcher(MatchNotRegex, name, regex)
+}
+
+// NewMatcher returns a Matcher of any type. It fails if a regex value can't be compiled
+func NewMatcher(t MatchType, name string, value string) (Matcher, error) {
+	m := Matcher{
+		Type:  t,
+		Name:  name,
+		Value: value,
+	}
+	if t == MatchRegex || t == MatchNotRegex {
+		re, err := compileAnchored(value)
+		if err != nil {
+			return Matcher{}, err
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// LabelPresent returns a Matcher for Keys that have the label name with any value
+func LabelPresent(name string) Matcher {
+	return Matcher{
+		Type: MatchPresent,
+		Name: name,
+	}
+}
+
+// LabelAbsent returns a Matcher for Keys that don't have the label name
+func LabelAbsent(name string) Matcher {
+	return Matcher{
+		Type: MatchAbsent,
+		Name: name,
+	}
+}
+
+// KeyMatchers returns the Equal matchers that match the same entries Filter(k) would
+// An empty value also gets a Present matcher since Filter needs the label to be there
+func KeyMatchers(k Key) []Matcher {
+	ms := make([]Matcher, 0, len(k))
+	for _, name := range sortedKeys(k) {
+		ms = append(ms, LabelEqual(name, k[name]))
+		if k[name] == "" {
+			ms = append(ms, LabelPresent(name))
+		}
+	}
+	return ms
+}
+
+// Matches checks whether the Key satisfies the matcher
+func (m Matcher) Matches(k Key) bool {
+	value, ok := k[m.Name]
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchPresent:
+		return ok
+	case MatchAbsent:
+		return !ok
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegex:
+		re := m.regexp()
+		return re != nil && re.MatchString(value)
+	case MatchNotRegex:
+		re := m.regexp()
+		return re != nil && !re.MatchString(value)
+	}
+	return false
+}
+
+// regexp returns the compiled regex. Matchers made without NewMatcher are compiled on every call
+// and one that doesn't compile is nil, which matches nothing
+func (m Matcher) regexp() *regexp.Regexp {
+	if m.re != nil {
+		return m.re
+	}
+	re, err := compileAnchored(m.Value)
+	if err != nil {
+		return nil
+	}
+	return re
+}
+
+// compileAnchored compiles the regex so it has to match the whole value
+func compileAnchored(regex string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + regex + ")$")
+}
+
+func (m Matcher) String() string {
+	switch m.Type {
+	case MatchEqual:
+		return fmt.Sprintf("%s=%q", m.Name, m.Value)
+	case MatchPresent:
+		return m.Name
+	case MatchAbsent:
+		return "!" + m.Name
+	case MatchNotEqual:
+		return fmt.Sprintf("%s!=%q", m.Name, m.Value)
+	case MatchRegex:
+		return fmt.Sprintf("%s=~%q", m.Name, m.Value)
+	case MatchNotRegex:
+		return fmt.Sprintf("%s!~%q", m.Name, m.Value)
+	}
+	return fmt.Sprintf("%s?%q", m.Name, m.Value)
+}
+
+// FilterMatchers returns every entry in r whose Key satisfies all of the matchers
+// Registries that aren't a MatcherFilterer are Filtered on the Equal matchers and the rest are checked after
+func FilterMatchers(r Registry, ms ...Matcher) []Entry {
+	if f, ok := r.(MatcherFilterer); ok {
+		return f.FilterMatchers(ms...)
+	}
+	return matchEntries(r.Filter(equalKey(ms)), ms)
+}
+
+// matchesAll checks whether the Key satisfies every matcher
+func matchesAll(k Key, ms []Matcher) bool {
+	for _, m := range ms {
+		if !m.Matches(k) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchEntries returns the entries whose Key satisfies every matcher
+func matchEntries(entries []Entry, ms []Matcher) []Entry {
+	matched := []Entry{}
+	for _, entry := range entries {
+		if matchesAll(entry.Key, ms) {
+			matched = append(matched, entry)
+		}
+	}
+	return matched
+}
+
+// equalKey returns a Key made of the Equal matchers. If two of them are for the same label
+// the Key only has one of them so the entries still need to be checked with matchesAll
+// Empty values are left out since they also match Keys without the label, which Filter wouldn't return
+func equalKey(ms []Matcher) Key {
+	k := Key{}
+	for _, m := range ms {
+		if m.Type == MatchEqual && m.Value != "" {
+			k[m.Name] = m.Value
+		}
+	}
+	return k
+}
+
+// firstPresentName returns the label of the first Present matcher, if there is one
+func firstPresentName(ms []Matcher) (string, bool) {
+	for _, m := range ms {
+		if m.Type == MatchPresent {
+			return m.Name, true
+		}
+	}
+	return "", false
+}
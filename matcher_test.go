@@ -0,0 +1,275 @@
+// +build all unit
+
+package registry
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Matchers", func() {
+	Describe("Given a Key", func() {
+		k := Key{"host": "web-1", "env": "prod"}
+		Context("When matching on a label's value", func() {
+			It("Then only the exact value should match", func() {
+				Expect(LabelEqual("host", "web-1").Matches(k)).To(BeTrue())
+				Expect(LabelEqual("host", "web-2").Matches(k)).To(BeFalse())
+				Expect(LabelEqual("region", "us").Matches(k)).To(BeFalse())
+			})
+		})
+		Context("When matching on a label that isn't there", func() {
+			It("Then it should count as the empty value for every type but Present and Absent", func() {
+				for _, c := range []struct {
+					typ   MatchType
+					value string
+					match bool
+				}{
+					{MatchEqual, "", true},
+					{MatchEqual, "us", false},
+					{MatchNotEqual, "", false},
+					{MatchNotEqual, "us", true},
+					{MatchRegex, "", true},
+					{MatchRegex, ".+", false},
+					{MatchNotRegex, "", false},
+					{MatchNotRegex, ".+", true},
+					{MatchPresent, "", false},
+					{MatchAbsent, "", true},
+				} {
+					m, err := NewMatcher(c.typ, "region", c.value)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(m.Matches(k)).To(Equal(c.match), "%v", m)
+				}
+			})
+		})
+		Context("When matching on a label being there", func() {
+			It("Then any value should match", func() {
+				Expect(LabelPresent("host").Matches(k)).To(BeTrue())
+				Expect(LabelPresent("region").Matches(k)).To(BeFalse())
+			})
+		})
+		Context("When matching on a label not being there", func() {
+			It("Then only Keys without the label should match", func() {
+				Expect(LabelAbsent("host").Matches(k)).To(BeFalse())
+				Expect(LabelAbsent("region").Matches(k)).To(BeTrue())
+			})
+		})
+		Context("When matching on a label not having a value", func() {
+			It("Then a missing label should count as the empty value", func() {
+				Expect(LabelNotEqual("host", "web-1").Matches(k)).To(BeFalse())
+				Expect(LabelNotEqual("host", "web-2").Matches(k)).To(BeTrue())
+				Expect(LabelNotEqual("region", "us").Matches(k)).To(BeTrue())
+			})
+		})
+		Context("When matching on a regex", func() {
+			It("Then the regex should have to match the whole value", func() {
+				m, err := LabelRegex("host", "web-.*")
+				Expect(err).To(BeNil())
+				Expect(m.Matches(k)).To(BeTrue())
+				m, _ = LabelRegex("host", "web")
+				Expect(m.Matches(k)).To(BeFalse())
+				m, _ = LabelRegex("region", ".*")
+				Expect(m.Matches(k)).To(BeTrue())
+			})
+			It("Then a negative regex should match everything else", func() {
+				m, err := LabelNotRegex("host", "web-.*")
+				Expect(err).To(BeNil())
+				Expect(m.Matches(k)).To(BeFalse())
+				m, _ = LabelNotRegex("env", "dev|staging")
+				Expect(m.Matches(k)).To(BeTrue())
+			})
+			It("Then a regex that doesn't compile should be an error", func() {
+				_, err := LabelRegex("host", "web-(")
+				Expect(err).ToNot(BeNil())
+			})
+			It("Then a Matcher not made with NewMatcher should still work", func() {
+				Expect(Matcher{Type: MatchRegex, Name: "host", Value: "web-[0-9]"}.Matches(k)).To(BeTrue())
+				Expect(Matcher{Type: MatchRegex, Name: "host", Value: "web-("}.Matches(k)).To(BeFalse())
+			})
+		})
+		Context("When turning it into matchers", func() {
+			It("Then there should be a sorted Equal matcher for every key value pair", func() {
+				Expect(KeyMatchers(k)).To(Equal([]Matcher{LabelEqual("env", "prod"), LabelEqual("host", "web-1")}))
+			})
+			It("Then an empty value should also need the label to be there", func() {
+				Expect(KeyMatchers(Key{"env": ""})).To(Equal([]Matcher{LabelEqual("env", ""), LabelPresent("env")}))
+			})
+		})
+	})
+	Describe("Given a selector", func() {
+		Context("When it is valid", func() {
+			It("Then it should be parsed into matchers", func() {
+				ms, err := ParseMatchers(`{env!="dev", host=~"web-.*", code!~"2..",service="a\"pi"}`)
+				Expect(err).To(BeNil())
+				Expect(ms).To(HaveLen(4))
+				Expect(ms[0]).To(Equal(LabelNotEqual("env", "dev")))
+				Expect(ms[1].String()).To(Equal(`host=~"web-.*"`))
+				Expect(ms[2].String()).To(Equal(`code!~"2.."`))
+				Expect(ms[3]).To(Equal(LabelEqual("service", `a"pi`)))
+			})
+			It("Then the braces should be optional", func() {
+				ms, err := ParseMatchers(` env = "prod" , `)
+				Expect(err).To(BeNil())
+				Expect(ms).To(Equal([]Matcher{LabelEqual("env", "prod")}))
+				ms, err = ParseMatchers(`{}`)
+				Expect(err).To(BeNil())
+				Expect(ms).To(BeEmpty())
+			})
+			It("Then empty values should become absence and presence matchers", func() {
+				ms, err := ParseMatchers(`{canary="", host!=""}`)
+				Expect(err).To(BeNil())
+				Expect(ms).To(Equal([]Matcher{LabelAbsent("canary"), LabelPresent("host")}))
+			})
+		})
+		Context("When it is not valid", func() {
+			It("Then an error should say where", func() {
+				for selector, message := range map[string]string{
+					`{env="dev"`:      "at 1:11: expected '}', got end of query",
+					`{env "dev"}`:     "at 1:6: expected one of",
+					`{env=dev}`:       `at 1:6: expected quoted string, got name "dev"`,
+					`{="dev"}`:        "at 1:2: expected name",
+					`{env="dev}`:      "at 1:6: unterminated quoted string",
+					`{host=~"web-("}`: "at 1:8: invalid regex",
+					`env="dev" extra`: "at 1:11: expected end of query",
+					`{env="dev"} env`: "at 1:13: expected end of query",
+					`{env="\q"}`:      "at 1:7: invalid escape sequence",
+					`{env=="dev"}`:    "at 1:6: expected quoted string",
+					`{env!"dev"}`:     "at 1:5: expected '!=' or '!~'",
+					`{env="dev";}`:    "at 1:11: unexpected character ';'",
+				} {
+					_, err := ParseMatchers(selector)
+					Expect(err).ToNot(BeNil(), selector)
+					Expect(err.Error()).To(ContainSubstring(message), selector)
+				}
+			})
+			It("Then lines and columns should be counted across newlines", func() {
+				_, err := ParseSelector("{\n  env=\"dev\",\n  host=~\"web-(\"\n}")
+				Expect(err).To(BeAssignableToTypeOf(&ParseError{}))
+				Expect(err.(*ParseError).Pos).To(Equal(Position{Offset: 23, Line: 3, Column: 9}))
+			})
+			It("Then names the exporter wouldn't allow should be rejected", func() {
+				for selector, message := range map[string]string{
+					`{5xx="a"}`:       `at 1:2: invalid label name "5xx"`,
+					`{a:b="a"}`:       `at 1:2: invalid label name "a:b"`,
+					`5xx{code="500"}`: `at 1:1: invalid metric name "5xx"`,
+				} {
+					_, err := ParseSelector(selector)
+					Expect(err).ToNot(BeNil(), selector)
+					Expect(err.Error()).To(ContainSubstring(message), selector)
+				}
+			})
+		})
+		Context("When it has a metric name", func() {
+			It("Then the name should become a matcher on the name label", func() {
+				s, err := ParseSelector(`job:http_requests:rate5m{code=~"5.."}`)
+				Expect(err).To(BeNil())
+				Expect(s.Name).To(Equal("job:http_requests:rate5m"))
+				Expect(s.Matchers()[0]).To(Equal(LabelEqual(NameLabel, "job:http_requests:rate5m")))
+				Expect(s.Matchers()[1].String()).To(Equal(`code=~"5.."`))
+				ms, err := ParseMatchers(`up`)
+				Expect(err).To(BeNil())
+				Expect(ms).To(Equal([]Matcher{LabelEqual(NameLabel, "up")}))
+			})
+		})
+		Context("When it is parsed into a Selector", func() {
+			It("Then every name and value should know where it was", func() {
+				s, err := ParseSelector("up{ env = 'prod', path=~`/api/.*`}")
+				Expect(err).To(BeNil())
+				Expect(s.NamePos).To(Equal(Position{Offset: 0, Line: 1, Column: 1}))
+				Expect(s.Labels).To(HaveLen(2))
+				Expect(s.Labels[0].Name).To(Equal("env"))
+				Expect(s.Labels[0].Op).To(Equal(MatchEqual))
+				Expect(s.Labels[0].NamePos.Column).To(Equal(5))
+				Expect(s.Labels[0].ValuePos.Column).To(Equal(11))
+				Expect(s.Labels[1].Op).To(Equal(MatchRegex))
+				Expect(s.Labels[1].Value).To(Equal("/api/.*"))
+				Expect(s.String()).To(Equal(`up{env="prod", path=~"/api/.*"}`))
+			})
+			It("Then escapes should be unquoted in double and single quotes but not backticks", func() {
+				s, err := ParseSelector(`{a="tab\there", b='it\'s "quoted"', c="é", d=` + "`raw\\n`}")
+				Expect(err).To(BeNil())
+				Expect(s.Labels[0].Value).To(Equal("tab\there"))
+				Expect(s.Labels[1].Value).To(Equal(`it's "quoted"`))
+				Expect(s.Labels[2].Value).To(Equal("é"))
+				Expect(s.Labels[3].Value).To(Equal(`raw\n`))
+			})
+		})
+	})
+	for name, newRegistry := range conformingRegistries {
+		name, newRegistry := name, newRegistry
+		Describe("Given a "+name+" registry", func() {
+			var r Registry
+			web1 := Key{"host": "web-1", "env": "prod"}
+			web2 := Key{"host": "web-2", "env": "dev"}
+			db := Key{"db": "main", "env": "prod"}
+			unlabelled := Key{}
+			BeforeEach(func() {
+				r = newRegistry()
+				r.Set(web1, 1)
+				r.Set(web2, 2)
+				r.Set(db, 3)
+				r.Set(unlabelled, 4)
+			})
+			Context("When filtering on a label being there", func() {
+				It("Then every entry with the label should be returned", func() {
+					Expect(FilterMatchers(r, LabelPresent("host"))).To(ConsistOf(Entry{web1, 1}, Entry{web2, 2}))
+				})
+			})
+			Context("When filtering on a label not being there", func() {
+				It("Then every entry without the label should be returned", func() {
+					Expect(FilterMatchers(r, LabelAbsent("host"))).To(ConsistOf(Entry{db, 3}, Entry{unlabelled, 4}))
+				})
+			})
+			Context("When mixing matchers", func() {
+				It("Then entries should satisfy all of them", func() {
+					Expect(FilterMatchers(r, LabelEqual("env", "prod"), LabelPresent("host"))).To(ConsistOf(Entry{web1, 1}))
+					Expect(FilterMatchers(r, LabelEqual("env", "prod"), LabelAbsent("host"))).To(ConsistOf(Entry{db, 3}))
+					Expect(FilterMatchers(r, LabelPresent("host"), LabelAbsent("env"))).To(BeEmpty())
+				})
+			})
+			Context("When filtering with PromQL style matchers", func() {
+				It("Then the Equal matchers should be combined with the rest", func() {
+					ms, err := ParseMatchers(`{env="prod", host=~"web-.*"}`)
+					Expect(err).To(BeNil())
+					Expect(FilterMatchers(r, ms...)).To(ConsistOf(Entry{web1, 1}))
+					ms, err = ParseMatchers(`{env!="dev", db!~"main"}`)
+					Expect(err).To(BeNil())
+					Expect(FilterMatchers(r, ms...)).To(ConsistOf(Entry{web1, 1}, Entry{unlabelled, 4}))
+				})
+			})
+			Context("When running a query", func() {
+				It("Then the entries it selects should be returned", func() {
+					entries, err := Query(r, `{env="prod", host=~"web-.*"}`)
+					Expect(err).To(BeNil())
+					Expect(entries).To(ConsistOf(Entry{web1, 1}))
+					entries, err = Query(plainRegistry{r}, `{env!="dev", db=""}`)
+					Expect(err).To(BeNil())
+					Expect(entries).To(ConsistOf(Entry{web1, 1}, Entry{unlabelled, 4}))
+					_, err = Query(r, `{env=}`)
+					Expect(err).ToNot(BeNil())
+				})
+			})
+			Context("When matching on an empty value", func() {
+				It("Then entries without the label should be returned too", func() {
+					Expect(FilterMatchers(r, LabelEqual("host", ""))).To(ConsistOf(Entry{db, 3}, Entry{unlabelled, 4}))
+					Expect(FilterMatchers(r, LabelEqual("host", ""), LabelEqual("env", "prod"))).To(ConsistOf(Entry{db, 3}))
+				})
+			})
+			Context("When two Equal matchers disagree on a label", func() {
+				It("Then nothing should be returned", func() {
+					Expect(FilterMatchers(r, LabelEqual("env", "prod"), LabelEqual("env", "dev"))).To(BeEmpty())
+				})
+			})
+			Context("When there are no matchers", func() {
+				It("Then every entry should be returned", func() {
+					Expect(FilterMatchers(r)).To(HaveLen(4))
+				})
+			})
+			Context("When the registry doesn't filter on matchers itself", func() {
+				It("Then the fallback should return the same entries", func() {
+					ms := []Matcher{LabelEqual("env", "prod"), LabelPresent("host")}
+					Expect(FilterMatchers(plainRegistry{r}, ms...)).To(ConsistOf(FilterMatchers(r, ms...)))
+				})
+			})
+		})
+	}
+})
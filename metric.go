@@ -0,0 +1,198 @@
+package registry
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync/atomic"
+)
+
+/*
+
+	Counter, Gauge and Histogram are values meant to be stored in a registry. They are
+	stored as pointers so once one is registered under a Key, updating it never has to
+	go back through Set. Every update is atomic so they can be shared between goroutines
+	without a lock, and since they are plain values Filter returns them like any other.
+
+*/
+
+var (
+	// ErrMetricTypeMismatch is returned by GetOrRegisterCounter and friends when the Key already holds another type of value
+	ErrMetricTypeMismatch = errors.New("Key already holds a different type of value")
+)
+
+// DefaultBuckets are the upper bounds used by a Histogram when none are given
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Counter is a value that only ever goes up
+type Counter struct {
+	value uint64
+}
+
+// NewCounter returns a Counter starting at zero
+func NewCounter() *Counter {
+	return &Counter{}
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Add adds n to the counter
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Value returns the current count
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	bits uint64 // float64 stored as bits so it can be updated atomically
+}
+
+// NewGauge returns a Gauge starting at zero
+func NewGauge() *Gauge {
+	return &Gauge{}
+}
+
+// Set replaces the value of the gauge
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+// Add adds v to the gauge
+func (g *Gauge) Add(v float64) {
+	addFloat64(&g.bits, v)
+}
+
+// Sub subtracts v from the gauge
+func (g *Gauge) Sub(v float64) {
+	addFloat64(&g.bits, -v)
+}
+
+// Value returns the current value of the gauge
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// Histogram counts observations into buckets by their upper bound
+type Histogram struct {
+	count   uint64
+	sumBits uint64    // float64 stored as bits so it can be updated atomically
+	buckets []float64 // sorted upper bounds, the last bucket (+Inf) is implied
+	counts  []uint64  // counts[i] is the number of observations in (buckets[i-1], buckets[i]]
+}
+
+// HistogramSnapshot is a point in time copy of a Histogram. Counts are cumulative
+// like Prometheus does it so Counts[i] is the number of observations <= Buckets[i]
+type HistogramSnapshot struct {
+	Buckets []float64
+	Counts  []uint64
+	Count   uint64
+	Sum     float64
+}
+
+// NewHistogram returns a Histogram with the given bucket upper bounds or DefaultBuckets if none are given
+func NewHistogram(buckets []float64) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	sorted := make([]float64, 0, len(buckets))
+	for _, b := range buckets {
+		if !math.IsInf(b, 1) {
+			sorted = append(sorted, b)
+		}
+	}
+	sort.Float64s(sorted)
+	return &Histogram{
+		buckets: sorted,
+		counts:  make([]uint64, len(sorted)+1),
+	}
+}
+
+// Observe adds v to the histogram
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	addFloat64(&h.sumBits, v)
+	atomic.AddUint64(&h.count, 1)
+}
+
+// Snapshot returns the current buckets, count and sum of the histogram
+// NOTE: Observes that happen during Snapshot may show up in some fields and not others
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Buckets: append([]float64{}, h.buckets...),
+		Counts:  make([]uint64, len(h.buckets)),
+		Count:   atomic.LoadUint64(&h.count),
+		Sum:     math.Float64frombits(atomic.LoadUint64(&h.sumBits)),
+	}
+	var cumulative uint64
+	for i := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		s.Counts[i] = cumulative
+	}
+	return s
+}
+
+// GetOrRegisterCounter returns the Counter stored at k, creating one if k is not in r
+func GetOrRegisterCounter(r Registry, k Key) (*Counter, error) {
+	i, err := getOrRegister(r, k, func() interface{} { return NewCounter() })
+	if err != nil {
+		return nil, err
+	}
+	c, ok := i.(*Counter)
+	if !ok {
+		return nil, ErrMetricTypeMismatch
+	}
+	return c, nil
+}
+
+// GetOrRegisterGauge returns the Gauge stored at k, creating one if k is not in r
+func GetOrRegisterGauge(r Registry, k Key) (*Gauge, error) {
+	i, err := getOrRegister(r, k, func() interface{} { return NewGauge() })
+	if err != nil {
+		return nil, err
+	}
+	g, ok := i.(*Gauge)
+	if !ok {
+		return nil, ErrMetricTypeMismatch
+	}
+	return g, nil
+}
+
+// GetOrRegisterHistogram returns the Histogram stored at k, creating one with buckets if k is not in r
+// If the Histogram already exists, buckets is ignored
+func GetOrRegisterHistogram(r Registry, k Key, buckets []float64) (*Histogram, error) {
+	i, err := getOrRegister(r, k, func() interface{} { return NewHistogram(buckets) })
+	if err != nil {
+		return nil, err
+	}
+	h, ok := i.(*Histogram)
+	if !ok {
+		return nil, ErrMetricTypeMismatch
+	}
+	return h, nil
+}
+
+// getOrRegister returns the value at k or Sets the value from create if there is none, or why it couldn't
+// NOTE: This is only safe to call from multiple goroutines if r is (e.g. SafeRegistry or ShardedRegistry)
+func getOrRegister(r Registry, k Key, create func() interface{}) (interface{}, error) {
+	i, _, err := TryGetOrCreate(r, k, create)
+	return i, err
+}
+
+// addFloat64 atomically adds v to the float64 stored as bits at addr
+func addFloat64(addr *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		next := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(addr, old, next) {
+			return
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// +build all unit
+
+package registry
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	Describe("Given a Counter", func() {
+		Context("When it is incremented from many goroutines", func() {
+			It("Then no increments should be lost", func() {
+				c := NewCounter()
+				var wg sync.WaitGroup
+				for w := 0; w < concurrentWorkers; w++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := 0; i < concurrentOperations; i++ {
+							c.Inc()
+						}
+					}()
+				}
+				wg.Wait()
+				c.Add(5)
+				Expect(c.Value()).To(Equal(uint64(concurrentWorkers*concurrentOperations + 5)))
+			})
+		})
+	})
+	Describe("Given a Gauge", func() {
+		Context("When it is Set, Added to and Subtracted from", func() {
+			It("Then the value should follow along", func() {
+				g := NewGauge()
+				g.Set(2.5)
+				g.Add(1)
+				g.Sub(0.5)
+				Expect(g.Value()).To(Equal(3.0))
+			})
+		})
+	})
+	Describe("Given a Histogram", func() {
+		Context("When values are observed", func() {
+			It("Then the snapshot should have cumulative bucket counts", func() {
+				h := NewHistogram([]float64{10, 1, 5})
+				for _, v := range []float64{0.5, 1, 3, 7, 100} {
+					h.Observe(v)
+				}
+				s := h.Snapshot()
+				Expect(s.Buckets).To(Equal([]float64{1, 5, 10}))
+				Expect(s.Counts).To(Equal([]uint64{2, 3, 4}))
+				Expect(s.Count).To(Equal(uint64(5)))
+				Expect(s.Sum).To(Equal(111.5))
+			})
+		})
+		Context("When no buckets are given", func() {
+			It("Then the default buckets should be used", func() {
+				Expect(NewHistogram(nil).Snapshot().Buckets).To(Equal(DefaultBuckets))
+			})
+		})
+	})
+	Describe("Given a registry", func() {
+		var r Registry
+		BeforeEach(func() {
+			r = NewBetterRegistry()
+		})
+		Context("When a Counter is registered twice with the same Key", func() {
+			It("Then the same Counter should be returned", func() {
+				c1, err := GetOrRegisterCounter(r, Key{"name": "requests"})
+				Expect(err).To(BeNil())
+				c1.Inc()
+				c2, err := GetOrRegisterCounter(r, Key{"name": "requests"})
+				Expect(err).To(BeNil())
+				Expect(c2).To(BeIdenticalTo(c1))
+				Expect(c2.Value()).To(Equal(uint64(1)))
+			})
+		})
+		Context("When the Key already holds a different type", func() {
+			It("Then an error should be returned", func() {
+				_, err := GetOrRegisterGauge(r, Key{"name": "requests"})
+				Expect(err).To(BeNil())
+				_, err = GetOrRegisterCounter(r, Key{"name": "requests"})
+				Expect(err).To(Equal(ErrMetricTypeMismatch))
+				_, err = GetOrRegisterHistogram(r, Key{"name": "requests"}, nil)
+				Expect(err).To(Equal(ErrMetricTypeMismatch))
+			})
+		})
+		Context("When filtering on a shared label", func() {
+			It("Then every metric with the label should be returned", func() {
+				c, _ := GetOrRegisterCounter(r, Key{"name": "requests", "code": "200"})
+				c.Add(3)
+				c, _ = GetOrRegisterCounter(r, Key{"name": "requests", "code": "500"})
+				c.Inc()
+				var total uint64
+				for _, e := range r.Filter(Key{"name": "requests"}) {
+					total += e.Value.(*Counter).Value()
+				}
+				Expect(total).To(Equal(uint64(4)))
+			})
+		})
+	})
+	Describe("Given a limited registry inside another wrapper", func() {
+		wrappers := map[string]func(Registry) Registry{
+			"expiring":    func(r Registry) Registry { return NewExpiringRegistry(r, time.Hour) },
+			"time series": func(r Registry) Registry { return NewTimeSeriesRegistry(r, Retention{}) },
+			"safe":        func(r Registry) Registry { return NewSafeRegistry(r) },
+		}
+		for name, wrap := range wrappers {
+			wrap := wrap
+			Context("When the "+name+" registry registers a Counter over the limit", func() {
+				It("Then the limit error should come through", func() {
+					r := wrap(NewLimitedRegistry(NewCacheRegistry(10), Limits{MaxEntries: 1}, LimitReject))
+					_, err := GetOrRegisterCounter(r, Key{"name": "a"})
+					Expect(err).ToNot(HaveOccurred())
+					_, err = GetOrRegisterCounter(r, Key{"name": "b"})
+					Expect(errors.Is(err, ErrTooManyEntries)).To(BeTrue())
+					Expect(TrySet(r, Key{"name": "c"}, 1)).To(MatchError(ErrTooManyEntries))
+				})
+			})
+		}
+	})
+})
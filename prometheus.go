@@ -0,0 +1,319 @@
+package registry
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+
+	PrometheusExporter writes every entry in a registry out in the Prometheus text format
+	(https://prometheus.io/docs/instrumenting/exposition_formats/). The metric name comes
+	from the NameLabel label in the Key and the rest of the Key becomes the label set.
+	Entries without a name or with a value that can't be turned into a number are skipped.
+
+	Counter, Gauge and Histogram are exported with their type. Plain numbers (int, float64, ...)
+	are exported as untyped. Everything is sorted so the output is the same on every scrape.
+
+	Names are sanitized, so two different names can come out the same, "queue.depth" and
+	"queue-depth" or labels "a-b" and "a_b". Merging them would write one family twice or a
+	series with the same label twice, so Write returns an error instead. So does a Histogram
+	with an le label since its buckets need that label for themselves.
+
+*/
+
+const (
+	// NameLabel is the label in a Key that holds the Prometheus metric name
+	NameLabel = "__name__"
+
+	prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	bucketLabel = "le"
+)
+
+var (
+	metricNameCollision = errors.New("Metric names are the same once sanitized")
+	labelNameCollision  = errors.New("Label names are the same once sanitized")
+)
+
+// PrometheusExporter renders the entries of a Registry in the Prometheus text format
+type PrometheusExporter struct {
+	registry Registry
+}
+
+// metricFamily is all the samples that share a metric name
+type metricFamily struct {
+	name    string
+	rawName string // The NameLabel the family was made for, before it was sanitized
+	typ     string
+	samples []string // fully rendered sample lines
+}
+
+// NewPrometheusExporter returns an exporter for the entries in r
+func NewPrometheusExporter(r Registry) *PrometheusExporter {
+	return &PrometheusExporter{
+		registry: r,
+	}
+}
+
+// ServeHTTP writes the registry in the Prometheus text format so the exporter can be mounted on /metrics
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", prometheusContentType)
+	if err := e.Write(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Write writes every entry in the registry to w in the Prometheus text format
+func (e *PrometheusExporter) Write(w io.Writer) error {
+	// Entries without a name aren't exported so their labels can't fail the scrape
+	entries := []Entry{}
+	for _, entry := range e.registry.Filter(Key{}) {
+		if entry.Key[NameLabel] != "" {
+			entries = append(entries, entry)
+		}
+	}
+	names := make([]string, len(entries))
+	labels := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = sanitizeName(entry.Key[NameLabel], true)
+		l, err := formatLabels(entry.Key)
+		if err != nil {
+			return err
+		}
+		labels[i] = l
+	}
+	sort.Sort(entriesByLabels{entries: entries, names: names, labels: labels})
+
+	families := map[string]*metricFamily{}
+	familyNames := []string{}
+	for i, entry := range entries {
+		rawName, name := entry.Key[NameLabel], names[i]
+		if _, ok := entry.Value.(*Histogram); ok && hasLabel(entry.Key, bucketLabel) {
+			return fmt.Errorf("%w: histogram %v has an %s label", labelNameCollision, entry.Key, bucketLabel)
+		}
+		typ, samples, ok := renderSamples(name, labels[i], entry.Value)
+		if !ok {
+			continue
+		}
+		family, ok := families[name]
+		if !ok {
+			family = &metricFamily{
+				name:    name,
+				rawName: rawName,
+				typ:     typ,
+			}
+			families[name] = family
+			familyNames = append(familyNames, name)
+		}
+		if family.rawName != rawName {
+			return fmt.Errorf("%w: %q and %q are both %q", metricNameCollision, family.rawName, rawName, name)
+		}
+		if family.typ != typ {
+			// Prometheus can't have one name with two types, the first one wins
+			continue
+		}
+		family.samples = append(family.samples, samples...)
+	}
+
+	// Entries are sorted by sanitized name so the families already are
+	bw := bufio.NewWriter(w)
+	for _, name := range familyNames {
+		family := families[name]
+		bw.WriteString("# TYPE " + family.name + " " + family.typ + "\n")
+		for _, sample := range family.samples {
+			bw.WriteString(sample)
+		}
+	}
+	return bw.Flush()
+}
+
+// renderSamples returns the Prometheus type and sample lines for a value or false if it can't be exported
+func renderSamples(name string, labels string, i interface{}) (string, []string, bool) {
+	switch v := i.(type) {
+	case *Counter:
+		return "counter", []string{renderSample(name, labels, float64(v.Value()))}, true
+	case *Gauge:
+		return "gauge", []string{renderSample(name, labels, v.Value())}, true
+	case *Histogram:
+		s := v.Snapshot()
+		samples := make([]string, 0, len(s.Buckets)+3)
+		for i, b := range s.Buckets {
+			samples = append(samples, renderSample(name+"_bucket", appendLabel(labels, bucketLabel, formatFloat(b)), float64(s.Counts[i])))
+		}
+		samples = append(samples,
+			renderSample(name+"_bucket", appendLabel(labels, bucketLabel, "+Inf"), float64(s.Count)),
+			renderSample(name+"_sum", labels, s.Sum),
+			renderSample(name+"_count", labels, float64(s.Count)),
+		)
+		return "histogram", samples, true
+	}
+	f, ok := toFloat64(i)
+	if !ok {
+		return "", nil, false
+	}
+	return "untyped", []string{renderSample(name, labels, f)}, true
+}
+
+func renderSample(name string, labels string, v float64) string {
+	if labels == "" {
+		return name + " " + formatFloat(v) + "\n"
+	}
+	return name + "{" + labels + "} " + formatFloat(v) + "\n"
+}
+
+// formatLabels renders every label except the name as sorted, escaped name="value" pairs
+// It fails if two label names are the same once sanitized
+func formatLabels(k Key) (string, error) {
+	labels := ""
+	seen := map[string]string{}
+	for _, name := range sortedKeys(k) {
+		if name == NameLabel {
+			continue
+		}
+		sanitized := sanitizeName(name, false)
+		if other, ok := seen[sanitized]; ok {
+			return "", fmt.Errorf("%w: %q and %q in %v are both %q", labelNameCollision, other, name, k, sanitized)
+		}
+		seen[sanitized] = name
+		labels = appendLabel(labels, sanitized, k[name])
+	}
+	return labels, nil
+}
+
+// hasLabel checks if k has a label that is called name once sanitized
+func hasLabel(k Key, name string) bool {
+	for l := range k {
+		if l != NameLabel && sanitizeName(l, false) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func appendLabel(labels string, name string, value string) string {
+	label := name + `="` + escapeLabelValue(value) + `"`
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// toFloat64 converts the numeric types to a float64
+func toFloat64(i interface{}) (float64, bool) {
+	switch v := i.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// validName checks a label name matches [a-zA-Z_][a-zA-Z0-9_]* or,
+// with allowColon, a metric name matches [a-zA-Z_:][a-zA-Z0-9_:]*
+func validName(name string, allowColon bool) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if !validNameRune(c, i, allowColon) {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeName replaces every character Prometheus doesn't allow in a name with an underscore
+func sanitizeName(name string, allowColon bool) string {
+	if validName(name, allowColon) {
+		return name
+	}
+	if name == "" {
+		return "_"
+	}
+	b := []rune(name)
+	for i, c := range b {
+		if !validNameRune(c, i, allowColon) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func validNameRune(c rune, i int, allowColon bool) bool {
+	return c == '_' ||
+		(c >= 'a' && c <= 'z') ||
+		(c >= 'A' && c <= 'Z') ||
+		(c == ':' && allowColon) ||
+		(c >= '0' && c <= '9' && i > 0)
+}
+
+// entriesByLabels sorts entries by sanitized name first and then by their rendered labels
+type entriesByLabels struct {
+	entries []Entry
+	names   []string
+	labels  []string
+}
+
+func (e entriesByLabels) Len() int {
+	return len(e.entries)
+}
+
+func (e entriesByLabels) Less(i, j int) bool {
+	if e.names[i] != e.names[j] {
+		return e.names[i] < e.names[j]
+	}
+	return e.labels[i] < e.labels[j]
+}
+
+func (e entriesByLabels) Swap(i, j int) {
+	e.entries[i], e.entries[j] = e.entries[j], e.entries[i]
+	e.names[i], e.names[j] = e.names[j], e.names[i]
+	e.labels[i], e.labels[j] = e.labels[j], e.labels[i]
+}
@@ -0,0 +1,117 @@
+// +build all unit
+
+package registry
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const prometheusGoldenFile = "testdata/prometheus.golden"
+
+var _ = Describe("Prometheus exporter", func() {
+	Describe("Given a registry with metrics in it", func() {
+		var r Registry
+		BeforeEach(func() {
+			r = NewSimpleRegistry()
+			c, _ := GetOrRegisterCounter(r, Key{NameLabel: "http_requests_total", "method": "GET", "code": "200"})
+			c.Add(3)
+			c, _ = GetOrRegisterCounter(r, Key{NameLabel: "http_requests_total", "method": "GET", "code": "500"})
+			c.Inc()
+			g, _ := GetOrRegisterGauge(r, Key{NameLabel: "temperature", "room": "living \"room\"\\ \n"})
+			g.Set(21.5)
+			h, _ := GetOrRegisterHistogram(r, Key{NameLabel: "latency_seconds"}, []float64{0.1, 1})
+			h.Observe(0.05)
+			h.Observe(0.5)
+			h.Observe(2)
+			r.Set(Key{NameLabel: "queue.depth", "bad-label": "x"}, 7)
+			r.Set(Key{NameLabel: "http_requests_total", "method": "POST"}, 2) // different type
+			r.Set(Key{NameLabel: "version"}, "not a number")
+			r.Set(Key{"no": "name"}, 1)
+		})
+		Context("When the registry is written out", func() {
+			It("Then it should match the golden file", func() {
+				expected, err := ioutil.ReadFile(prometheusGoldenFile)
+				Expect(err).To(BeNil())
+				var b bytes.Buffer
+				Expect(NewPrometheusExporter(r).Write(&b)).To(Succeed())
+				Expect(b.String()).To(Equal(string(expected)))
+			})
+		})
+		Context("When the exporter is scraped over http", func() {
+			It("Then it should respond with the text format", func() {
+				expected, err := ioutil.ReadFile(prometheusGoldenFile)
+				Expect(err).To(BeNil())
+				w := httptest.NewRecorder()
+				NewPrometheusExporter(r).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+				Expect(w.Code).To(Equal(http.StatusOK))
+				Expect(w.Header().Get("Content-Type")).To(Equal(prometheusContentType))
+				Expect(w.Body.String()).To(Equal(string(expected)))
+			})
+		})
+	})
+	Describe("Given names that are the same once sanitized", func() {
+		var r Registry
+		BeforeEach(func() {
+			r = NewSimpleRegistry()
+		})
+		Context("When two metric names only differ in characters that are replaced", func() {
+			It("Then writing should fail instead of merging them", func() {
+				r.Set(Key{NameLabel: "queue.depth"}, 1)
+				r.Set(Key{NameLabel: "queue-depth", "q": "a"}, 2)
+				err := NewPrometheusExporter(r).Write(&bytes.Buffer{})
+				Expect(errors.Is(err, metricNameCollision)).To(BeTrue())
+			})
+		})
+		Context("When two label names only differ in characters that are replaced", func() {
+			It("Then writing should fail", func() {
+				r.Set(Key{NameLabel: "up", "a-b": "1", "a_b": "2"}, 1)
+				err := NewPrometheusExporter(r).Write(&bytes.Buffer{})
+				Expect(errors.Is(err, labelNameCollision)).To(BeTrue())
+			})
+		})
+		Context("When the label names are on an entry without a name", func() {
+			It("Then writing should skip the entry and succeed", func() {
+				r.Set(Key{"a-b": "1", "a_b": "2"}, 1)
+				r.Set(Key{NameLabel: "up"}, 1)
+				var b bytes.Buffer
+				Expect(NewPrometheusExporter(r).Write(&b)).To(Succeed())
+				Expect(b.String()).To(Equal("# TYPE up untyped\nup 1\n"))
+			})
+		})
+		Context("When a histogram has an le label", func() {
+			It("Then writing should fail since its buckets need the label", func() {
+				_, err := GetOrRegisterHistogram(r, Key{NameLabel: "latency_seconds", "le": "x"}, []float64{1})
+				Expect(err).ToNot(HaveOccurred())
+				r.Set(Key{NameLabel: "plain", "le": "x"}, 1)
+				err = NewPrometheusExporter(r).Write(&bytes.Buffer{})
+				Expect(errors.Is(err, labelNameCollision)).To(BeTrue())
+			})
+		})
+		Context("When names sort differently once sanitized", func() {
+			It("Then the families should be in sanitized order", func() {
+				r.Set(Key{NameLabel: "a.b"}, 1)
+				r.Set(Key{NameLabel: "a_a"}, 2)
+				r.Set(Key{NameLabel: "aZ"}, 3)
+				var b bytes.Buffer
+				Expect(NewPrometheusExporter(r).Write(&b)).To(Succeed())
+				Expect(b.String()).To(Equal("# TYPE aZ untyped\naZ 3\n# TYPE a_a untyped\na_a 2\n# TYPE a_b untyped\na_b 1\n"))
+			})
+		})
+	})
+	Describe("Given a name", func() {
+		Context("When it has characters Prometheus does not allow", func() {
+			It("Then they should be replaced with underscores", func() {
+				Expect(sanitizeName("0a-b:c", false)).To(Equal("_a_b_c"))
+				Expect(sanitizeName("0a-b:c", true)).To(Equal("_a_b:c"))
+				Expect(sanitizeName("ok_name", false)).To(Equal("ok_name"))
+			})
+		})
+	})
+})
@@ -0,0 +1,133 @@
+package registry
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+
+	A counter in a registry only has its latest value, which on its own says nothing about
+	how fast it is going up. RateTracker samples the entries a Filter Key matches every time
+	Record is called and keeps the samples for the last window in a TimeSeriesRegistry, so
+	Rate, Increase and Delta can look back over them.
+
+	Counters start again from zero when a process restarts. Increase and Rate treat any drop
+	in value as a reset and count the new value as what was added since, like Prometheus'
+	increase() and rate() do. Unlike Prometheus nothing is extrapolated to the edges of the
+	window, the results only cover the time between the first and last sample. Delta is for
+	gauges and is just the last value minus the first.
+
+	Entries need at least two samples in the window to show up in the results. Keys that
+	stop matching, or go away, are forgotten once their last sample is older than the window.
+
+*/
+
+// RateTracker computes how fast the values of the entries matching a Filter Key change
+type RateTracker struct {
+	registry Registry
+	filter   Key
+	window   time.Duration
+	series   *TimeSeriesRegistry
+	now      func() time.Time
+}
+
+// NewRateTracker returns a RateTracker for the entries in r that contain k, looking back over window
+func NewRateTracker(r Registry, k Key, window time.Duration) *RateTracker {
+	t := &RateTracker{
+		registry: r,
+		filter:   copyKey(k),
+		window:   window,
+		now:      time.Now,
+	}
+	t.series = NewTimeSeriesRegistry(NewBetterRegistry(), Retention{MaxAge: window})
+	t.series.now = func() time.Time { return t.now() }
+	return t
+}
+
+// Record adds a sample of every matching entry's current value
+// Entries that aren't numbers or whose sample can't be added are skipped and the first one is returned as an error
+func (t *RateTracker) Record() error {
+	now := t.now()
+	var err error
+	for _, entry := range t.registry.Filter(t.filter) {
+		v, ok := numericValue(entry.Value)
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("%w: %v holds a %T", valueNotNumeric, entry.Key, entry.Value)
+			}
+			continue
+		}
+		if appendErr := t.series.Append(entry.Key, Sample{Time: now, Value: v}); appendErr != nil && err == nil {
+			err = fmt.Errorf("%v at %v: %w", entry.Key, now, appendErr)
+		}
+	}
+	t.dropStale(now)
+	return err
+}
+
+// Rate returns the per second increase of every entry over the window
+func (t *RateTracker) Rate() []Entry {
+	return t.compute(func(samples []Sample) float64 {
+		seconds := samples[len(samples)-1].Time.Sub(samples[0].Time).Seconds()
+		if seconds == 0 {
+			return 0
+		}
+		return increase(samples) / seconds
+	})
+}
+
+// Increase returns how much every entry went up over the window, counting drops as counter resets
+func (t *RateTracker) Increase() []Entry {
+	return t.compute(increase)
+}
+
+// Delta returns the difference between the last and first value of every entry in the window
+func (t *RateTracker) Delta() []Entry {
+	return t.compute(func(samples []Sample) float64 {
+		return samples[len(samples)-1].Value.(float64) - samples[0].Value.(float64)
+	})
+}
+
+// compute runs fn over the samples in the window of every entry that has at least two
+func (t *RateTracker) compute(fn func(samples []Sample) float64) []Entry {
+	now := t.now()
+	// Query's end is exclusive and the latest samples were taken at now
+	series := t.series.Query(Key{}, now.Add(-t.window), now.Add(time.Nanosecond))
+	entries := []Entry{}
+	for _, s := range series {
+		if len(s.Samples) < 2 {
+			continue
+		}
+		entries = append(entries, Entry{
+			Key:   s.Key,
+			Value: fn(s.Samples),
+		})
+	}
+	return entries
+}
+
+// dropStale forgets entries whose latest sample is older than the window
+func (t *RateTracker) dropStale(now time.Time) {
+	oldest := now.Add(-t.window)
+	for _, entry := range t.series.registry.Filter(Key{}) {
+		// Anything that isn't a ring buffer isn't a series and can go too
+		if ring, ok := entry.Value.(*sampleRing); !ok || ring.latest().Time.Before(oldest) {
+			t.series.Delete(entry.Key)
+		}
+	}
+}
+
+// increase adds up how much the samples went up, a drop means the counter was reset so the new value is all new
+func increase(samples []Sample) float64 {
+	total := 0.0
+	for i := 1; i < len(samples); i++ {
+		previous, current := samples[i-1].Value.(float64), samples[i].Value.(float64)
+		if current < previous {
+			total += current
+			continue
+		}
+		total += current - previous
+	}
+	return total
+}
@@ -0,0 +1,129 @@
+// +build all unit
+
+package registry
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rate tracker", func() {
+	var r Registry
+	var t *RateTracker
+	var now time.Time
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	api := Key{"__name__": "requests_total", "service": "api"}
+	db := Key{"__name__": "requests_total", "service": "db"}
+
+	// recordAt Records what is in the registry as if it was t seconds after start
+	recordAt := func(seconds int) error {
+		now = start.Add(time.Duration(seconds) * time.Second)
+		return t.Record()
+	}
+
+	BeforeEach(func() {
+		r = NewCacheRegistry(10)
+		t = NewRateTracker(r, Key{"__name__": "requests_total"}, time.Minute)
+		t.now = func() time.Time { return now }
+	})
+
+	Describe("Given counters that go up steadily", func() {
+		BeforeEach(func() {
+			c := NewCounter()
+			r.Set(api, c)
+			for i := 0; i <= 6; i++ {
+				r.Set(db, i*5)
+				Expect(recordAt(i * 10)).To(Succeed())
+				c.Add(20)
+			}
+		})
+		Context("When computing the rate", func() {
+			It("Then it should be the increase per second", func() {
+				Expect(t.Rate()).To(ConsistOf(Entry{api, 2.0}, Entry{db, 0.5}))
+			})
+		})
+		Context("When computing the increase and delta", func() {
+			It("Then they should be the same since nothing was reset", func() {
+				Expect(t.Increase()).To(ConsistOf(Entry{api, 120.0}, Entry{db, 30.0}))
+				Expect(t.Delta()).To(ConsistOf(Entry{api, 120.0}, Entry{db, 30.0}))
+			})
+		})
+		Context("When samples get older than the window", func() {
+			It("Then they shouldn't count any more", func() {
+				r.Set(db, 30)
+				Expect(recordAt(90)).To(Succeed())
+				Expect(t.Increase()).To(ConsistOf(Entry{api, 80.0}, Entry{db, 15.0}))
+			})
+		})
+	})
+	Describe("Given a counter that was reset", func() {
+		BeforeEach(func() {
+			for i, v := range []int{100, 150, 10, 40} {
+				r.Set(api, v)
+				Expect(recordAt(i * 10)).To(Succeed())
+			}
+		})
+		Context("When computing the increase", func() {
+			It("Then the value after the reset should count as new", func() {
+				Expect(t.Increase()).To(ConsistOf(Entry{api, 90.0}))
+				Expect(t.Rate()).To(ConsistOf(Entry{api, 3.0}))
+			})
+		})
+		Context("When computing the delta", func() {
+			It("Then the reset should be ignored", func() {
+				Expect(t.Delta()).To(ConsistOf(Entry{api, -60.0}))
+			})
+		})
+	})
+	Describe("Given a key with only one sample", func() {
+		Context("When computing the rate", func() {
+			It("Then it should be left out", func() {
+				r.Set(api, 1)
+				Expect(recordAt(0)).To(Succeed())
+				Expect(t.Rate()).To(BeEmpty())
+			})
+		})
+	})
+	Describe("Given a key that goes away", func() {
+		Context("When its last sample is older than the window", func() {
+			It("Then it should be forgotten", func() {
+				r.Set(api, 1)
+				r.Set(db, 1)
+				Expect(recordAt(0)).To(Succeed())
+				r.Delete(db)
+				Expect(recordAt(30)).To(Succeed())
+				Expect(t.series.Filter(Key{})).To(HaveLen(2))
+				Expect(recordAt(70)).To(Succeed())
+				Expect(t.series.Filter(Key{})).To(ConsistOf(Entry{api, 1.0}))
+			})
+		})
+	})
+	Describe("Given a value that isn't a number", func() {
+		Context("When it is recorded", func() {
+			It("Then the rest should still be recorded and the error should say which Key", func() {
+				r.Set(api, "lots")
+				r.Set(db, 1)
+				err := recordAt(0)
+				Expect(errors.Is(err, valueNotNumeric)).To(BeTrue())
+				Expect(err.Error()).To(ContainSubstring("service:api"))
+				Expect(t.series.Get(db)).To(Equal(1.0))
+			})
+		})
+	})
+	Describe("Given a clock that went backwards", func() {
+		Context("When samples are recorded", func() {
+			It("Then the out of order sample should be returned as an error and the latest kept", func() {
+				r.Set(api, 5)
+				Expect(recordAt(10)).To(Succeed())
+				r.Set(api, 3)
+				err := recordAt(5)
+				Expect(errors.Is(err, sampleOutOfOrder)).To(BeTrue())
+				Expect(err.Error()).To(ContainSubstring("service:api"))
+				Expect(t.series.Get(api)).To(Equal(5.0))
+			})
+		})
+	})
+})
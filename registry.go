@@ -1,17 +1,63 @@
-package registry
-
-// Registry collects all the metrics to be stored
-type Registry interface {
-	Get(k Key) interface{}
-	Filter(k Key) []Entry
-	Set(k Key, i interface{})
-	Delete(k Key)
-}
-
-// Key is made up of key value pair combinations which can be filtered on later
-type Key map[string]string
-
-type Entry struct {
-	Key   Key
-	Value interface{}
-}
+package registry
+
+import "errors"
+
+var (
+	// ErrKeyNotFound is returned when there is no entry with exactly the Key
+	ErrKeyNotFound = errors.New("Key not found")
+)
+
+// Registry collects all the metrics to be stored
+type Registry interface {
+	Get(k Key) interface{}
+	// Filter returns every entry whose Key contains all of k. The empty Key matches every entry
+	Filter(k Key) []Entry
+	Set(k Key, i interface{})
+	Delete(k Key)
+}
+
+// CheckedRegistry is a Registry that can say what went wrong. Get, Set and Delete are the same as
+// TryGet, TrySet and TryDelete with the error thrown away
+type CheckedRegistry interface {
+	Registry
+	// Lookup returns the value at k and whether there is an entry at k, so a nil value isn't mistaken for a missing one
+	Lookup(k Key) (interface{}, bool)
+	// TryGet returns the value at k or ErrKeyNotFound
+	TryGet(k Key) (interface{}, error)
+	// TrySet replaces or creates the entry at k or returns why it couldn't, like going over a limit
+	TrySet(k Key, i interface{}) error
+	// TryDelete removes the entry at k or returns ErrKeyNotFound if there is none
+	TryDelete(k Key) error
+}
+
+// Updater is implemented by registries that can read and write an entry with a single lookup
+type Updater interface {
+	// Update replaces the value at k with what fn returns. old is nil if k is not in the registry yet
+	Update(k Key, fn func(old interface{}) interface{})
+	// GetOrCreate returns the value at k or, if k is not in the registry, Sets and returns the value from create
+	GetOrCreate(k Key, create func() interface{}) (i interface{}, created bool)
+}
+
+// CheckedUpdater is an Updater that can say why the value from create couldn't be stored
+type CheckedUpdater interface {
+	Updater
+	// TryGetOrCreate is GetOrCreate but returns why the value from create wasn't stored, in which case i is nil
+	TryGetOrCreate(k Key, create func() interface{}) (i interface{}, created bool, err error)
+}
+
+// Key is made up of key value pair combinations which can be filtered on later
+type Key map[string]string
+
+type Entry struct {
+	Key   Key
+	Value interface{}
+}
+
+// copyKey returns a copy of k so a registry isn't changed when the caller reuses their Key
+func copyKey(k Key) Key {
+	c := make(Key, len(k))
+	for key, value := range k {
+		c[key] = value
+	}
+	return c
+}
@@ -1,94 +1,267 @@
-// +build all benchmark
-package registry
-
-import (
-	"math/rand"
-	"strconv"
-	"time"
-
-	. "github.com/onsi/ginkgo"
-	. "github.com/onsi/gomega"
-)
-
-const (
-	getCacheSize   = 1000
-	getEntryCount  = 5000 // How many entries inserted to registry for get benches
-	getRepeatCount = 1000 // How many times to repeat get for each benchmark
-)
-
-var _ = Describe("Registry", func() {
-	Describe("Get", func() {
-		Context("Simple Registry", func() {
-			var r Registry
-			var k []Key
-			It("Setup registry", func() {
-				r = NewSimpleRegistry()
-				k = insertRandomEntries(r, getEntryCount)
-			})
-			Measure("Getting the same entry", func(b Benchmarker) {
-				benchGetSameKey(r, k, b)
-			}, 10)
-			Measure("Getting a random entry", func(b Benchmarker) {
-				benchGetRandomKey(r, k, b)
-			}, 10)
-		})
-		Context("Better Registry", func() {
-			var r Registry
-			var k []Key
-			It("Setup registry", func() {
-				r = NewBetterRegistry()
-				k = insertRandomEntries(r, getEntryCount)
-			})
-			Measure("Getting the same entry", func(b Benchmarker) {
-				benchGetSameKey(r, k, b)
-			}, 10)
-			Measure("Getting a random entry", func(b Benchmarker) {
-				benchGetRandomKey(r, k, b)
-			}, 10)
-		})
-		Context("Cached Registry", func() {
-			var r Registry
-			var k []Key
-			It("Setup registry", func() {
-				r = NewCacheRegistry(getCacheSize)
-				k = insertRandomEntries(r, getEntryCount)
-			})
-			Measure("Getting the same entry", func(b Benchmarker) {
-				benchGetSameKey(r, k, b)
-			}, 10)
-			Measure("Getting a random entry", func(b Benchmarker) {
-				benchGetRandomKey(r, k, b)
-			}, 10)
-		})
-	})
-})
-
-func insertRandomEntries(r Registry, count int) []Key {
-	k := []Key{}
-	for i := 0; i < count; i++ {
-		k = append(k, Key{"a" + strconv.Itoa(i): "b", "c": "d" + strconv.Itoa(i)})
-		r.Set(k[i], i)
-	}
-	return k
-}
-
-func benchGetSameKey(r Registry, k []Key, b Benchmarker) time.Duration {
-	return b.Time("runtime", func() {
-		n := len(k) - 1
-		for j := 0; j < getRepeatCount; j++ {
-			i := r.Get(k[n])
-			Expect(i).To(Equal(n))
-		}
-	})
-}
-
-func benchGetRandomKey(r Registry, k []Key, b Benchmarker) time.Duration {
-	return b.Time("runtime", func() {
-		maxEntryIndex := len(k) - 1
-		for j := 0; j < getRepeatCount; j++ {
-			n := rand.Intn(maxEntryIndex)
-			i := r.Get(k[n])
-			Expect(i).To(Equal(n))
-		}
-	})
-}
+// +build all benchmark
+package registry
+
+import (
+	"encoding/base64"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	getCacheSize   = 1000
+	getEntryCount  = 5000 // How many entries inserted to registry for get benches
+	getRepeatCount = 1000 // How many times to repeat get for each benchmark
+
+	cacheBenchSize = 10000 // How many items the caches hold in the cache benches
+
+	keyHashRepeatCount = 10000 // How many Keys to hash for each key hashing benchmark
+
+	parallelShardCount = 16 // How many shards the sharded registry uses for parallel benches
+	parallelWorkers    = 8  // How many goroutines hit the registry at the same time
+)
+
+var _ = Describe("Registry", func() {
+	Describe("Get", func() {
+		Context("Simple Registry", func() {
+			var r Registry
+			var k []Key
+			It("Setup registry", func() {
+				r = NewSimpleRegistry()
+				k = insertRandomEntries(r, getEntryCount)
+			})
+			Measure("Getting the same entry", func(b Benchmarker) {
+				benchGetSameKey(r, k, b)
+			}, 10)
+			Measure("Getting a random entry", func(b Benchmarker) {
+				benchGetRandomKey(r, k, b)
+			}, 10)
+		})
+		Context("Better Registry", func() {
+			var r Registry
+			var k []Key
+			It("Setup registry", func() {
+				r = NewBetterRegistry()
+				k = insertRandomEntries(r, getEntryCount)
+			})
+			Measure("Getting the same entry", func(b Benchmarker) {
+				benchGetSameKey(r, k, b)
+			}, 10)
+			Measure("Getting a random entry", func(b Benchmarker) {
+				benchGetRandomKey(r, k, b)
+			}, 10)
+		})
+		Context("Cached Registry", func() {
+			var r Registry
+			var k []Key
+			It("Setup registry", func() {
+				r = NewCacheRegistry(getCacheSize)
+				k = insertRandomEntries(r, getEntryCount)
+			})
+			Measure("Getting the same entry", func(b Benchmarker) {
+				benchGetSameKey(r, k, b)
+			}, 10)
+			Measure("Getting a random entry", func(b Benchmarker) {
+				benchGetRandomKey(r, k, b)
+			}, 10)
+		})
+		Context("Cached Registry with SimpleCache", func() {
+			var r Registry
+			var k []Key
+			It("Setup registry", func() {
+				c := NewCacheRegistry(getCacheSize)
+				c.getCache = NewSimpleCache(getCacheSize)
+				c.filterCache = NewSimpleCache(getCacheSize)
+				r = c
+				k = insertRandomEntries(r, getEntryCount)
+			})
+			Measure("Getting the same entry", func(b Benchmarker) {
+				benchGetSameKey(r, k, b)
+			}, 10)
+			Measure("Getting a random entry", func(b Benchmarker) {
+				benchGetRandomKey(r, k, b)
+			}, 10)
+		})
+		Context("Cached Registry with fingerprint gets", func() {
+			var r Registry
+			var k []Key
+			It("Setup registry", func() {
+				r = NewCacheRegistry(getCacheSize, WithFingerprintGets())
+				k = insertRandomEntries(r, getEntryCount)
+			})
+			Measure("Getting the same entry", func(b Benchmarker) {
+				benchGetSameKey(r, k, b)
+			}, 10)
+			Measure("Getting a random entry", func(b Benchmarker) {
+				benchGetRandomKey(r, k, b)
+			}, 10)
+		})
+		Context("Sharded Registry", func() {
+			var r Registry
+			var k []Key
+			It("Setup registry", func() {
+				r = NewShardedRegistry(parallelShardCount)
+				k = insertRandomEntries(r, getEntryCount)
+			})
+			Measure("Getting the same entry", func(b Benchmarker) {
+				benchGetSameKey(r, k, b)
+			}, 10)
+			Measure("Getting a random entry", func(b Benchmarker) {
+				benchGetRandomKey(r, k, b)
+			}, 10)
+		})
+	})
+	Describe("Cache", func() {
+		Context("SimpleCache", func() {
+			Measure("Updating random items in a full cache", func(b Benchmarker) {
+				benchCacheUpdate(NewSimpleCache(cacheBenchSize), b)
+			}, 10)
+		})
+		Context("LRUCache", func() {
+			Measure("Updating random items in a full cache", func(b Benchmarker) {
+				benchCacheUpdate(NewLRUCache(cacheBenchSize), b)
+			}, 10)
+		})
+	})
+	Describe("Key hashing", func() {
+		Context("Base64 hash string, how keys were hashed before", func() {
+			Measure("Hashing a Key", func(b Benchmarker) {
+				benchKeyHashing(func(k Key) { base64HashString(k) }, b)
+			}, 10)
+		})
+		Context("Hash string", func() {
+			Measure("Hashing a Key", func(b Benchmarker) {
+				benchKeyHashing(func(k Key) { toHashString(k) }, b)
+			}, 10)
+		})
+		Context("Fingerprint", func() {
+			Measure("Hashing a Key", func(b Benchmarker) {
+				benchKeyHashing(func(k Key) { keyFingerprint(k) }, b)
+			}, 10)
+		})
+	})
+	Describe("Parallel Get and Set", func() {
+		Context("Safe Registry", func() {
+			var r Registry
+			var k []Key
+			It("Setup registry", func() {
+				r = NewSafeRegistry(NewBetterRegistry())
+				k = insertRandomEntries(r, getEntryCount)
+			})
+			Measure("Getting and setting random entries", func(b Benchmarker) {
+				benchParallelGetSet(r, k, b)
+			}, 10)
+		})
+		Context("Sharded Registry", func() {
+			var r Registry
+			var k []Key
+			It("Setup registry", func() {
+				r = NewShardedRegistry(parallelShardCount)
+				k = insertRandomEntries(r, getEntryCount)
+			})
+			Measure("Getting and setting random entries", func(b Benchmarker) {
+				benchParallelGetSet(r, k, b)
+			}, 10)
+		})
+	})
+})
+
+func insertRandomEntries(r Registry, count int) []Key {
+	k := []Key{}
+	for i := 0; i < count; i++ {
+		k = append(k, Key{"a" + strconv.Itoa(i): "b", "c": "d" + strconv.Itoa(i)})
+		r.Set(k[i], i)
+	}
+	return k
+}
+
+func benchGetSameKey(r Registry, k []Key, b Benchmarker) time.Duration {
+	return b.Time("runtime", func() {
+		n := len(k) - 1
+		for j := 0; j < getRepeatCount; j++ {
+			i := r.Get(k[n])
+			Expect(i).To(Equal(n))
+		}
+	})
+}
+
+func benchGetRandomKey(r Registry, k []Key, b Benchmarker) time.Duration {
+	return b.Time("runtime", func() {
+		maxEntryIndex := len(k) - 1
+		for j := 0; j < getRepeatCount; j++ {
+			n := rand.Intn(maxEntryIndex)
+			i := r.Get(k[n])
+			Expect(i).To(Equal(n))
+		}
+	})
+}
+
+// benchCacheUpdate fills the cache and then updates random items so every update has to find the item's place in the recency order
+func benchCacheUpdate(c Cache, b Benchmarker) time.Duration {
+	hashes := make([]string, cacheBenchSize*2)
+	for i := range hashes {
+		hashes[i] = strconv.Itoa(i)
+	}
+	for i := 0; i < cacheBenchSize; i++ {
+		c.UpdateWithHash(hashes[i], i)
+	}
+	return b.Time("runtime", func() {
+		for j := 0; j < getRepeatCount; j++ {
+			n := rand.Intn(len(hashes))
+			c.UpdateWithHash(hashes[n], n)
+		}
+	})
+}
+
+// benchKeyHashing hashes a Key with a few labels like most metrics have and records how many allocations that takes
+func benchKeyHashing(hash func(Key), b Benchmarker) time.Duration {
+	k := Key{"__name__": "http_requests_total", "method": "GET", "code": "200", "handler": "/api/v1/query"}
+	b.RecordValue("allocations", testing.AllocsPerRun(100, func() { hash(k) }))
+	return b.Time("runtime", func() {
+		for j := 0; j < keyHashRepeatCount; j++ {
+			hash(k)
+		}
+	})
+}
+
+// base64HashString is how toHashString used to hash a Key, kept to compare against
+func base64HashString(k Key) string {
+	hash := ""
+	names := make([]string, 0, len(k))
+	for name := range k {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hash = hash + base64.StdEncoding.EncodeToString([]byte(name)) + ":" + base64.StdEncoding.EncodeToString([]byte(k[name])) + ","
+	}
+	return hash
+}
+
+// benchParallelGetSet has parallelWorkers goroutines each Get a random entry and Set it back
+func benchParallelGetSet(r Registry, k []Key, b Benchmarker) time.Duration {
+	return b.Time("runtime", func() {
+		var wg sync.WaitGroup
+		maxEntryIndex := len(k) - 1
+		for w := 0; w < parallelWorkers; w++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for j := 0; j < getRepeatCount; j++ {
+					n := rand.Intn(maxEntryIndex)
+					i := r.Get(k[n])
+					Expect(i).To(Equal(n))
+					r.Set(k[n], n)
+				}
+			}()
+		}
+		wg.Wait()
+	})
+}
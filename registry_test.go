@@ -2,7 +2,6 @@
 package registry
 
 import (
-	"encoding/base64"
 	"strconv"
 
 	. "github.com/onsi/ginkgo"
@@ -102,7 +101,7 @@ var _ = Describe("Registry", func() {
 					}
 
 					_, _, err := getEntry(r, k3)
-					Expect(err).To(Equal(keyNotFound))
+					Expect(err).To(Equal(ErrKeyNotFound))
 				})
 			})
 		})
@@ -721,7 +720,7 @@ var _ = Describe("Registry", func() {
 						k2 := map[string]string{"b": "2", "a": "1"}
 						hk1 := toHashString(k1)
 						hk2 := toHashString(k2)
-						expectedHash := base64.StdEncoding.EncodeToString([]byte("a")) + ":" + base64.StdEncoding.EncodeToString([]byte("1")) + "," + base64.StdEncoding.EncodeToString([]byte("b")) + ":" + base64.StdEncoding.EncodeToString([]byte("2")) + ","
+						expectedHash := "a\x00\x011\x00\x01b\x00\x012\x00\x01"
 						Expect(hk1).To(Equal(expectedHash))
 						Expect(hk1).To(Equal(hk2))
 					})
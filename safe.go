@@ -0,0 +1,137 @@
+package registry
+
+import "sync"
+
+/*
+
+	None of the registries lock anything on their own, so SafeRegistry wraps any of them
+	with a sync.RWMutex. Gets and Filters share a read lock as long as they really only
+	read. CachedRegistry is the odd one out: a Get or Filter updates the caches and the
+	cache keys on each hashEntry, so every call on it has to take the write lock.
+
+*/
+
+// SafeRegistry makes any Registry safe to use from multiple goroutines
+type SafeRegistry struct {
+	lock        sync.RWMutex
+	registry    Registry
+	readsMutate bool // true when Get and Filter write to the wrapped registry
+}
+
+// NewSafeRegistry wraps r so all of its methods are guarded by a lock
+func NewSafeRegistry(r Registry) *SafeRegistry {
+	return &SafeRegistry{
+		registry:    r,
+		readsMutate: readsMutate(r),
+	}
+}
+
+// Get returns the value that matches the key exactly
+func (s *SafeRegistry) Get(k Key) interface{} {
+	s.readLock()
+	defer s.readUnlock()
+	return s.registry.Get(k)
+}
+
+// Lookup returns the value at k and whether there is an entry at k
+func (s *SafeRegistry) Lookup(k Key) (interface{}, bool) {
+	s.readLock()
+	defer s.readUnlock()
+	return Lookup(s.registry, k)
+}
+
+// TryGet returns the value at k or ErrKeyNotFound
+func (s *SafeRegistry) TryGet(k Key) (interface{}, error) {
+	s.readLock()
+	defer s.readUnlock()
+	return TryGet(s.registry, k)
+}
+
+// Filter returns a list of entries that contain the key
+func (s *SafeRegistry) Filter(k Key) []Entry {
+	s.readLock()
+	defer s.readUnlock()
+	return s.registry.Filter(k)
+}
+
+// FilterMatchers returns a list of entries whose Key satisfies all the matchers
+func (s *SafeRegistry) FilterMatchers(ms ...Matcher) []Entry {
+	s.readLock()
+	defer s.readUnlock()
+	return FilterMatchers(s.registry, ms...)
+}
+
+// Set replaces or creates new entry with key and value
+func (s *SafeRegistry) Set(k Key, i interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.registry.Set(k, i)
+}
+
+// TrySet replaces or creates new entry with key and value or says why the wrapped registry couldn't
+func (s *SafeRegistry) TrySet(k Key, i interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return TrySet(s.registry, k, i)
+}
+
+// Delete removes an entry from the registry
+func (s *SafeRegistry) Delete(k Key) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.registry.Delete(k)
+}
+
+// TryDelete removes an entry from the registry or returns ErrKeyNotFound if there is none
+func (s *SafeRegistry) TryDelete(k Key) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return TryDelete(s.registry, k)
+}
+
+// Update replaces the value at k with what fn returns while holding the lock
+func (s *SafeRegistry) Update(k Key, fn func(old interface{}) interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	Update(s.registry, k, fn)
+}
+
+// GetOrCreate returns the value at k or Sets the value from create while holding the lock
+func (s *SafeRegistry) GetOrCreate(k Key, create func() interface{}) (interface{}, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return GetOrCreate(s.registry, k, create)
+}
+
+// TryGetOrCreate returns the value at k or Sets the value from create while holding the lock, or says why it couldn't
+func (s *SafeRegistry) TryGetOrCreate(k Key, create func() interface{}) (interface{}, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return TryGetOrCreate(s.registry, k, create)
+}
+
+func (s *SafeRegistry) readLock() {
+	if s.readsMutate {
+		s.lock.Lock()
+		return
+	}
+	s.lock.RLock()
+}
+
+func (s *SafeRegistry) readUnlock() {
+	if s.readsMutate {
+		s.lock.Unlock()
+		return
+	}
+	s.lock.RUnlock()
+}
+
+// readsMutate reports whether Get or Filter on r write to r's internal state
+func readsMutate(r Registry) bool {
+	switch r.(type) {
+	case *SimpleRegistry, *BetterRegistry:
+		return false
+	}
+	// CachedRegistry and anything we don't know about get the write lock to be safe
+	return true
+}
@@ -0,0 +1,69 @@
+// +build all unit
+
+package registry
+
+import (
+	"strconv"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	concurrentWorkers    = 8
+	concurrentOperations = 200
+)
+
+var _ = Describe("Safe registry", func() {
+	Describe("Given a registry wrapped with NewSafeRegistry", func() {
+		Context("When the registry only reads on Get and Filter", func() {
+			It("Then reads should share the read lock", func() {
+				Expect(NewSafeRegistry(NewSimpleRegistry()).readsMutate).To(BeFalse())
+				Expect(NewSafeRegistry(NewBetterRegistry()).readsMutate).To(BeFalse())
+			})
+		})
+		Context("When the registry writes on Get and Filter", func() {
+			It("Then reads should take the write lock", func() {
+				Expect(NewSafeRegistry(NewCacheRegistry(1)).readsMutate).To(BeTrue())
+			})
+		})
+		// Run with `go test -race` for these to mean anything
+		Context("When Get, Filter, Set and Delete are called concurrently", func() {
+			It("Then the simple registry should not race", func() {
+				runConcurrently(NewSafeRegistry(NewSimpleRegistry()))
+			})
+			It("Then the better registry should not race", func() {
+				runConcurrently(NewSafeRegistry(NewBetterRegistry()))
+			})
+			It("Then the cached registry should not race", func() {
+				runConcurrently(NewSafeRegistry(NewCacheRegistry(10)))
+			})
+		})
+	})
+})
+
+// runConcurrently has every worker Set, Get, Filter and Delete its own keys while sharing
+// one label with everybody else so Filter and the caches see each others writes
+func runConcurrently(r Registry) {
+	var wg sync.WaitGroup
+	for w := 0; w < concurrentWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer GinkgoRecover()
+			defer wg.Done()
+			worker := strconv.Itoa(w)
+			for i := 0; i < concurrentOperations; i++ {
+				k := Key{"shared": "yes", "worker": worker, "i": strconv.Itoa(i % 10)}
+				r.Set(k, i)
+				Expect(r.Get(k)).To(Equal(i))
+				Expect(r.Filter(Key{"worker": worker})).ToNot(BeEmpty())
+				r.Filter(Key{"shared": "yes"})
+				if i%3 == 0 {
+					r.Delete(k)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,260 @@
+package registry
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/*
+
+	A selector is a query like http_requests_total{service="api", code=~"5.."}. The metric
+	name in front is optional and is the same as __name__="http_requests_total". The braces
+	are optional too when there is no name, so env="prod" on its own works for flags and
+	config files.
+
+	ParseSelector turns the query into a Selector, which keeps every name and value together
+	with where it was in the query so tools can point at the part that is wrong. Label names
+	have to be valid Prometheus label names and metric names valid metric names, the same rule
+	the exporter uses, so anything a query can ask for can also be exported. Regexes are
+	compiled while parsing so a bad one is reported at its position instead of never matching.
+
+	Like PromQL, name="" matches Keys without the label and name!="" matches Keys with it, so
+	those become Absent and Present matchers.
+
+*/
+
+// Selector is a parsed query
+type Selector struct {
+	Name    string // The metric name in front of the braces, empty if there wasn't one
+	NamePos Position
+	Labels  []*LabelMatcher
+}
+
+// LabelMatcher is a single name op "value" in a Selector
+type LabelMatcher struct {
+	Name     string
+	Op       MatchType // One of MatchEqual, MatchNotEqual, MatchRegex or MatchNotRegex
+	Value    string    // Unquoted
+	NamePos  Position
+	ValuePos Position
+	re       *regexp.Regexp // Compiled Value for MatchRegex and MatchNotRegex
+}
+
+// ParseSelector parses a query into a Selector. Errors are a *ParseError with the position of the problem
+func ParseSelector(query string) (*Selector, error) {
+	p := &selectorParser{lexer: newLexer(query)}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	s, err := p.selector()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ParseMatchers parses a selector into the Matchers it is made of
+func ParseMatchers(selector string) ([]Matcher, error) {
+	s, err := ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	return s.Matchers(), nil
+}
+
+// Query parses the query and returns every entry in r it selects
+func Query(r Registry, query string) ([]Entry, error) {
+	s, err := ParseSelector(query)
+	if err != nil {
+		return nil, err
+	}
+	return s.Eval(r), nil
+}
+
+// Matchers returns the Matchers the Selector is made of, starting with the metric name
+func (s *Selector) Matchers() []Matcher {
+	ms := make([]Matcher, 0, len(s.Labels)+1)
+	if s.Name != "" {
+		ms = append(ms, LabelEqual(NameLabel, s.Name))
+	}
+	for _, l := range s.Labels {
+		ms = append(ms, l.Matcher())
+	}
+	return ms
+}
+
+// Eval returns every entry in r the Selector selects. The Equal matchers are used to Filter and the rest are checked after
+func (s *Selector) Eval(r Registry) []Entry {
+	return FilterMatchers(r, s.Matchers()...)
+}
+
+func (s *Selector) String() string {
+	labels := make([]string, len(s.Labels))
+	for i, l := range s.Labels {
+		labels[i] = l.String()
+	}
+	return s.Name + "{" + strings.Join(labels, ", ") + "}"
+}
+
+// Matcher returns the Matcher for the label, empty values become Absent and Present matchers
+func (l *LabelMatcher) Matcher() Matcher {
+	switch {
+	case l.Op == MatchEqual && l.Value == "":
+		return LabelAbsent(l.Name)
+	case l.Op == MatchNotEqual && l.Value == "":
+		return LabelPresent(l.Name)
+	}
+	return Matcher{
+		Type:  l.Op,
+		Name:  l.Name,
+		Value: l.Value,
+		re:    l.re,
+	}
+}
+
+func (l *LabelMatcher) String() string {
+	return Matcher{Type: l.Op, Name: l.Name, Value: l.Value}.String()
+}
+
+var tokenMatchTypes = map[tokenType]MatchType{
+	tokenEqual:    MatchEqual,
+	tokenNotEqual: MatchNotEqual,
+	tokenRegex:    MatchRegex,
+	tokenNotRegex: MatchNotRegex,
+}
+
+type selectorParser struct {
+	lexer *lexer
+	tok   token // The token being looked at
+	peek  *token
+}
+
+// selector parses [name] ['{' [matcher {',' matcher} [',']] '}'] or a list of matchers without braces
+func (p *selectorParser) selector() (*Selector, error) {
+	s := &Selector{Labels: []*LabelMatcher{}}
+	if p.tok.typ == tokenIdentifier {
+		next, err := p.lookahead()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := tokenMatchTypes[next.typ]; ok {
+			if err := p.matchers(s, tokenEOF); err != nil {
+				return nil, err
+			}
+			return s, p.expect(tokenEOF)
+		}
+		if !validName(p.tok.value, true) {
+			return nil, p.errorf(p.tok.pos, "invalid metric name %q", p.tok.value)
+		}
+		s.Name, s.NamePos = p.tok.value, p.tok.pos
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if p.tok.typ == tokenLeftBrace {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if err := p.matchers(s, tokenRightBrace); err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenRightBrace); err != nil {
+			return nil, err
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	return s, p.expect(tokenEOF)
+}
+
+// matchers parses comma separated matchers until the end token, a trailing comma is allowed
+func (p *selectorParser) matchers(s *Selector, end tokenType) error {
+	for p.tok.typ != end {
+		l, err := p.matcher()
+		if err != nil {
+			return err
+		}
+		s.Labels = append(s.Labels, l)
+		if p.tok.typ != tokenComma {
+			return nil
+		}
+		if err := p.advance(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matcher parses a single name op "value"
+func (p *selectorParser) matcher() (*LabelMatcher, error) {
+	if err := p.expect(tokenIdentifier); err != nil {
+		return nil, err
+	}
+	l := &LabelMatcher{Name: p.tok.value, NamePos: p.tok.pos}
+	if !validName(l.Name, false) {
+		return nil, p.errorf(l.NamePos, "invalid label name %q", l.Name)
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	op, ok := tokenMatchTypes[p.tok.typ]
+	if !ok {
+		return nil, p.errorf(p.tok.pos, "expected one of '=', '!=', '=~' or '!~' after %q, got %v", l.Name, p.tok)
+	}
+	l.Op = op
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if err := p.expect(tokenString); err != nil {
+		return nil, err
+	}
+	l.Value, l.ValuePos = p.tok.value, p.tok.pos
+	if l.Op == MatchRegex || l.Op == MatchNotRegex {
+		re, err := compileAnchored(l.Value)
+		if err != nil {
+			return nil, p.errorf(l.ValuePos, "invalid regex for %q: %v", l.Name, err)
+		}
+		l.re = re
+	}
+	return l, p.advance()
+}
+
+// advance moves on to the next token
+func (p *selectorParser) advance() error {
+	if p.peek != nil {
+		p.tok, p.peek = *p.peek, nil
+		return nil
+	}
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+// lookahead returns the token after the current one without moving on
+func (p *selectorParser) lookahead() (token, error) {
+	if p.peek == nil {
+		tok, err := p.lexer.next()
+		if err != nil {
+			return token{}, err
+		}
+		p.peek = &tok
+	}
+	return *p.peek, nil
+}
+
+// expect fails unless the current token is of the type
+func (p *selectorParser) expect(typ tokenType) error {
+	if p.tok.typ == typ {
+		return nil
+	}
+	return p.errorf(p.tok.pos, "expected %v, got %v", typ, p.tok)
+}
+
+func (p *selectorParser) errorf(pos Position, format string, args ...interface{}) error {
+	return &ParseError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
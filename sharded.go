@@ -0,0 +1,144 @@
+package registry
+
+import "sync"
+
+/*
+
+	SafeRegistry puts one lock around the whole registry so every writer waits on every
+	other writer. ShardedRegistry splits the entries across a number of EvenBetterRegistry
+	shards based on the hash of the complete Key, each with its own lock. Get, Set and Delete
+	only ever touch the one shard the Key lands in. Filter has no idea which shards have
+	matching entries so it has to ask all of them and merge the results.
+
+*/
+
+// ShardedRegistry is a thread safe registry that spreads its entries over several locked shards
+type ShardedRegistry struct {
+	shards []*shard
+}
+
+type shard struct {
+	lock     sync.RWMutex
+	registry *EvenBetterRegistry
+}
+
+// NewShardedRegistry returns a thread safe registry split into shardCount shards
+func NewShardedRegistry(shardCount int) *ShardedRegistry {
+	if shardCount < 1 {
+		shardCount = 1
+	}
+	shards := make([]*shard, shardCount)
+	for i := range shards {
+		shards[i] = &shard{
+			registry: NewEvenBetterRegistry(),
+		}
+	}
+	return &ShardedRegistry{
+		shards: shards,
+	}
+}
+
+// Get returns the value that matches the key exactly
+func (s *ShardedRegistry) Get(k Key) interface{} {
+	i, _ := s.TryGet(k)
+	return i
+}
+
+// Lookup returns the value at k and whether there is an entry at k
+func (s *ShardedRegistry) Lookup(k Key) (interface{}, bool) {
+	i, err := s.TryGet(k)
+	return i, err == nil
+}
+
+// TryGet returns the value at k or ErrKeyNotFound
+func (s *ShardedRegistry) TryGet(k Key) (interface{}, error) {
+	shard := s.shardFor(k)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	entry, err := shard.registry.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return entry.value, nil
+}
+
+// Filter returns a list of entries that contain the key from every shard
+func (s *ShardedRegistry) Filter(k Key) []Entry {
+	entries := []Entry{}
+	for _, shard := range s.shards {
+		shard.lock.RLock()
+		entries = append(entries, toEntryArray(shard.registry.Filter(k))...)
+		shard.lock.RUnlock()
+	}
+	return entries
+}
+
+// FilterMatchers returns every entry whose Key satisfies all the matchers from every shard
+func (s *ShardedRegistry) FilterMatchers(ms ...Matcher) []Entry {
+	entries := []Entry{}
+	for _, shard := range s.shards {
+		shard.lock.RLock()
+		entries = append(entries, toEntryArray(shard.registry.FilterMatchers(ms...))...)
+		shard.lock.RUnlock()
+	}
+	return entries
+}
+
+// Set replaces or creates new entry with key and value
+func (s *ShardedRegistry) Set(k Key, i interface{}) {
+	s.TrySet(k, i)
+}
+
+// TrySet is Set, it never fails
+func (s *ShardedRegistry) TrySet(k Key, i interface{}) error {
+	shard := s.shardFor(k)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	shard.registry.Set(k, i)
+	return nil
+}
+
+// Update replaces the value at k with what fn returns while holding the shard's lock
+func (s *ShardedRegistry) Update(k Key, fn func(old interface{}) interface{}) {
+	shard := s.shardFor(k)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	entry, _ := shard.registry.getOrAdd(k)
+	entry.value = fn(entry.value)
+}
+
+// GetOrCreate returns the value at k or creates it with the value from create while holding the shard's lock
+func (s *ShardedRegistry) GetOrCreate(k Key, create func() interface{}) (interface{}, bool) {
+	shard := s.shardFor(k)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	entry, created := shard.registry.getOrAdd(k)
+	if created {
+		entry.value = create()
+	}
+	return entry.value, created
+}
+
+// Delete removes an entry from the registry
+func (s *ShardedRegistry) Delete(k Key) {
+	s.TryDelete(k)
+}
+
+// TryDelete removes the entry at k or returns ErrKeyNotFound if there is none
+func (s *ShardedRegistry) TryDelete(k Key) error {
+	shard := s.shardFor(k)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if shard.registry.Delete(k) == nil {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// shardFor returns the shard that the complete Key belongs to
+func (s *ShardedRegistry) shardFor(k Key) *shard {
+	if len(s.shards) == 1 {
+		return s.shards[0]
+	}
+	return s.shards[keyFingerprint(k)%uint64(len(s.shards))]
+}
@@ -0,0 +1,62 @@
+// +build all unit
+
+package registry
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sharded registry", func() {
+	Describe("Given a user is using the sharded registry", func() {
+		var sr *ShardedRegistry
+		var k1, k2, k3 Key
+		BeforeEach(func() {
+			sr = NewShardedRegistry(4)
+			k1 = map[string]string{"a": "1", "b": "2"}
+			k2 = map[string]string{"a": "1", "b": "3"}
+			k3 = map[string]string{"a": "1"}
+			sr.Set(k1, "k1")
+			sr.Set(k2, "k2")
+			sr.Set(k3, "k3")
+		})
+		Context("When users Sets a value", func() {
+			It("Then they should be able to Get the value", func() {
+				Expect(sr.Get(k1)).To(Equal("k1"))
+				Expect(sr.Get(k2)).To(Equal("k2"))
+				Expect(sr.Get(k3)).To(Equal("k3"))
+			})
+			It("Then the same Key should always land in the same shard", func() {
+				Expect(sr.shardFor(k1)).To(BeIdenticalTo(sr.shardFor(Key{"b": "2", "a": "1"})))
+			})
+		})
+		Context("When users Filters a key", func() {
+			It("Then entries from every shard should be merged", func() {
+				entries := sr.Filter(k3)
+				Expect(entries).To(HaveLen(3))
+				Expect(entries).To(ContainElement(Entry{Key: k1, Value: "k1"}))
+				Expect(entries).To(ContainElement(Entry{Key: k2, Value: "k2"}))
+				Expect(entries).To(ContainElement(Entry{Key: k3, Value: "k3"}))
+			})
+		})
+		Context("When users delete a key that does exist", func() {
+			It("Then only that key is deleted", func() {
+				sr.Delete(k2)
+				Expect(sr.Get(k1)).To(Equal("k1"))
+				Expect(sr.Get(k2)).To(BeNil())
+				Expect(sr.Get(k3)).To(Equal("k3"))
+				Expect(sr.Filter(k3)).To(HaveLen(2))
+			})
+		})
+		Context("When asked for less than one shard", func() {
+			It("Then a single shard should be used", func() {
+				Expect(NewShardedRegistry(0).shards).To(HaveLen(1))
+			})
+		})
+		Context("When Get, Filter, Set and Delete are called concurrently", func() {
+			It("Then the sharded registry should not race", func() {
+				runConcurrently(NewShardedRegistry(4))
+			})
+		})
+	})
+})
@@ -1,103 +1,151 @@
-package registry
-
-import "errors"
-
-/*
-
-	This is probably the most straight forward implmentation. In terms of peformance,
-	it is pretty much linear time for all of the functions. It is going to be
-	O(n + avg key size).
-
-	Also it is not thread safe. Just need to add some locks for that
-
-*/
-
-// SimpleRegistry is a quick and dirty naive implementation of the resgistry
-type SimpleRegistry struct {
-	registry []*Entry
-}
-
-var (
-	keyNotFound = errors.New("Key not found")
-)
-
-// NewSimpleRegistry returns a simple implementation of registry
-func NewSimpleRegistry() *SimpleRegistry {
-	return &SimpleRegistry{
-		registry: []*Entry{},
-	}
-}
-
-// Get returns the metric that matches the key exactly
-func (r *SimpleRegistry) Get(k Key) interface{} {
-	entry, _, err := getEntry(r.registry, k)
-	if err != nil {
-		return nil
-	}
-	return entry.Value
-}
-
-// Filter returns a list of metrics that matches the key
-func (r *SimpleRegistry) Filter(k Key) []Entry {
-	ks := []Entry{}
-	for _, entry := range r.registry {
-		if isSubset(k, entry.Key) {
-			ks = append(ks, *entry)
-		}
-	}
-	return ks
-}
-
-// Set replaces or creates new entry with key and value
-func (r *SimpleRegistry) Set(k Key, i interface{}) {
-	entry, _, err := getEntry(r.registry, k)
-	if err == keyNotFound {
-		entry := &Entry{
-			Key:   k,
-			Value: i,
-		}
-		r.registry = append(r.registry, entry)
-	}
-	if entry != nil {
-		entry.Value = i
-	}
-}
-
-// Delete removes an entry from the registry
-func (r *SimpleRegistry) Delete(k Key) {
-	_, i, err := getEntry(r.registry, k)
-	if err == keyNotFound {
-		return
-	}
-	r.registry = append(r.registry[:i], r.registry[i+1:]...)
-}
-
-func getEntry(entries []*Entry, k Key) (*Entry, int, error) {
-	for i, entry := range entries {
-		if isEquals(entry.Key, k) {
-			return entry, i, nil
-		}
-	}
-	return nil, 0, keyNotFound
-}
-
-func isEquals(k1 Key, k2 Key) bool {
-	if len(k1) != len(k2) {
-		return false
-	}
-	return isSubset(k1, k2)
-}
-
-// isSubset checks whether of not all of the Keys in k is in the set
-func isSubset(k Key, set Key) bool {
-	for key := range k {
-		setValues, ok := set[key]
-		if !ok {
-			return false
-		}
-		if setValues != k[key] {
-			return false
-		}
-	}
-	return true
-}
+package registry
+
+/*
+
+	This is probably the most straight forward implmentation. In terms of peformance,
+	it is pretty much linear time for all of the functions. It is going to be
+	O(n + avg key size).
+
+	Also it is not thread safe. Wrap it with NewSafeRegistry() for that
+
+*/
+
+// SimpleRegistry is a quick and dirty naive implementation of the resgistry
+type SimpleRegistry struct {
+	registry []*Entry
+}
+
+// NewSimpleRegistry returns a simple implementation of registry
+func NewSimpleRegistry() *SimpleRegistry {
+	return &SimpleRegistry{
+		registry: []*Entry{},
+	}
+}
+
+// Get returns the metric that matches the key exactly
+func (r *SimpleRegistry) Get(k Key) interface{} {
+	i, _ := r.TryGet(k)
+	return i
+}
+
+// Lookup returns the metric that matches the key exactly and whether there is one
+func (r *SimpleRegistry) Lookup(k Key) (interface{}, bool) {
+	i, err := r.TryGet(k)
+	return i, err == nil
+}
+
+// TryGet returns the metric that matches the key exactly or ErrKeyNotFound
+func (r *SimpleRegistry) TryGet(k Key) (interface{}, error) {
+	entry, _, err := getEntry(r.registry, k)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Value, nil
+}
+
+// Filter returns a list of metrics that matches the key. An empty key matches every metric
+func (r *SimpleRegistry) Filter(k Key) []Entry {
+	ks := []Entry{}
+	for _, entry := range r.registry {
+		if isSubset(k, entry.Key) {
+			ks = append(ks, *entry)
+		}
+	}
+	return ks
+}
+
+// FilterMatchers returns a list of metrics whose key satisfies every matcher
+func (r *SimpleRegistry) FilterMatchers(ms ...Matcher) []Entry {
+	ks := []Entry{}
+	for _, entry := range r.registry {
+		if matchesAll(entry.Key, ms) {
+			ks = append(ks, *entry)
+		}
+	}
+	return ks
+}
+
+// Set replaces or creates new entry with key and value
+func (r *SimpleRegistry) Set(k Key, i interface{}) {
+	r.TrySet(k, i)
+}
+
+// TrySet replaces or creates new entry with key and value. It never fails
+func (r *SimpleRegistry) TrySet(k Key, i interface{}) error {
+	entry, _ := r.getOrAdd(k)
+	entry.Value = i
+	return nil
+}
+
+// Update replaces the value at k with what fn returns, creating the entry if needed
+func (r *SimpleRegistry) Update(k Key, fn func(old interface{}) interface{}) {
+	entry, _ := r.getOrAdd(k)
+	entry.Value = fn(entry.Value)
+}
+
+// GetOrCreate returns the value at k or creates the entry with the value from create
+func (r *SimpleRegistry) GetOrCreate(k Key, create func() interface{}) (interface{}, bool) {
+	entry, created := r.getOrAdd(k)
+	if created {
+		entry.Value = create()
+	}
+	return entry.Value, created
+}
+
+// getOrAdd returns the entry with the key, adding an empty one if there is none
+func (r *SimpleRegistry) getOrAdd(k Key) (*Entry, bool) {
+	entry, _, err := getEntry(r.registry, k)
+	if err == nil {
+		return entry, false
+	}
+	entry = &Entry{
+		Key: copyKey(k),
+	}
+	r.registry = append(r.registry, entry)
+	return entry, true
+}
+
+// Delete removes an entry from the registry
+func (r *SimpleRegistry) Delete(k Key) {
+	r.TryDelete(k)
+}
+
+// TryDelete removes an entry from the registry or returns ErrKeyNotFound if there is none
+func (r *SimpleRegistry) TryDelete(k Key) error {
+	_, i, err := getEntry(r.registry, k)
+	if err != nil {
+		return err
+	}
+	r.registry = append(r.registry[:i], r.registry[i+1:]...)
+	return nil
+}
+
+func getEntry(entries []*Entry, k Key) (*Entry, int, error) {
+	for i, entry := range entries {
+		if isEquals(entry.Key, k) {
+			return entry, i, nil
+		}
+	}
+	return nil, 0, ErrKeyNotFound
+}
+
+func isEquals(k1 Key, k2 Key) bool {
+	if len(k1) != len(k2) {
+		return false
+	}
+	return isSubset(k1, k2)
+}
+
+// isSubset checks whether of not all of the Keys in k is in the set
+func isSubset(k Key, set Key) bool {
+	for key := range k {
+		setValues, ok := set[key]
+		if !ok {
+			return false
+		}
+		if setValues != k[key] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,191 @@
+package registry
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+/*
+
+	Snapshot writes every entry in a registry to a Writer and Restore puts them back, so
+	counters survive a restart. Restore Sets every entry like any other write, so an
+	EvenBetterRegistry's index is built up again and a CachedRegistry starts with empty
+	caches that fill up as it is used.
+
+	The format, version 1. A uvarint is encoding/binary's, strings and bytes are a uvarint
+	length followed by the bytes, and everything else is big endian:
+
+		magic     "RSNP"
+		version   1 byte
+		codec     string, the Name of the ValueCodec the values were written with
+		count     uvarint, the number of entries
+		entries   count times a length prefixed entry:
+		            length    uvarint, the size of the rest of the entry in bytes
+		            labels    uvarint, the number of labels in the Key
+		            label     labels times the name and then the value, both strings, sorted by name
+		            type      string, the type name from the codec
+		            value     bytes, the value from the codec
+		checksum  4 bytes, CRC-32 (IEEE) of everything before it
+
+	Restore reads and checks the whole snapshot before it touches the registry, so a snapshot
+	that is cut off or corrupt is an error and leaves the registry as it was. Entries are put
+	back with TrySet so a registry that turns some of them away says so.
+
+*/
+
+const snapshotVersion = 1
+
+var snapshotMagic = []byte("RSNP")
+
+var (
+	// ErrNotASnapshot is returned by Restore when what it reads doesn't start like a snapshot
+	ErrNotASnapshot = errors.New("Not a registry snapshot")
+	// ErrUnsupportedVersion is returned by Restore for snapshots in a format version it can't read
+	ErrUnsupportedVersion = errors.New("Snapshot version is not supported")
+	// ErrCodecMismatch is returned by Restore when the snapshot was written with another ValueCodec
+	ErrCodecMismatch = errors.New("Snapshot was written with a different codec")
+)
+
+// Snapshot writes every entry in r to w with values encoded by codec
+func Snapshot(r Registry, w io.Writer, codec ValueCodec) error {
+	entries := r.Filter(Key{})
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	header := append([]byte{}, snapshotMagic...)
+	header = append(header, snapshotVersion)
+	header = appendBytes(header, []byte(codec.Name()))
+	header = appendUvarint(header, uint64(len(entries)))
+	bw.Write(header)
+
+	var entry []byte
+	for _, e := range entries {
+		var err error
+		entry, err = appendEntry(entry[:0], e.Key, e.Value, codec)
+		if err != nil {
+			return err
+		}
+		bw.Write(appendBytes(nil, entry))
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc.Sum32())
+	_, err := w.Write(checksum[:])
+	return err
+}
+
+// Restore replaces everything in r with the entries in a snapshot read from rd
+// If r can't take an entry, like a LimitedRegistry over its limits, the rest are still restored
+// and the first failure is returned
+func Restore(r Registry, rd io.Reader, codec ValueCodec) error {
+	entries, err := readSnapshot(rd, codec)
+	if err != nil {
+		return err
+	}
+	var first error
+	for _, e := range r.Filter(Key{}) {
+		if err := TryDelete(r, e.Key); err != nil && err != ErrKeyNotFound && first == nil {
+			first = fmt.Errorf("Can't delete %v: %w", e.Key, err)
+		}
+	}
+	for _, e := range entries {
+		if err := TrySet(r, e.Key, e.Value); err != nil && first == nil {
+			first = fmt.Errorf("Can't restore %v: %w", e.Key, err)
+		}
+	}
+	return first
+}
+
+// readSnapshot reads and checks the whole snapshot and returns the entries in it
+func readSnapshot(rd io.Reader, codec ValueCodec) ([]Entry, error) {
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(snapshotMagic)+1+4 || string(data[:len(snapshotMagic)]) != string(snapshotMagic) {
+		return nil, ErrNotASnapshot
+	}
+	if version := data[len(snapshotMagic)]; version != snapshotVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	body, checksum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != checksum {
+		return nil, fmt.Errorf("Snapshot checksum doesn't match: %w", ErrCorruptData)
+	}
+
+	d := &decoder{data: body[len(snapshotMagic)+1:]}
+	if name := d.string(); d.err == nil && name != codec.Name() {
+		return nil, fmt.Errorf("%w: %q, not %q", ErrCodecMismatch, name, codec.Name())
+	}
+	count := d.uvarint()
+	entries := []Entry{}
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		e, err := decodeEntry(d.bytes(), codec)
+		if err != nil {
+			return nil, fmt.Errorf("Snapshot entry %d: %w", i, err)
+		}
+		entries = append(entries, e)
+	}
+	if d.err != nil || len(d.data) != 0 {
+		return nil, fmt.Errorf("Snapshot doesn't have %d entries: %w", count, ErrCorruptData)
+	}
+	return entries, nil
+}
+
+// appendEntry encodes the Key and value onto b
+func appendEntry(b []byte, k Key, i interface{}, codec ValueCodec) ([]byte, error) {
+	typ, data, err := codec.Encode(i)
+	if err != nil {
+		return nil, fmt.Errorf("Can't encode the value of %v: %w", k, err)
+	}
+	b = appendKey(b, k)
+	b = appendBytes(b, []byte(typ))
+	return appendBytes(b, data), nil
+}
+
+// appendKey encodes the number of labels and then every label sorted by name
+func appendKey(b []byte, k Key) []byte {
+	b = appendUvarint(b, uint64(len(k)))
+	for _, name := range sortedKeys(k) {
+		b = appendBytes(b, []byte(name))
+		b = appendBytes(b, []byte(k[name]))
+	}
+	return b
+}
+
+// decodeEntry decodes what appendEntry wrote, all of data has to be used
+func decodeEntry(data []byte, codec ValueCodec) (Entry, error) {
+	d := &decoder{data: data}
+	k := d.key()
+	typ := d.string()
+	value := d.bytes()
+	if d.err != nil || len(d.data) != 0 {
+		return Entry{}, ErrCorruptData
+	}
+	i, err := codec.Decode(typ, value)
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{Key: k, Value: i}, nil
+}
+
+// key decodes what appendKey wrote
+func (d *decoder) key() Key {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.fail()
+		return nil
+	}
+	k := make(Key, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		name := d.string()
+		k[name] = d.string()
+	}
+	return k
+}
@@ -0,0 +1,261 @@
+// +build all unit
+
+package registry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// point is a value DefaultCodec doesn't know about
+type point struct {
+	x, y int
+}
+
+// pointCodec handles points and leaves everything else to DefaultCodec
+type pointCodec struct{}
+
+func (pointCodec) Name() string {
+	return "point"
+}
+
+func (pointCodec) Encode(i interface{}) (string, []byte, error) {
+	if p, ok := i.(point); ok {
+		return "point", []byte(fmt.Sprintf("%d,%d", p.x, p.y)), nil
+	}
+	return DefaultCodec.Encode(i)
+}
+
+func (pointCodec) Decode(typ string, data []byte) (interface{}, error) {
+	if typ == "point" {
+		var p point
+		_, err := fmt.Sscanf(string(data), "%d,%d", &p.x, &p.y)
+		return p, err
+	}
+	return DefaultCodec.Decode(typ, data)
+}
+
+var _ = Describe("Snapshots", func() {
+	Describe("Given a registry with every kind of value DefaultCodec knows", func() {
+		var r Registry
+		var snapshot *bytes.Buffer
+		h := NewHistogram([]float64{1, 5})
+		for _, v := range []float64{0.5, 3, 7, 9} {
+			h.Observe(v)
+		}
+		c := NewCounter()
+		c.Add(42)
+		g := NewGauge()
+		g.Set(-2.5)
+		values := map[string]interface{}{
+			"nil":     nil,
+			"bool":    true,
+			"string":  "hello",
+			"int":     -1,
+			"int8":    int8(-8),
+			"int16":   int16(16),
+			"int32":   int32(-32),
+			"int64":   int64(1) << 40,
+			"uint":    uint(1),
+			"uint8":   uint8(8),
+			"uint16":  uint16(16),
+			"uint32":  uint32(32),
+			"uint64":  uint64(1) << 63,
+			"float32": float32(1.5),
+			"float64": 0.1,
+		}
+		BeforeEach(func() {
+			r = NewCacheRegistry(10)
+			for typ, value := range values {
+				r.Set(Key{"type": typ, "kind": "plain"}, value)
+			}
+			r.Set(Key{"type": "counter"}, c)
+			r.Set(Key{"type": "gauge"}, g)
+			r.Set(Key{"type": "histogram"}, h)
+			r.Set(Key{}, "unlabelled")
+			snapshot = &bytes.Buffer{}
+			Expect(Snapshot(r, snapshot, DefaultCodec)).To(Succeed())
+		})
+		Context("When it is restored into a new registry", func() {
+			var restored *CachedRegistry
+			BeforeEach(func() {
+				restored = NewCacheRegistry(10)
+				Expect(Restore(restored, snapshot, DefaultCodec)).To(Succeed())
+			})
+			It("Then every plain value should come back with the same type", func() {
+				for typ, value := range values {
+					i, ok := restored.Lookup(Key{"type": typ, "kind": "plain"})
+					Expect(ok).To(BeTrue(), typ)
+					if value == nil {
+						Expect(i).To(BeNil())
+						continue
+					}
+					Expect(i).To(Equal(value), typ)
+				}
+				Expect(restored.Get(Key{})).To(Equal("unlabelled"))
+			})
+			It("Then metrics should come back as new metrics with the same state", func() {
+				restoredCounter := restored.Get(Key{"type": "counter"}).(*Counter)
+				Expect(restoredCounter).ToNot(BeIdenticalTo(c))
+				Expect(restoredCounter.Value()).To(Equal(uint64(42)))
+				Expect(restored.Get(Key{"type": "gauge"}).(*Gauge).Value()).To(Equal(-2.5))
+				restoredHistogram := restored.Get(Key{"type": "histogram"}).(*Histogram)
+				Expect(restoredHistogram.Snapshot()).To(Equal(h.Snapshot()))
+				restoredHistogram.Observe(2)
+				Expect(restoredHistogram.Snapshot().Count).To(Equal(uint64(5)))
+			})
+			It("Then the index should work for Filter", func() {
+				Expect(restored.Filter(Key{"kind": "plain"})).To(HaveLen(len(values)))
+				Expect(restored.Filter(Key{"type": "int"})).To(ConsistOf(Entry{Key{"type": "int", "kind": "plain"}, -1}))
+			})
+		})
+		Context("When it is restored into a registry that already has entries", func() {
+			It("Then only what was in the snapshot should be left and the caches shouldn't be stale", func() {
+				restored := NewCacheRegistry(10)
+				restored.Set(Key{"type": "int", "kind": "old"}, 1)
+				restored.Set(Key{"type": "counter"}, "old")
+				Expect(restored.Filter(Key{"type": "int"})).To(HaveLen(1))
+				Expect(restored.Get(Key{"type": "counter"})).To(Equal("old"))
+				Expect(Restore(restored, snapshot, DefaultCodec)).To(Succeed())
+				Expect(restored.Filter(Key{"type": "int"})).To(ConsistOf(Entry{Key{"type": "int", "kind": "plain"}, -1}))
+				Expect(restored.Get(Key{"type": "counter"})).To(BeAssignableToTypeOf(&Counter{}))
+				Expect(restored.Filter(Key{})).To(HaveLen(len(values) + 4))
+			})
+		})
+		Context("When it is restored into a registry that can't take every entry", func() {
+			It("Then the rest should be restored and the first failure returned", func() {
+				restored := NewLimitedRegistry(NewCacheRegistry(10), Limits{MaxEntries: 3}, LimitReject)
+				err := Restore(restored, snapshot, DefaultCodec)
+				Expect(errors.Is(err, ErrTooManyEntries)).To(BeTrue())
+				Expect(err.Error()).To(HavePrefix("Can't restore map["))
+				Expect(restored.Filter(Key{})).To(HaveLen(3))
+			})
+		})
+		Context("When the snapshot is damaged", func() {
+			It("Then Restore should fail and leave the registry alone", func() {
+				data := snapshot.Bytes()
+				damaged := map[string][]byte{
+					"flipped byte": append(append(append([]byte{}, data[:20]...), data[20]^0xff), data[21:]...),
+					"cut off":      data[:len(data)-10],
+					"empty":        {},
+				}
+				for name, snapshot := range damaged {
+					restored := NewSimpleRegistry()
+					restored.Set(Key{"a": "1"}, 1)
+					Expect(Restore(restored, bytes.NewReader(snapshot), DefaultCodec)).ToNot(Succeed(), name)
+					Expect(restored.Filter(Key{})).To(Equal([]Entry{{Key{"a": "1"}, 1}}), name)
+				}
+			})
+		})
+	})
+	Describe("Given a registry with one entry", func() {
+		var snapshot []byte
+		BeforeEach(func() {
+			r := NewSimpleRegistry()
+			r.Set(Key{"a": "1"}, 5)
+			buffer := &bytes.Buffer{}
+			Expect(Snapshot(r, buffer, DefaultCodec)).To(Succeed())
+			snapshot = buffer.Bytes()
+		})
+		Context("When it is written", func() {
+			It("Then it should follow the documented format", func() {
+				body := []byte("RSNP\x01\x07default\x01")
+				body = append(body, 11, 1, 1, 'a', 1, '1', 3, 'i', 'n', 't', 1, 10)
+				checksum := make([]byte, 4)
+				binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(body))
+				Expect(snapshot).To(Equal(append(body, checksum...)))
+			})
+		})
+		Context("When it is from a different version", func() {
+			It("Then it shouldn't be restored", func() {
+				snapshot[4] = 2
+				err := Restore(NewSimpleRegistry(), bytes.NewReader(snapshot), DefaultCodec)
+				Expect(errors.Is(err, ErrUnsupportedVersion)).To(BeTrue())
+			})
+		})
+		Context("When it isn't a snapshot at all", func() {
+			It("Then it shouldn't be restored", func() {
+				err := Restore(NewSimpleRegistry(), bytes.NewReader([]byte("# TYPE up gauge\nup 1\n")), DefaultCodec)
+				Expect(err).To(Equal(ErrNotASnapshot))
+			})
+		})
+		Context("When it is restored with a different codec", func() {
+			It("Then it shouldn't be restored", func() {
+				err := Restore(NewSimpleRegistry(), bytes.NewReader(snapshot), pointCodec{})
+				Expect(errors.Is(err, ErrCodecMismatch)).To(BeTrue())
+			})
+		})
+	})
+	Describe("Given a value DefaultCodec doesn't know", func() {
+		var r Registry
+		BeforeEach(func() {
+			r = NewBetterRegistry()
+			r.Set(Key{"shape": "point"}, point{1, 2})
+			r.Set(Key{"shape": "size"}, 3)
+		})
+		Context("When it is snapshotted with DefaultCodec", func() {
+			It("Then it should say which value it couldn't encode", func() {
+				err := Snapshot(r, &bytes.Buffer{}, DefaultCodec)
+				Expect(errors.Is(err, ErrUnsupportedValue)).To(BeTrue())
+				Expect(err.Error()).To(ContainSubstring("registry.point"))
+			})
+		})
+		Context("When it is snapshotted with a codec that knows it", func() {
+			It("Then it should be restored", func() {
+				snapshot := &bytes.Buffer{}
+				Expect(Snapshot(r, snapshot, pointCodec{})).To(Succeed())
+				restored := NewBetterRegistry()
+				Expect(Restore(restored, snapshot, pointCodec{})).To(Succeed())
+				Expect(restored.Get(Key{"shape": "point"})).To(Equal(point{1, 2}))
+				Expect(restored.Get(Key{"shape": "size"})).To(Equal(3))
+			})
+		})
+	})
+	Describe("Given values DefaultCodec can't have written", func() {
+		Context("When a bool isn't a single 0 or 1", func() {
+			It("Then it should be corrupt", func() {
+				for _, data := range [][]byte{{2}, {}, {1, 0}} {
+					_, err := DefaultCodec.Decode("bool", data)
+					Expect(errors.Is(err, ErrCorruptData)).To(BeTrue(), "%v", data)
+				}
+				Expect(DefaultCodec.Decode("bool", []byte{0})).To(BeFalse())
+			})
+		})
+		Context("When a number doesn't fit in its type", func() {
+			It("Then it should be corrupt instead of wrapping around", func() {
+				for typ, data := range map[string][]byte{
+					"int8":    appendVarint(nil, 300),
+					"int16":   appendVarint(nil, math.MinInt16-1),
+					"int32":   appendVarint(nil, math.MaxInt32+1),
+					"uint8":   appendUvarint(nil, 256),
+					"uint16":  appendUvarint(nil, math.MaxUint16+1),
+					"uint32":  appendUvarint(nil, math.MaxUint32+1),
+					"float32": appendUvarint(nil, math.MaxUint32+1),
+				} {
+					_, err := DefaultCodec.Decode(typ, data)
+					Expect(errors.Is(err, ErrCorruptData)).To(BeTrue(), typ)
+				}
+				Expect(DefaultCodec.Decode("int8", appendVarint(nil, math.MinInt8))).To(Equal(int8(math.MinInt8)))
+				Expect(DefaultCodec.Decode("uint8", appendUvarint(nil, math.MaxUint8))).To(Equal(uint8(math.MaxUint8)))
+			})
+		})
+		Context("When a histogram's bucket bounds are out of order", func() {
+			It("Then it should be corrupt instead of putting observations in the wrong bucket", func() {
+				_, data, err := DefaultCodec.Encode(NewHistogram([]float64{1, 2}))
+				Expect(err).ToNot(HaveOccurred())
+				unsorted := append(appendFloat64(appendFloat64(appendUvarint(nil, 2), 2), 1), data[17:]...)
+				_, err = DefaultCodec.Decode("histogram", unsorted)
+				Expect(errors.Is(err, ErrCorruptData)).To(BeTrue())
+				_, err = DefaultCodec.Decode("histogram", data)
+				Expect(err).ToNot(HaveOccurred())
+			})
+		})
+	})
+})
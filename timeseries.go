@@ -0,0 +1,286 @@
+package registry
+
+import (
+	"errors"
+	"time"
+)
+
+/*
+
+	A Registry only keeps the last value Set for a Key. TimeSeriesRegistry keeps a history
+	instead: every Set adds a timestamped Sample to a ring buffer for the Key, and Query
+	returns the samples in a time range for every entry a Filter Key matches. Get and Filter
+	still return the latest value, so it can be used anywhere a Registry is.
+
+	The ring buffers are stored in another registry, which does the indexing, so Query is as
+	fast at finding entries as Filter on the registry it wraps. Retention caps how many
+	samples each Key keeps and how old they can get. The oldest samples are dropped when a
+	new one is added, and samples past MaxAge are never returned even if they haven't been
+	dropped yet. A sample older than the latest one for its Key is refused, whether it comes
+	from Append or from a Set after an Append with a later time, so every ring stays in time
+	order and latest is always the newest.
+
+	Like the other registries it doesn't lock on its own. Anything in the wrapped registry that
+	isn't a ring buffer wasn't put there by TimeSeriesRegistry, so Get, Filter and Query act
+	like it isn't there and the next Set for its Key replaces it.
+
+*/
+
+var (
+	sampleOutOfOrder = errors.New("Sample is older than the latest sample for the Key")
+)
+
+// Retention is how much history a TimeSeriesRegistry keeps for each Key. Zero means no limit
+type Retention struct {
+	MaxSamples int           // How many samples to keep for each Key
+	MaxAge     time.Duration // How long to keep a sample for
+}
+
+// Sample is a value and when it was recorded
+type Sample struct {
+	Time  time.Time
+	Value interface{}
+}
+
+// Series is the samples Query found for a Key, oldest first
+type Series struct {
+	Key     Key
+	Samples []Sample
+}
+
+// TimeSeriesRegistry keeps the recent history of every Key
+type TimeSeriesRegistry struct {
+	registry  Registry // Holds a *sampleRing for every Key
+	retention Retention
+	now       func() time.Time
+}
+
+// NewTimeSeriesRegistry returns a TimeSeriesRegistry that indexes its entries with r, which should be empty
+func NewTimeSeriesRegistry(r Registry, retention Retention) *TimeSeriesRegistry {
+	return &TimeSeriesRegistry{
+		registry:  r,
+		retention: retention,
+		now:       time.Now,
+	}
+}
+
+// Get returns the latest value of the key
+func (t *TimeSeriesRegistry) Get(k Key) interface{} {
+	ring, ok := t.registry.Get(k).(*sampleRing)
+	if !ok {
+		return nil
+	}
+	return ring.latest().Value
+}
+
+// Lookup returns the latest value of the key and whether the key has a history
+func (t *TimeSeriesRegistry) Lookup(k Key) (interface{}, bool) {
+	i, _ := Lookup(t.registry, k)
+	ring, ok := i.(*sampleRing)
+	if !ok {
+		return nil, false
+	}
+	return ring.latest().Value, true
+}
+
+// TryGet returns the latest value of the key or ErrKeyNotFound
+func (t *TimeSeriesRegistry) TryGet(k Key) (interface{}, error) {
+	i, ok := t.Lookup(k)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return i, nil
+}
+
+// Filter returns a list of entries that contain the key with their latest values
+func (t *TimeSeriesRegistry) Filter(k Key) []Entry {
+	entries := []Entry{}
+	for _, entry := range t.registry.Filter(k) {
+		ring, ok := entry.Value.(*sampleRing)
+		if !ok {
+			continue
+		}
+		entries = append(entries, Entry{Key: entry.Key, Value: ring.latest().Value})
+	}
+	return entries
+}
+
+// Set adds a sample with the current time to the key's history
+// It is dropped if an Append already added a newer sample, use TrySet to know
+func (t *TimeSeriesRegistry) Set(k Key, i interface{}) {
+	t.TrySet(k, i)
+}
+
+// TrySet adds a sample with the current time to the key's history or says why it couldn't
+func (t *TimeSeriesRegistry) TrySet(k Key, i interface{}) error {
+	now := t.now()
+	return t.add(k, Sample{Time: now, Value: i}, now)
+}
+
+// Update adds a sample with what fn returns for the latest value. old is nil if the key has no history yet
+func (t *TimeSeriesRegistry) Update(k Key, fn func(old interface{}) interface{}) {
+	t.TrySet(k, fn(t.Get(k)))
+}
+
+// GetOrCreate returns the latest value of the key or starts its history with the value from create
+func (t *TimeSeriesRegistry) GetOrCreate(k Key, create func() interface{}) (interface{}, bool) {
+	i, created, _ := t.TryGetOrCreate(k, create)
+	return i, created
+}
+
+// TryGetOrCreate is GetOrCreate but returns why the history couldn't be started
+func (t *TimeSeriesRegistry) TryGetOrCreate(k Key, create func() interface{}) (interface{}, bool, error) {
+	if i, ok := t.Lookup(k); ok {
+		return i, false, nil
+	}
+	i := create()
+	if err := t.TrySet(k, i); err != nil {
+		return nil, false, err
+	}
+	return i, true, nil
+}
+
+// Append adds a sample with its own time to the key's history. It fails if the key already has a newer sample
+func (t *TimeSeriesRegistry) Append(k Key, s Sample) error {
+	return t.add(k, s, t.now())
+}
+
+// add adds the sample to the key's ring buffer unless it would go before the latest one
+func (t *TimeSeriesRegistry) add(k Key, s Sample, now time.Time) error {
+	if ring, ok := t.registry.Get(k).(*sampleRing); ok && s.Time.Before(ring.latest().Time) {
+		return sampleOutOfOrder
+	}
+	ring, err := t.ring(k)
+	if err != nil {
+		return err
+	}
+	ring.add(s, t.retention.MaxSamples)
+	t.dropExpired(ring, now)
+	return nil
+}
+
+// Delete removes the key and all of its history
+func (t *TimeSeriesRegistry) Delete(k Key) {
+	t.registry.Delete(k)
+}
+
+// TryDelete removes the key and all of its history or returns ErrKeyNotFound if there is none
+func (t *TimeSeriesRegistry) TryDelete(k Key) error {
+	return TryDelete(t.registry, k)
+}
+
+// Query returns the samples in [start, end) of every entry that contains the key
+// Entries without any samples in the range are left out
+func (t *TimeSeriesRegistry) Query(k Key, start time.Time, end time.Time) []Series {
+	if t.retention.MaxAge > 0 {
+		if oldest := t.now().Add(-t.retention.MaxAge); start.Before(oldest) {
+			start = oldest
+		}
+	}
+	series := []Series{}
+	for _, entry := range t.registry.Filter(k) {
+		ring, ok := entry.Value.(*sampleRing)
+		if !ok {
+			continue
+		}
+		samples := ring.between(start, end)
+		if len(samples) == 0 {
+			continue
+		}
+		series = append(series, Series{
+			Key:     entry.Key,
+			Samples: samples,
+		})
+	}
+	return series
+}
+
+// ring returns the key's ring buffer, adding an empty one if there isn't one yet
+// It fails if the wrapped registry won't store the new one
+func (t *TimeSeriesRegistry) ring(k Key) (*sampleRing, error) {
+	if ring, ok := t.registry.Get(k).(*sampleRing); ok {
+		return ring, nil
+	}
+	ring := &sampleRing{}
+	if err := TrySet(t.registry, k, ring); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// dropExpired removes samples past MaxAge but always keeps the latest so Get has something to return
+func (t *TimeSeriesRegistry) dropExpired(ring *sampleRing, now time.Time) {
+	if t.retention.MaxAge <= 0 {
+		return
+	}
+	oldest := now.Add(-t.retention.MaxAge)
+	for ring.count > 1 && ring.at(0).Time.Before(oldest) {
+		ring.dropOldest()
+	}
+}
+
+// sampleRing is a ring buffer of samples in time order. It grows until it reaches the max
+// and from then on every new sample overwrites the oldest one
+type sampleRing struct {
+	samples []Sample
+	start   int // Index of the oldest sample
+	count   int
+}
+
+func (r *sampleRing) add(s Sample, max int) {
+	if r.count == len(r.samples) && (max <= 0 || r.count < max) {
+		r.grow(max)
+	}
+	if r.count == len(r.samples) {
+		// Full, so the oldest sample makes room
+		r.samples[r.start] = s
+		r.start = (r.start + 1) % len(r.samples)
+		return
+	}
+	r.samples[(r.start+r.count)%len(r.samples)] = s
+	r.count++
+}
+
+// grow doubles the buffer, but not past max, and moves the samples to the front
+func (r *sampleRing) grow(max int) {
+	size := len(r.samples) * 2
+	if size == 0 {
+		size = 4
+	}
+	if max > 0 && size > max {
+		size = max
+	}
+	samples := make([]Sample, size)
+	for i := 0; i < r.count; i++ {
+		samples[i] = r.at(i)
+	}
+	r.samples = samples
+	r.start = 0
+}
+
+// at returns the i'th oldest sample
+func (r *sampleRing) at(i int) Sample {
+	return r.samples[(r.start+i)%len(r.samples)]
+}
+
+func (r *sampleRing) latest() Sample {
+	return r.at(r.count - 1)
+}
+
+func (r *sampleRing) dropOldest() {
+	r.samples[r.start] = Sample{}
+	r.start = (r.start + 1) % len(r.samples)
+	r.count--
+}
+
+// between returns a copy of the samples in [start, end)
+func (r *sampleRing) between(start time.Time, end time.Time) []Sample {
+	samples := []Sample{}
+	for i := 0; i < r.count; i++ {
+		s := r.at(i)
+		if !s.Time.Before(start) && s.Time.Before(end) {
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
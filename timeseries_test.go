@@ -0,0 +1,150 @@
+// +build all unit
+
+package registry
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Time series registry", func() {
+	var t *TimeSeriesRegistry
+	var now time.Time
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	api := Key{"service": "api", "host": "a"}
+	db := Key{"service": "db", "host": "a"}
+
+	// setAt Sets the value as if it was t seconds after start
+	setAt := func(k Key, seconds int, value interface{}) {
+		now = start.Add(time.Duration(seconds) * time.Second)
+		t.Set(k, value)
+	}
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+
+	newTimeSeriesRegistry := func(retention Retention) {
+		t = NewTimeSeriesRegistry(NewCacheRegistry(10), retention)
+		t.now = func() time.Time { return now }
+	}
+
+	Describe("Given a key that was Set a few times", func() {
+		BeforeEach(func() {
+			newTimeSeriesRegistry(Retention{})
+			for i := 0; i < 5; i++ {
+				setAt(api, i, i*10)
+			}
+			setAt(db, 2, "db")
+		})
+		Context("When the key is Get or Filtered", func() {
+			It("Then the latest value should be returned", func() {
+				Expect(t.Get(api)).To(Equal(40))
+				Expect(t.Filter(Key{"host": "a"})).To(ConsistOf(Entry{api, 40}, Entry{db, "db"}))
+			})
+		})
+		Context("When querying a time range", func() {
+			It("Then only samples from the start up to but not including the end should be returned", func() {
+				Expect(t.Query(Key{"service": "api"}, at(1), at(3))).To(Equal([]Series{
+					{Key: api, Samples: []Sample{{at(1), 10}, {at(2), 20}}},
+				}))
+			})
+			It("Then every entry the filter key matches should be returned", func() {
+				Expect(t.Query(Key{"host": "a"}, at(2), at(3))).To(ConsistOf(
+					Series{Key: api, Samples: []Sample{{at(2), 20}}},
+					Series{Key: db, Samples: []Sample{{at(2), "db"}}},
+				))
+			})
+			It("Then entries without samples in the range should be left out", func() {
+				Expect(t.Query(Key{"host": "a"}, at(3), at(10))).To(Equal([]Series{
+					{Key: api, Samples: []Sample{{at(3), 30}, {at(4), 40}}},
+				}))
+			})
+		})
+		Context("When a sample is appended with its own time", func() {
+			It("Then it should fail if it is older than the latest sample", func() {
+				Expect(t.Append(api, Sample{at(10), 100})).To(Succeed())
+				Expect(t.Append(api, Sample{at(9), 90})).To(MatchError(sampleOutOfOrder))
+				Expect(t.Get(api)).To(Equal(100))
+			})
+			It("Then a Set with an older time should be dropped instead of going after it", func() {
+				Expect(t.Append(api, Sample{at(10), 100})).To(Succeed())
+				setAt(api, 5, 50)
+				Expect(t.Get(api)).To(Equal(100))
+				Expect(t.Query(api, at(5), at(11))).To(Equal([]Series{{Key: api, Samples: []Sample{{at(10), 100}}}}))
+			})
+		})
+		Context("When the key is deleted", func() {
+			It("Then its history should go with it", func() {
+				t.Delete(api)
+				Expect(t.Get(api)).To(BeNil())
+				Expect(t.Query(Key{"service": "api"}, at(0), at(10))).To(BeEmpty())
+			})
+		})
+	})
+	Describe("Given a wrapped registry that already holds other values", func() {
+		var r Registry
+		BeforeEach(func() {
+			r = NewCacheRegistry(10)
+			r.Set(db, "not a ring")
+			newTimeSeriesRegistry(Retention{})
+			t.registry = r
+			setAt(api, 1, 10)
+		})
+		Context("When it is Filtered or Queried", func() {
+			It("Then the other values should be left out instead of panicking", func() {
+				Expect(t.Filter(Key{"host": "a"})).To(Equal([]Entry{{api, 10}}))
+				Expect(t.Query(Key{"host": "a"}, at(0), at(10))).To(Equal([]Series{
+					{Key: api, Samples: []Sample{{at(1), 10}}},
+				}))
+				Expect(t.Get(db)).To(BeNil())
+			})
+		})
+		Context("When the Key of another value is Set", func() {
+			It("Then it should be replaced with a history", func() {
+				setAt(db, 2, "db")
+				Expect(t.Get(db)).To(Equal("db"))
+			})
+		})
+	})
+	Describe("Given a limit on the number of samples", func() {
+		BeforeEach(func() {
+			newTimeSeriesRegistry(Retention{MaxSamples: 3})
+		})
+		Context("When more samples are added than the limit", func() {
+			It("Then the oldest ones should be dropped", func() {
+				for i := 0; i < 10; i++ {
+					setAt(api, i, i)
+				}
+				Expect(t.Query(api, at(0), at(100))).To(Equal([]Series{
+					{Key: api, Samples: []Sample{{at(7), 7}, {at(8), 8}, {at(9), 9}}},
+				}))
+			})
+		})
+	})
+	Describe("Given a limit on the age of samples", func() {
+		BeforeEach(func() {
+			newTimeSeriesRegistry(Retention{MaxAge: 5 * time.Second})
+			for i := 0; i < 10; i++ {
+				setAt(api, i, i)
+			}
+		})
+		Context("When a new sample is added", func() {
+			It("Then samples older than the max age should be dropped", func() {
+				Expect(t.Query(api, at(0), at(100))[0].Samples).To(HaveLen(6))
+			})
+		})
+		Context("When time passes without new samples", func() {
+			It("Then old samples shouldn't be returned but the latest value should stay", func() {
+				now = at(12)
+				Expect(t.Query(api, at(0), at(100))).To(Equal([]Series{
+					{Key: api, Samples: []Sample{{at(7), 7}, {at(8), 8}, {at(9), 9}}},
+				}))
+				now = at(100)
+				Expect(t.Query(api, at(0), at(100))).To(BeEmpty())
+				Expect(t.Get(api)).To(Equal(9))
+			})
+		})
+	})
+})
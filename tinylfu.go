@@ -0,0 +1,228 @@
+package registry
+
+import "container/list"
+
+/*
+
+	TinyLFUCache is W-TinyLFU, the policy Caffeine uses. New items go into a small LRU window,
+	one percent of the cache. What falls out of the window has to get into the main cache,
+	which is a segmented LRU: items start in probation and move to protected when they are
+	used again, and protected, eighty percent of the main cache, pushes its oldest back down to
+	probation when it is full.
+
+	When the main cache is full, the item leaving the window only gets in if it has been asked
+	for more often than the oldest item in probation, otherwise it is the one evicted. How often
+	something has been asked for, whether it was cached or not, is kept in a count-min sketch:
+	four rows of small counters, four for every item the cache holds, each picked by a different
+	hash of the item. The estimate is the lowest of the four so collisions can only make it too
+	high, never too low. Every counter is halved once there have been ten times as many Gets as
+	a row is wide, so what was popular a long time ago doesn't stay popular forever.
+
+	The window lets a burst of new items in without the sketch having to know them first, and
+	the admission check keeps a scan of items that are only asked for once from pushing out the
+	ones that are asked for all the time.
+
+	Only Gets count as a use. Updating an item that is already there only replaces its value.
+
+*/
+
+const (
+	sketchDepth      = 4  // How many rows of counters the sketch has
+	sketchWidthRatio = 4  // How many counters a row has for every item the cache holds
+	sketchMaxCount   = 15 // Counters stop here, anything above is just popular
+	sketchResetRatio = 10 // Counters are halved after this many times the width of Gets
+)
+
+// TinyLFUCache is a Cache that only keeps a new item over an old one if it is asked for more often
+type TinyLFUCache struct {
+	items         map[string]*cacheItem // Every item by hash
+	window        *list.List            // New items, most recently used at the front
+	probation     *list.List            // Main items that haven't been used since they got there
+	protected     *list.List            // Main items that were used again
+	windowSize    int                   // Max size of window
+	protectedSize int                   // Max size of protected
+	maxSize       int                   // Max size of cache
+	sketch        *countMinSketch
+	stats         CacheStats
+}
+
+func NewTinyLFUCache(maxSize int) *TinyLFUCache {
+	windowSize := maxSize / 100
+	if windowSize < 1 {
+		windowSize = 1
+	}
+	return &TinyLFUCache{
+		items:         map[string]*cacheItem{},
+		window:        list.New(),
+		probation:     list.New(),
+		protected:     list.New(),
+		windowSize:    windowSize,
+		protectedSize: (maxSize - windowSize) * 4 / 5,
+		maxSize:       maxSize,
+		sketch:        newCountMinSketch(maxSize),
+	}
+}
+
+// GetWithKey gets a value from the cache that matches complete key
+func (c *TinyLFUCache) GetWithKey(k Key) (interface{}, error) {
+	return c.GetWithHash(toHashString(k))
+}
+
+// GetWithHash gets a value from the cache that matches the hashstring. Hit or miss, it counts towards how often it is asked for
+func (c *TinyLFUCache) GetWithHash(h string) (interface{}, error) {
+	c.sketch.add(h)
+	item, ok := c.items[h]
+	c.stats.record(ok)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	if item.list != c.probation {
+		moveToFront(item, item.list)
+		return item.value, nil
+	}
+	moveToFront(item, c.protected)
+	if c.protected.Len() > c.protectedSize {
+		moveToFront(c.protected.Back().Value.(*cacheItem), c.probation)
+	}
+	return item.value, nil
+}
+
+// hitWithHashBytes gets a value the cache has and counts it like GetWithHash without making a string of the hash
+func (c *TinyLFUCache) hitWithHashBytes(h []byte) (interface{}, bool) {
+	item, ok := c.items[string(h)]
+	if !ok {
+		return nil, false
+	}
+	i, err := c.GetWithHash(item.hash)
+	return i, err == nil
+}
+
+// PeekWithHash gets a value from the cache without counting it as a use or in the stats
+func (c *TinyLFUCache) PeekWithHash(h string) (interface{}, error) {
+	if item, ok := c.items[h]; ok {
+		return item.value, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// UpdateWithKey adds a value to the cache. If cache size will be exceed, a value is removed and also returned
+func (c *TinyLFUCache) UpdateWithKey(k Key, i interface{}) (cacheItemRemoved bool, cacheKeyRemoved string, cacheValueRemoved interface{}) {
+	return c.UpdateWithHash(toHashString(k), i)
+}
+
+// UpdateWithHash adds a value to the cache. If cache size will be exceed, either the oldest value in the window
+// or the oldest in probation is removed, whichever is asked for less, and also returned
+func (c *TinyLFUCache) UpdateWithHash(h string, i interface{}) (cacheItemRemoved bool, cacheKeyRemoved string, cacheValueRemoved interface{}) {
+	if item, ok := c.items[h]; ok {
+		item.value = i
+		return false, "", nil
+	}
+	if c.maxSize <= 0 {
+		return true, h, i
+	}
+	item := &cacheItem{hash: h, value: i}
+	c.items[h] = item
+	moveToFront(item, c.window)
+	if c.window.Len() <= c.windowSize {
+		return false, "", nil
+	}
+
+	candidate := c.window.Back().Value.(*cacheItem)
+	if c.probation.Len()+c.protected.Len() < c.maxSize-c.windowSize {
+		moveToFront(candidate, c.probation)
+		return false, "", nil
+	}
+	victims := c.probation
+	if victims.Len() == 0 {
+		victims = c.protected
+	}
+	evicted := candidate
+	if victims.Len() > 0 {
+		victim := victims.Back().Value.(*cacheItem)
+		if c.sketch.estimate(candidate.hash) > c.sketch.estimate(victim.hash) {
+			moveToFront(candidate, c.probation)
+			evicted = victim
+		}
+	}
+	c.RemoveWithHash(evicted.hash)
+	return true, evicted.hash, evicted.value
+}
+
+// Stats returns how many Gets were hits and misses
+func (c *TinyLFUCache) Stats() CacheStats {
+	return c.stats
+}
+
+func (c *TinyLFUCache) RemoveWithHash(h string) {
+	if item, ok := c.items[h]; ok {
+		removeFromList(item)
+		delete(c.items, h)
+	}
+}
+
+// countMinSketch estimates how many times every hash was added in a fixed amount of memory
+type countMinSketch struct {
+	rows      [sketchDepth][]uint8
+	mask      uint64 // The width is a power of two so this picks a column
+	additions int    // Since the counters were last halved
+	resetAt   int
+}
+
+// newCountMinSketch returns a sketch with sketchWidthRatio counters a row for every item in a cache of the size
+func newCountMinSketch(size int) *countMinSketch {
+	width := 16
+	for width < size*sketchWidthRatio {
+		width *= 2
+	}
+	s := &countMinSketch{
+		mask:    uint64(width - 1),
+		resetAt: width * sketchResetRatio,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// add counts the hash once and halves every counter if it is time to
+func (s *countMinSketch) add(h string) {
+	h1, h2 := sketchHashes(h)
+	for i := range s.rows {
+		column := (h1 + uint64(i)*h2) & s.mask
+		if s.rows[i][column] < sketchMaxCount {
+			s.rows[i][column]++
+		}
+	}
+	s.additions++
+	if s.additions < s.resetAt {
+		return
+	}
+	for i := range s.rows {
+		for column := range s.rows[i] {
+			s.rows[i][column] /= 2
+		}
+	}
+	s.additions /= 2
+}
+
+// estimate returns how many times the hash was added, or more if it shares counters with others
+func (s *countMinSketch) estimate(h string) uint8 {
+	h1, h2 := sketchHashes(h)
+	min := uint8(sketchMaxCount)
+	for i := range s.rows {
+		if count := s.rows[i][(h1+uint64(i)*h2)&s.mask]; count < min {
+			min = count
+		}
+	}
+	return min
+}
+
+// sketchHashes splits the 64 bit FNV-1a hash of h into two so every row can have its own hash
+// It runs on every lookup so it hashes in place like keyFingerprint instead of allocating a hash.Hash
+func sketchHashes(h string) (uint64, uint64) {
+	sum := uint64(fnvOffset64)
+	for i := 0; i < len(h); i++ {
+		sum = (sum ^ uint64(h[i])) * fnvPrime64
+	}
+	return sum & 0xffffffff, sum>>32 | 1
+}
@@ -0,0 +1,32 @@
+package registry
+
+/*
+
+	Update and GetOrCreate work on any Registry. If the registry is an Updater the entry is
+	only looked up once, otherwise we fall back to a Get followed by a Set. The fallback is
+	only as atomic as the registry it is called on, which for most of them means not at all.
+	SafeRegistry and ShardedRegistry do both under their lock.
+
+*/
+
+// Update replaces the value at k in r with what fn returns. old is nil if k is not in r yet
+func Update(r Registry, k Key, fn func(old interface{}) interface{}) {
+	if u, ok := r.(Updater); ok {
+		u.Update(k, fn)
+		return
+	}
+	r.Set(k, fn(r.Get(k)))
+}
+
+// GetOrCreate returns the value at k in r or, if there is none, Sets and returns the value from create
+func GetOrCreate(r Registry, k Key, create func() interface{}) (interface{}, bool) {
+	if u, ok := r.(Updater); ok {
+		return u.GetOrCreate(k, create)
+	}
+	if i, ok := Lookup(r, k); ok {
+		return i, false
+	}
+	i := create()
+	r.Set(k, i)
+	return i, true
+}
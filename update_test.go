@@ -0,0 +1,98 @@
+// +build all unit
+
+package registry
+
+import (
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// plainRegistry hides every method except the ones on Registry so the fallbacks get used
+type plainRegistry struct {
+	Registry
+}
+
+var _ = Describe("Update", func() {
+	registries := map[string]func() Registry{
+		"simple":   func() Registry { return NewSimpleRegistry() },
+		"better":   func() Registry { return NewBetterRegistry() },
+		"cached":   func() Registry { return NewCacheRegistry(10) },
+		"safe":     func() Registry { return NewSafeRegistry(NewSimpleRegistry()) },
+		"sharded":  func() Registry { return NewShardedRegistry(4) },
+		"fallback": func() Registry { return plainRegistry{NewSimpleRegistry()} },
+	}
+	increment := func(old interface{}) interface{} {
+		if old == nil {
+			return 1
+		}
+		return old.(int) + 1
+	}
+	for name, newRegistry := range registries {
+		name, newRegistry := name, newRegistry
+		Describe("Given a "+name+" registry", func() {
+			var r Registry
+			k := Key{"a": "1", "b": "2"}
+			BeforeEach(func() {
+				r = newRegistry()
+			})
+			Context("When updating a key that does not exist", func() {
+				It("Then the entry should be created from a nil old value", func() {
+					Update(r, k, increment)
+					Expect(r.Get(k)).To(Equal(1))
+					Expect(r.Filter(Key{"a": "1"})).To(HaveLen(1))
+				})
+			})
+			Context("When updating a key that exists", func() {
+				It("Then the callback should get the old value", func() {
+					r.Set(k, 5)
+					Update(r, k, increment)
+					Expect(r.Get(k)).To(Equal(6))
+					Expect(r.Filter(Key{"a": "1"})).To(HaveLen(1))
+				})
+			})
+			Context("When calling GetOrCreate", func() {
+				It("Then the value should only be created the first time", func() {
+					i, created := GetOrCreate(r, k, func() interface{} { return "first" })
+					Expect(created).To(BeTrue())
+					Expect(i).To(Equal("first"))
+					i, created = GetOrCreate(r, k, func() interface{} { return "second" })
+					Expect(created).To(BeFalse())
+					Expect(i).To(Equal("first"))
+				})
+			})
+			Context("When calling GetOrCreate on a key that holds nil", func() {
+				It("Then the nil should be kept", func() {
+					r.Set(k, nil)
+					i, created := GetOrCreate(r, k, func() interface{} { return "created" })
+					Expect(created).To(BeFalse())
+					Expect(i).To(BeNil())
+					Expect(r.Get(k)).To(BeNil())
+				})
+			})
+		})
+	}
+	Describe("Given a thread safe registry", func() {
+		for name, r := range map[string]Registry{"safe": NewSafeRegistry(NewCacheRegistry(10)), "sharded": NewShardedRegistry(4)} {
+			name, r := name, r
+			Context("When the "+name+" registry is updated from many goroutines", func() {
+				It("Then no updates should be lost", func() {
+					k := Key{"name": "requests"}
+					var wg sync.WaitGroup
+					for w := 0; w < concurrentWorkers; w++ {
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							for i := 0; i < concurrentOperations; i++ {
+								Update(r, k, increment)
+							}
+						}()
+					}
+					wg.Wait()
+					Expect(r.Get(k)).To(Equal(concurrentWorkers * concurrentOperations))
+				})
+			})
+		}
+	})
+})
@@ -0,0 +1,507 @@
+package registry
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+
+	A Snapshot only has what was in the registry when it was taken. WALRegistry wraps a
+	registry and writes every Set and Delete to an append-only log before passing it on, so
+	nothing is lost between snapshots. When it is opened it restores the latest snapshot and
+	replays the log on top of it.
+
+	The log is split into numbered segment files in a directory. A record is:
+
+		length    4 bytes, the size of the payload
+		checksum  4 bytes, CRC-32 (IEEE) of the payload
+		payload   1 byte for the operation, 1 for Set and 2 for Delete, then the entry for a
+		          Set or the Key for a Delete, encoded the same way Snapshot encodes them
+
+	A crash in the middle of a write can leave half a record at the end of the last segment.
+	Replay stops at the first record that is cut off or fails its checksum in the last
+	segment and truncates the segment there, so the next records are appended after the last
+	good one. The same thing anywhere else is real corruption and Open fails. So a write that
+	fails part way is cut off again right away, before anything else is appended after it. If
+	even that fails the segment is closed and every write after fails with ErrWALClosed.
+
+	Compact writes a snapshot named after the first segment it doesn't cover and then removes
+	the older snapshots and segments. If it is interrupted, Open ignores whatever is older
+	than the newest snapshot and cleans it up.
+
+	A change is applied to the registry as soon as its record is in the segment, before the
+	segment is synced, rotated or compacted, so a snapshot always has everything in the
+	segments it replaces. If one of those fails afterwards the change still stands, since
+	replay would apply it anyway, and only the error is returned. Set, Update and Delete can't
+	return errors, so they keep the last one for Err.
+
+	Counters, Gauges and Histograms change without going through Set, so only the snapshots
+	have their latest state. Compact often enough for that to be good enough, or Set them.
+
+*/
+
+const (
+	walRecordSet    byte = 1
+	walRecordDelete byte = 2
+	walHeaderSize        = 8
+
+	// DefaultMaxSegmentBytes is how big a segment gets before a new one is started when WALOptions doesn't say
+	DefaultMaxSegmentBytes = 16 << 20
+
+	segmentPrefix  = "segment-"
+	segmentSuffix  = ".wal"
+	snapshotPrefix = "snapshot-"
+	snapshotSuffix = ".snap"
+)
+
+var (
+	// ErrWALClosed is returned by anything that writes to the log after Close
+	ErrWALClosed = errors.New("WAL is closed")
+)
+
+// WALOptions configures a WALRegistry
+type WALOptions struct {
+	Codec           ValueCodec // How values are written, DefaultCodec if nil
+	MaxSegmentBytes int64      // How big a segment gets before a new one is started, DefaultMaxSegmentBytes if zero
+	CompactAfter    int        // Compact once there are this many segments since the last snapshot, never if zero
+	Sync            bool       // Sync the segment to disk after every record
+}
+
+// WALRegistry logs every Set and Delete to disk before passing it on to the registry it wraps
+type WALRegistry struct {
+	registry     Registry
+	dir          string
+	options      WALOptions
+	segment      segmentFile
+	segmentIndex int
+	segmentBytes int64
+	firstSegment int    // The first segment that isn't in the latest snapshot
+	record       []byte // Reused to build records
+	err          error  // The last error Set, Update or Delete couldn't return, see Err
+}
+
+// segmentFile is what a WALRegistry needs from the *os.File of the current segment
+type segmentFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// OpenWALRegistry restores the snapshot and replays the log in dir into r, which should be empty,
+// and returns r wrapped so every change is logged. dir is created if it doesn't exist
+func OpenWALRegistry(dir string, r Registry, options WALOptions) (*WALRegistry, error) {
+	if options.Codec == nil {
+		options.Codec = DefaultCodec
+	}
+	if options.MaxSegmentBytes <= 0 {
+		options.MaxSegmentBytes = DefaultMaxSegmentBytes
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &WALRegistry{
+		registry: r,
+		dir:      dir,
+		options:  options,
+	}
+	if err := w.replay(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Get returns the value that matches the key exactly
+func (w *WALRegistry) Get(k Key) interface{} {
+	return w.registry.Get(k)
+}
+
+// Lookup returns the value at k and whether there is an entry at k
+func (w *WALRegistry) Lookup(k Key) (interface{}, bool) {
+	return Lookup(w.registry, k)
+}
+
+// TryGet returns the value at k or ErrKeyNotFound
+func (w *WALRegistry) TryGet(k Key) (interface{}, error) {
+	return TryGet(w.registry, k)
+}
+
+// Filter returns a list of entries that contain the key
+func (w *WALRegistry) Filter(k Key) []Entry {
+	return w.registry.Filter(k)
+}
+
+// FilterMatchers returns a list of entries whose Key satisfies all the matchers
+func (w *WALRegistry) FilterMatchers(ms ...Matcher) []Entry {
+	return FilterMatchers(w.registry, ms...)
+}
+
+// Set logs and then replaces or creates new entry with key and value. Use TrySet or Err to know if it was logged
+func (w *WALRegistry) Set(k Key, i interface{}) {
+	w.keep(w.TrySet(k, i))
+}
+
+// TrySet logs and then replaces or creates new entry with key and value. Nothing changes if it can't be logged,
+// but once it is the entry is set even if syncing, rotating or compacting the log after fails
+func (w *WALRegistry) TrySet(k Key, i interface{}) error {
+	record, err := appendEntry(w.newRecord(walRecordSet), k, i, w.options.Codec)
+	if err != nil {
+		return err
+	}
+	if err := w.write(record); err != nil {
+		return err
+	}
+	if err := TrySet(w.registry, k, i); err != nil {
+		return err
+	}
+	return w.housekeep()
+}
+
+// Update replaces the value at k with what fn returns and logs it as a Set. Use Err to know if it was logged
+func (w *WALRegistry) Update(k Key, fn func(old interface{}) interface{}) {
+	w.keep(w.TrySet(k, fn(w.registry.Get(k))))
+}
+
+// GetOrCreate returns the value at k or Sets the value from create, which is logged
+// It returns nil, false if the value couldn't be logged. Use TryGetOrCreate to know why
+func (w *WALRegistry) GetOrCreate(k Key, create func() interface{}) (interface{}, bool) {
+	i, created, _ := w.TryGetOrCreate(k, create)
+	return i, created
+}
+
+// TryGetOrCreate is GetOrCreate but returns why the value from create couldn't be logged
+func (w *WALRegistry) TryGetOrCreate(k Key, create func() interface{}) (interface{}, bool, error) {
+	if i, ok := Lookup(w.registry, k); ok {
+		return i, false, nil
+	}
+	i := create()
+	if err := w.TrySet(k, i); err != nil {
+		if _, ok := Lookup(w.registry, k); !ok {
+			return nil, false, err
+		}
+		return i, true, err
+	}
+	return i, true, nil
+}
+
+// Delete logs and then removes an entry from the registry. Use TryDelete or Err to know if it was logged
+func (w *WALRegistry) Delete(k Key) {
+	if err := w.TryDelete(k); err != ErrKeyNotFound {
+		w.keep(err)
+	}
+}
+
+// TryDelete logs and then removes an entry from the registry. Keys that aren't there aren't logged
+// Once it is logged the entry is removed even if syncing, rotating or compacting the log after fails
+func (w *WALRegistry) TryDelete(k Key) error {
+	if _, ok := Lookup(w.registry, k); !ok {
+		return ErrKeyNotFound
+	}
+	if err := w.write(appendKey(w.newRecord(walRecordDelete), k)); err != nil {
+		return err
+	}
+	if err := TryDelete(w.registry, k); err != nil {
+		return err
+	}
+	return w.housekeep()
+}
+
+// Err returns the last error Set, Update or Delete couldn't return and forgets it
+func (w *WALRegistry) Err() error {
+	err := w.err
+	w.err = nil
+	return err
+}
+
+// keep holds on to an error for Err
+func (w *WALRegistry) keep(err error) {
+	if err != nil {
+		w.err = err
+	}
+}
+
+// Compact writes a snapshot of the registry and removes the segments it replaces
+func (w *WALRegistry) Compact() error {
+	if w.segment == nil {
+		return ErrWALClosed
+	}
+	if w.segmentBytes > 0 {
+		if err := w.openSegment(w.segmentIndex + 1); err != nil {
+			return err
+		}
+	}
+	first := w.segmentIndex
+	path := w.path(snapshotPrefix, first, snapshotSuffix)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = Snapshot(w.registry, f, w.options.Codec)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	w.firstSegment = first
+	return w.removeBefore(first)
+}
+
+// Close closes the current segment. The WALRegistry can't be written to after
+func (w *WALRegistry) Close() error {
+	if w.segment == nil {
+		return ErrWALClosed
+	}
+	err := w.segment.Close()
+	w.segment = nil
+	return err
+}
+
+// newRecord starts a record in the reused buffer with room for the header
+func (w *WALRegistry) newRecord(op byte) []byte {
+	record := append(w.record[:0], make([]byte, walHeaderSize)...)
+	return append(record, op)
+}
+
+// write fills in the header of the record and appends it to the current segment
+// Once it returns nil the record is in the log and replay will apply it
+func (w *WALRegistry) write(record []byte) error {
+	w.record = record
+	if w.segment == nil {
+		return ErrWALClosed
+	}
+	payload := record[walHeaderSize:]
+	binary.BigEndian.PutUint32(record[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	if _, err := w.segment.Write(record); err != nil {
+		// Whatever part of the record made it would stop replay before every record after it
+		if truncateErr := w.segment.Truncate(w.segmentBytes); truncateErr != nil {
+			w.segment.Close()
+			w.segment = nil
+			return fmt.Errorf("%w: segment %d couldn't be cut back to %d bytes after %v: %v",
+				ErrWALClosed, w.segmentIndex, w.segmentBytes, err, truncateErr)
+		}
+		return err
+	}
+	w.segmentBytes += int64(len(record))
+	return nil
+}
+
+// housekeep syncs the segment, starts a new one when it is full and compacts when there are enough
+// It runs after the last record was applied to the registry so a compaction has it in its snapshot
+func (w *WALRegistry) housekeep() error {
+	if w.options.Sync {
+		if err := w.segment.Sync(); err != nil {
+			return err
+		}
+	}
+	if w.segmentBytes < w.options.MaxSegmentBytes {
+		return nil
+	}
+	if err := w.openSegment(w.segmentIndex + 1); err != nil {
+		return err
+	}
+	if w.options.CompactAfter > 0 && w.segmentIndex-w.firstSegment >= w.options.CompactAfter {
+		return w.Compact()
+	}
+	return nil
+}
+
+// openSegment closes the current segment and opens the one with the index for appending
+func (w *WALRegistry) openSegment(index int) error {
+	if w.segment != nil {
+		if err := w.segment.Close(); err != nil {
+			return err
+		}
+		w.segment = nil
+	}
+	f, err := os.OpenFile(w.path(segmentPrefix, index, segmentSuffix), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.segment = f
+	w.segmentIndex = index
+	w.segmentBytes = info.Size()
+	return nil
+}
+
+// replay restores the newest snapshot, replays every segment after it and opens the last segment for appending
+func (w *WALRegistry) replay() error {
+	snapshots, segments, err := w.files()
+	if err != nil {
+		return err
+	}
+	if len(snapshots) > 0 {
+		w.firstSegment = snapshots[len(snapshots)-1]
+		if err := w.restore(w.firstSegment); err != nil {
+			return err
+		}
+	}
+	last := w.firstSegment
+	for i, index := range segments {
+		if index < w.firstSegment {
+			continue
+		}
+		if err := w.replaySegment(index, i == len(segments)-1); err != nil {
+			return err
+		}
+		last = index
+	}
+	if err := w.removeBefore(w.firstSegment); err != nil {
+		return err
+	}
+	return w.openSegment(last)
+}
+
+func (w *WALRegistry) restore(index int) error {
+	f, err := os.Open(w.path(snapshotPrefix, index, snapshotSuffix))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := Restore(w.registry, f, w.options.Codec); err != nil {
+		return fmt.Errorf("Can't restore snapshot %d: %w", index, err)
+	}
+	return nil
+}
+
+// replaySegment applies every record in the segment. A bad record at the end of the last segment
+// is a write that didn't finish, so the segment is truncated there
+func (w *WALRegistry) replaySegment(index int, last bool) error {
+	path := w.path(segmentPrefix, index, segmentSuffix)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for offset := 0; offset < len(data); {
+		payload, n, err := readWALRecord(data[offset:])
+		if err != nil {
+			if last {
+				return os.Truncate(path, int64(offset))
+			}
+			return fmt.Errorf("WAL segment %d at byte %d: %w", index, offset, err)
+		}
+		if err := w.apply(payload); err != nil {
+			return fmt.Errorf("WAL segment %d at byte %d: %w", index, offset, err)
+		}
+		offset += n
+	}
+	return nil
+}
+
+// readWALRecord returns the payload of the record at the start of data and the size of the whole record
+func readWALRecord(data []byte) ([]byte, int, error) {
+	if len(data) < walHeaderSize {
+		return nil, 0, fmt.Errorf("Record header is cut off: %w", ErrCorruptData)
+	}
+	length := binary.BigEndian.Uint32(data)
+	if uint64(length) > uint64(len(data)-walHeaderSize) {
+		return nil, 0, fmt.Errorf("Record is cut off: %w", ErrCorruptData)
+	}
+	payload := data[walHeaderSize : walHeaderSize+int(length)]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[4:]) {
+		return nil, 0, fmt.Errorf("Record checksum doesn't match: %w", ErrCorruptData)
+	}
+	return payload, walHeaderSize + int(length), nil
+}
+
+// apply makes the change in the payload to the registry without logging it again
+func (w *WALRegistry) apply(payload []byte) error {
+	if len(payload) == 0 {
+		return ErrCorruptData
+	}
+	switch payload[0] {
+	case walRecordSet:
+		e, err := decodeEntry(payload[1:], w.options.Codec)
+		if err != nil {
+			return err
+		}
+		w.registry.Set(e.Key, e.Value)
+		return nil
+	case walRecordDelete:
+		d := &decoder{data: payload[1:]}
+		k := d.key()
+		if d.err != nil || len(d.data) != 0 {
+			return ErrCorruptData
+		}
+		w.registry.Delete(k)
+		return nil
+	}
+	return fmt.Errorf("Unknown record type %d: %w", payload[0], ErrCorruptData)
+}
+
+// files returns the indexes of the snapshots and segments in the directory, both sorted
+func (w *WALRegistry) files() ([]int, []int, error) {
+	dirEntries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshots, segments := []int{}, []int{}
+	for _, dirEntry := range dirEntries {
+		if index, ok := parseIndex(dirEntry.Name(), snapshotPrefix, snapshotSuffix); ok {
+			snapshots = append(snapshots, index)
+		}
+		if index, ok := parseIndex(dirEntry.Name(), segmentPrefix, segmentSuffix); ok {
+			segments = append(segments, index)
+		}
+	}
+	sort.Ints(snapshots)
+	sort.Ints(segments)
+	return snapshots, segments, nil
+}
+
+// removeBefore removes the snapshots and segments older than the segment index
+func (w *WALRegistry) removeBefore(index int) error {
+	snapshots, segments, err := w.files()
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot < index {
+			if err := os.Remove(w.path(snapshotPrefix, snapshot, snapshotSuffix)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, segment := range segments {
+		if segment < index {
+			if err := os.Remove(w.path(segmentPrefix, segment, segmentSuffix)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *WALRegistry) path(prefix string, index int, suffix string) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%s%08d%s", prefix, index, suffix))
+}
+
+func parseIndex(name string, prefix string, suffix string) (int, bool) {
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return 0, false
+	}
+	index, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix))
+	return index, err == nil
+}
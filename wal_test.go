@@ -0,0 +1,300 @@
+// +build all unit
+
+package registry
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// failingSegment writes half of the next record and fails, and can fail to truncate too
+type failingSegment struct {
+	segmentFile
+	failWrite    bool
+	failTruncate bool
+}
+
+func (f *failingSegment) Write(p []byte) (int, error) {
+	if !f.failWrite {
+		return f.segmentFile.Write(p)
+	}
+	f.failWrite = false
+	n, _ := f.segmentFile.Write(p[:len(p)/2])
+	return n, errors.New("Disk is full")
+}
+
+func (f *failingSegment) Truncate(size int64) error {
+	if f.failTruncate {
+		return errors.New("Can't truncate")
+	}
+	return f.segmentFile.Truncate(size)
+}
+
+var _ = Describe("WAL registry", func() {
+	var dir string
+	var w *WALRegistry
+	open := func(options WALOptions) (*WALRegistry, error) {
+		return OpenWALRegistry(dir, NewCacheRegistry(10), options)
+	}
+	reopen := func(options WALOptions) *WALRegistry {
+		Expect(w.Close()).To(Succeed())
+		var err error
+		w, err = open(options)
+		Expect(err).ToNot(HaveOccurred())
+		return w
+	}
+	files := func(pattern string) []string {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		Expect(err).ToNot(HaveOccurred())
+		return matches
+	}
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "wal")
+		Expect(err).ToNot(HaveOccurred())
+		w, err = open(WALOptions{})
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		w.Close()
+		os.RemoveAll(dir)
+	})
+
+	Describe("Given entries that were Set and Deleted", func() {
+		BeforeEach(func() {
+			w.Set(Key{"a": "1"}, 1)
+			w.Set(Key{"a": "1", "b": "2"}, "ab")
+			w.Set(Key{"a": "1"}, 10)
+			w.Set(Key{"c": "3"}, 3.5)
+			w.Delete(Key{"c": "3"})
+		})
+		Context("When the WAL is opened again", func() {
+			It("Then the registry should be as it was", func() {
+				reopen(WALOptions{})
+				Expect(w.Filter(Key{})).To(ConsistOf(
+					Entry{Key{"a": "1"}, 10},
+					Entry{Key{"a": "1", "b": "2"}, "ab"},
+				))
+			})
+		})
+		Context("When the last record was only half written", func() {
+			It("Then replay should stop before it and new records should go after the last good one", func() {
+				segments := files("segment-*.wal")
+				Expect(segments).To(HaveLen(1))
+				info, err := os.Stat(segments[0])
+				Expect(err).ToNot(HaveOccurred())
+				w.Set(Key{"d": "4"}, 4)
+				Expect(w.Close()).To(Succeed())
+				Expect(os.Truncate(segments[0], info.Size()+5)).To(Succeed())
+
+				w, err = open(WALOptions{})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(w.Get(Key{"d": "4"})).To(BeNil())
+				Expect(w.Get(Key{"a": "1"})).To(Equal(10))
+				w.Set(Key{"e": "5"}, 5)
+				reopen(WALOptions{})
+				Expect(w.Get(Key{"e": "5"})).To(Equal(5))
+				Expect(w.Filter(Key{})).To(HaveLen(3))
+			})
+		})
+		Context("When the last record fails its checksum", func() {
+			It("Then replay should drop it", func() {
+				segments := files("segment-*.wal")
+				w.Set(Key{"d": "4"}, 4)
+				Expect(w.Close()).To(Succeed())
+				data, err := os.ReadFile(segments[0])
+				Expect(err).ToNot(HaveOccurred())
+				data[len(data)-1] ^= 0xff
+				Expect(os.WriteFile(segments[0], data, 0644)).To(Succeed())
+
+				w, err = open(WALOptions{})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(w.Get(Key{"d": "4"})).To(BeNil())
+				Expect(w.Filter(Key{})).To(HaveLen(2))
+			})
+		})
+	})
+
+	Describe("Given segments small enough that every record starts a new one", func() {
+		BeforeEach(func() {
+			w = reopen(WALOptions{MaxSegmentBytes: 1})
+			for i := 0; i < 4; i++ {
+				w.Set(Key{"a": "1"}, i)
+			}
+		})
+		Context("When the WAL is opened again", func() {
+			It("Then every segment should be replayed in order", func() {
+				Expect(len(files("segment-*.wal"))).To(BeNumerically(">=", 4))
+				reopen(WALOptions{})
+				Expect(w.Get(Key{"a": "1"})).To(Equal(3))
+			})
+		})
+		Context("When a segment before the last is damaged", func() {
+			It("Then it shouldn't be opened", func() {
+				Expect(w.Close()).To(Succeed())
+				segment := files("segment-*.wal")[1]
+				data, err := os.ReadFile(segment)
+				Expect(err).ToNot(HaveOccurred())
+				data[len(data)-1] ^= 0xff
+				Expect(os.WriteFile(segment, data, 0644)).To(Succeed())
+
+				_, err = open(WALOptions{})
+				Expect(errors.Is(err, ErrCorruptData)).To(BeTrue())
+			})
+		})
+		Context("When it is compacted", func() {
+			It("Then the old segments should be replaced by a snapshot", func() {
+				w.Set(Key{"b": "2"}, NewCounter())
+				w.Get(Key{"b": "2"}).(*Counter).Add(7)
+				Expect(w.Compact()).To(Succeed())
+				Expect(files("snapshot-*.snap")).To(HaveLen(1))
+				Expect(files("segment-*.wal")).To(HaveLen(1))
+				w.Delete(Key{"a": "1"})
+
+				reopen(WALOptions{})
+				Expect(w.Get(Key{"a": "1"})).To(BeNil())
+				Expect(w.Get(Key{"b": "2"}).(*Counter).Value()).To(Equal(uint64(7)))
+			})
+		})
+		Context("When a compaction was interrupted before the old files were removed", func() {
+			It("Then the old files should be ignored and removed", func() {
+				old := map[string][]byte{}
+				for _, segment := range files("segment-*.wal") {
+					data, err := os.ReadFile(segment)
+					Expect(err).ToNot(HaveOccurred())
+					old[segment] = data
+				}
+				w.Set(Key{"a": "1"}, "compacted")
+				Expect(w.Compact()).To(Succeed())
+				Expect(w.Close()).To(Succeed())
+				for segment, data := range old {
+					Expect(os.WriteFile(segment, data, 0644)).To(Succeed())
+				}
+
+				var err error
+				w, err = open(WALOptions{})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(w.Get(Key{"a": "1"})).To(Equal("compacted"))
+				Expect(files("segment-*.wal")).To(HaveLen(1))
+			})
+		})
+	})
+
+	Describe("Given a WAL that compacts after two segments", func() {
+		Context("When enough is written", func() {
+			It("Then it should compact on its own", func() {
+				w = reopen(WALOptions{MaxSegmentBytes: 1, CompactAfter: 2})
+				for i := 0; i < 5; i++ {
+					w.Set(Key{"a": "1"}, i)
+				}
+				Expect(files("snapshot-*.snap")).To(HaveLen(1))
+				Expect(len(files("segment-*.wal"))).To(BeNumerically("<=", 2))
+				reopen(WALOptions{})
+				Expect(w.Get(Key{"a": "1"})).To(Equal(4))
+			})
+		})
+		Context("When the last Set before a reopen is the one that compacts", func() {
+			It("Then its value should be in the snapshot", func() {
+				w = reopen(WALOptions{MaxSegmentBytes: 1, CompactAfter: 2})
+				for i, value := range []string{"a", "b", "c", "x", "y", "z"} {
+					w.Set(Key{"k": strconv.Itoa(i % 3)}, value)
+				}
+				Expect(files("snapshot-*.snap")).ToNot(BeEmpty())
+				reopen(WALOptions{})
+				Expect(w.Filter(Key{})).To(HaveLen(3))
+				Expect(w.Get(Key{"k": "2"})).To(Equal("z"))
+			})
+		})
+	})
+
+	Describe("Given a write that fails part way through a record", func() {
+		BeforeEach(func() {
+			w.Set(Key{"a": "1"}, 1)
+		})
+		Context("When more records are written after it", func() {
+			It("Then they should survive a reopen", func() {
+				w.segment = &failingSegment{segmentFile: w.segment, failWrite: true}
+				Expect(w.TrySet(Key{"b": "2"}, 2)).ToNot(Succeed())
+				Expect(w.TrySet(Key{"c": "3"}, 3)).To(Succeed())
+				w.Delete(Key{"a": "1"})
+				reopen(WALOptions{})
+				Expect(w.Filter(Key{})).To(ConsistOf(Entry{Key{"c": "3"}, 3}))
+			})
+		})
+		Context("When the segment can't be cut back either", func() {
+			It("Then the WAL should close instead of writing after the broken record", func() {
+				w.segment = &failingSegment{segmentFile: w.segment, failWrite: true, failTruncate: true}
+				Expect(errors.Is(w.TrySet(Key{"b": "2"}, 2), ErrWALClosed)).To(BeTrue())
+				Expect(w.TrySet(Key{"c": "3"}, 3)).To(Equal(ErrWALClosed))
+				var err error
+				w, err = open(WALOptions{})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(w.Filter(Key{})).To(ConsistOf(Entry{Key{"a": "1"}, 1}))
+			})
+		})
+	})
+
+	Describe("Given a WAL whose directory is gone", func() {
+		Context("When a Set fills the segment", func() {
+			It("Then it should fail to start a new one but still set the value it logged", func() {
+				w = reopen(WALOptions{MaxSegmentBytes: 1})
+				Expect(os.RemoveAll(dir)).To(Succeed())
+				Expect(w.TrySet(Key{"a": "1"}, 1)).ToNot(Succeed())
+				Expect(w.Get(Key{"a": "1"})).To(Equal(1))
+			})
+		})
+	})
+
+	Describe("Given a value the codec doesn't know", func() {
+		Context("When it is Set", func() {
+			It("Then it should fail and not be written", func() {
+				err := w.TrySet(Key{"shape": "point"}, point{1, 2})
+				Expect(errors.Is(err, ErrUnsupportedValue)).To(BeTrue())
+				Expect(w.Filter(Key{})).To(BeEmpty())
+			})
+		})
+		Context("When it is created", func() {
+			It("Then it shouldn't be reported as created and the error should be returned", func() {
+				i, created := w.GetOrCreate(Key{"shape": "point"}, func() interface{} { return point{1, 2} })
+				Expect(i).To(BeNil())
+				Expect(created).To(BeFalse())
+				_, _, err := w.TryGetOrCreate(Key{"shape": "point"}, func() interface{} { return point{1, 2} })
+				Expect(errors.Is(err, ErrUnsupportedValue)).To(BeTrue())
+				Expect(w.Filter(Key{})).To(BeEmpty())
+			})
+		})
+		Context("When it is Set or Updated", func() {
+			It("Then Err should return the error once", func() {
+				Expect(w.Err()).To(Succeed())
+				w.Set(Key{"shape": "point"}, point{1, 2})
+				Expect(errors.Is(w.Err(), ErrUnsupportedValue)).To(BeTrue())
+				w.Update(Key{"shape": "point"}, func(interface{}) interface{} { return point{1, 2} })
+				Expect(errors.Is(w.Err(), ErrUnsupportedValue)).To(BeTrue())
+				Expect(w.Err()).To(Succeed())
+			})
+		})
+		Context("When the WAL uses a codec that knows it", func() {
+			It("Then it should be replayed", func() {
+				w = reopen(WALOptions{Codec: pointCodec{}})
+				Expect(w.TrySet(Key{"shape": "point"}, point{1, 2})).To(Succeed())
+				reopen(WALOptions{Codec: pointCodec{}})
+				Expect(w.Get(Key{"shape": "point"})).To(Equal(point{1, 2}))
+			})
+		})
+	})
+
+	Describe("Given a closed WAL", func() {
+		Context("When it is written to", func() {
+			It("Then it should fail and leave the registry alone", func() {
+				Expect(w.Close()).To(Succeed())
+				Expect(w.TrySet(Key{"a": "1"}, 1)).To(Equal(ErrWALClosed))
+				Expect(w.Get(Key{"a": "1"})).To(BeNil())
+			})
+		})
+	})
+})
@@ -0,0 +1,185 @@
+package registry
+
+import "container/list"
+
+/*
+
+	The other caches count items, but a filterCache item can hold thousands of entries while a
+	getCache item holds one, so a number of items says nothing about how much memory a cache
+	takes. WeightedLRUCache gives every item a weight from a Weigher and keeps the total under a
+	budget, evicting the least recently used items until it fits. That can take more than one
+	item, which UpdateWithHash can't return, so it is also a WeightedCache whose
+	UpdateAllWithHash returns everything it removed. CachedRegistry uses that when it can.
+
+	An item that weighs more than the whole budget is turned away instead of emptying the cache
+	for it. EntryWeigher and ByteWeigher weigh what CachedRegistry caches. ByteWeigher is an
+	estimate of what the cache itself holds, the entries belong to the registry and are only
+	pointed to.
+
+*/
+
+const (
+	cacheItemBytes   = 128 // The list element, item and map entry for every cached item, roughly
+	cachedEntryBytes = 24  // A pointer to the entry and the hash in its filterCacheKeys
+)
+
+// Weigher says how much a cached value weighs
+type Weigher func(h string, i interface{}) int64
+
+// CacheEviction is an item a cache removed
+type CacheEviction struct {
+	Hash  string
+	Value interface{}
+}
+
+// WeightedCache is a Cache that can remove any number of items when one is added
+type WeightedCache interface {
+	Cache
+	// UpdateAllWithHash adds a value to the cache and returns every item removed to make room for it
+	UpdateAllWithHash(h string, i interface{}) []CacheEviction
+}
+
+// EntryWeigher weighs what CachedRegistry caches by the number of entries, at least one so an empty Filter isn't free
+var EntryWeigher Weigher = func(h string, i interface{}) int64 {
+	if entries, ok := i.(hashEntries); ok && len(entries) > 1 {
+		return int64(len(entries))
+	}
+	return 1
+}
+
+// ByteWeigher estimates how many bytes what CachedRegistry caches takes up in the cache
+var ByteWeigher Weigher = func(h string, i interface{}) int64 {
+	bytes := int64(cacheItemBytes + len(h))
+	if entries, ok := i.(hashEntries); ok {
+		bytes += int64(len(entries)) * cachedEntryBytes
+	}
+	return bytes
+}
+
+// WeightedLRUCache is a Cache that evicts the least recently used items until the weight of what is left is in budget
+type WeightedLRUCache struct {
+	items   map[string]*list.Element // The list element of every item by hash
+	recency *list.List               // weightedItems with the most recently used at the front
+	weigh   Weigher
+	budget  int64 // Max weight of cache
+	weight  int64 // Weight of everything in the cache
+	stats   CacheStats
+}
+
+type weightedItem struct {
+	hash   string
+	value  interface{}
+	weight int64
+}
+
+func NewWeightedLRUCache(budget int64, weigh Weigher) *WeightedLRUCache {
+	return &WeightedLRUCache{
+		items:   map[string]*list.Element{},
+		recency: list.New(),
+		weigh:   weigh,
+		budget:  budget,
+	}
+}
+
+// GetWithKey gets a value from the cache that matches complete key
+func (c *WeightedLRUCache) GetWithKey(k Key) (interface{}, error) {
+	return c.GetWithHash(toHashString(k))
+}
+
+// GetWithHash gets a value from the cache that matches the hashstring and marks it as used
+func (c *WeightedLRUCache) GetWithHash(h string) (interface{}, error) {
+	element, ok := c.items[h]
+	c.stats.record(ok)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	c.recency.MoveToFront(element)
+	return element.Value.(*weightedItem).value, nil
+}
+
+// hitWithHashBytes gets a value the cache has and marks it as used without making a string of the hash
+func (c *WeightedLRUCache) hitWithHashBytes(h []byte) (interface{}, bool) {
+	element, ok := c.items[string(h)]
+	if !ok {
+		return nil, false
+	}
+	i, err := c.GetWithHash(element.Value.(*weightedItem).hash)
+	return i, err == nil
+}
+
+// PeekWithHash gets a value from the cache without marking it as used or counting it in the stats
+func (c *WeightedLRUCache) PeekWithHash(h string) (interface{}, error) {
+	if element, ok := c.items[h]; ok {
+		return element.Value.(*weightedItem).value, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// UpdateWithKey adds a value to the cache. Only the first item removed to make room is returned
+func (c *WeightedLRUCache) UpdateWithKey(k Key, i interface{}) (cacheItemRemoved bool, cacheKeyRemoved string, cacheValueRemoved interface{}) {
+	return c.UpdateWithHash(toHashString(k), i)
+}
+
+// UpdateWithHash adds a value to the cache. Only the first item removed to make room is returned, use UpdateAllWithHash to get all of them
+func (c *WeightedLRUCache) UpdateWithHash(h string, i interface{}) (cacheItemRemoved bool, cacheKeyRemoved string, cacheValueRemoved interface{}) {
+	evictions := c.UpdateAllWithHash(h, i)
+	if len(evictions) == 0 {
+		return false, "", nil
+	}
+	return true, evictions[0].Hash, evictions[0].Value
+}
+
+// UpdateAllWithHash adds a value to the cache and removes the least recently used items until the cache is in budget
+// An item heavier than the budget is removed right away and returned
+func (c *WeightedLRUCache) UpdateAllWithHash(h string, i interface{}) []CacheEviction {
+	weight := c.weigh(h, i)
+	if element, ok := c.items[h]; ok {
+		item := element.Value.(*weightedItem)
+		c.weight += weight - item.weight
+		item.value, item.weight = i, weight
+		c.recency.MoveToFront(element)
+	} else {
+		c.items[h] = c.recency.PushFront(&weightedItem{hash: h, value: i, weight: weight})
+		c.weight += weight
+	}
+	if weight > c.budget {
+		c.RemoveWithHash(h)
+		return []CacheEviction{{Hash: h, Value: i}}
+	}
+	var evictions []CacheEviction
+	for c.weight > c.budget {
+		oldest := c.recency.Back().Value.(*weightedItem)
+		c.RemoveWithHash(oldest.hash)
+		evictions = append(evictions, CacheEviction{Hash: oldest.hash, Value: oldest.value})
+	}
+	return evictions
+}
+
+// Stats returns how many Gets were hits and misses
+func (c *WeightedLRUCache) Stats() CacheStats {
+	return c.stats
+}
+
+// Weight returns the weight of everything in the cache
+func (c *WeightedLRUCache) Weight() int64 {
+	return c.weight
+}
+
+func (c *WeightedLRUCache) RemoveWithHash(h string) {
+	if element, ok := c.items[h]; ok {
+		c.weight -= element.Value.(*weightedItem).weight
+		c.recency.Remove(element)
+		delete(c.items, h)
+	}
+}
+
+// updateCache adds a value to the cache and returns every item the cache removed for it
+func updateCache(c Cache, h string, i interface{}) []CacheEviction {
+	if w, ok := c.(WeightedCache); ok {
+		return w.UpdateAllWithHash(h, i)
+	}
+	if cacheItemRemoved, cacheKeyRemoved, cacheValueRemoved := c.UpdateWithHash(h, i); cacheItemRemoved {
+		return []CacheEviction{{Hash: cacheKeyRemoved, Value: cacheValueRemoved}}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// +build all unit
+
+package registry
+
+import (
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Weighted cache", func() {
+	// weight is a Weigher for values that are their own weight
+	var weight Weigher = func(h string, i interface{}) int64 {
+		return int64(i.(int))
+	}
+	var c *WeightedLRUCache
+	BeforeEach(func() {
+		c = NewWeightedLRUCache(10, weight)
+		c.UpdateWithHash("a", 3)
+		c.UpdateWithHash("b", 3)
+		c.UpdateWithHash("c", 3)
+	})
+
+	Describe("Given a cache close to its budget", func() {
+		Context("When a heavy item is added", func() {
+			It("Then the least recently used items should be removed until it is in budget", func() {
+				c.GetWithHash("a")
+				evictions := c.UpdateAllWithHash("d", 7)
+				Expect(evictions).To(Equal([]CacheEviction{{"b", 3}, {"c", 3}}))
+				Expect(c.Weight()).To(Equal(int64(10)))
+				Expect(c.PeekWithHash("a")).To(Equal(3))
+			})
+		})
+		Context("When an item heavier than the budget is added", func() {
+			It("Then it should be turned away and everything else kept", func() {
+				Expect(c.UpdateAllWithHash("d", 11)).To(Equal([]CacheEviction{{"d", 11}}))
+				Expect(c.Weight()).To(Equal(int64(9)))
+				Expect(c.items).To(HaveLen(3))
+			})
+		})
+		Context("When an item gets heavier", func() {
+			It("Then its new weight should count", func() {
+				Expect(c.UpdateAllWithHash("a", 4)).To(BeEmpty())
+				Expect(c.Weight()).To(Equal(int64(10)))
+				cacheItemRemoved, cacheKeyRemoved, _ := c.UpdateWithKey(Key{}, 1)
+				Expect(cacheItemRemoved).To(BeTrue())
+				Expect(cacheKeyRemoved).To(Equal("b"))
+			})
+		})
+		Context("When an item is removed", func() {
+			It("Then its weight should be freed", func() {
+				c.RemoveWithHash("a")
+				c.RemoveWithHash("missing")
+				Expect(c.Weight()).To(Equal(int64(6)))
+				_, err := c.GetWithKey(Key{})
+				Expect(err).To(Equal(ErrKeyNotFound))
+				Expect(c.Stats()).To(Equal(CacheStats{Misses: 1}))
+			})
+		})
+	})
+
+	Describe("Given what CachedRegistry caches", func() {
+		entries := hashEntries{{}, {}, {}}
+		Context("When it is weighed by entries", func() {
+			It("Then it should weigh one for every entry and at least one", func() {
+				Expect(EntryWeigher("h", entries)).To(Equal(int64(3)))
+				Expect(EntryWeigher("h", hashEntries{})).To(Equal(int64(1)))
+			})
+		})
+		Context("When it is weighed by bytes", func() {
+			It("Then more entries and longer hashes should weigh more", func() {
+				Expect(ByteWeigher("h", entries)).To(Equal(int64(cacheItemBytes + 1 + 3*cachedEntryBytes)))
+				Expect(ByteWeigher("hh", entries)).To(BeNumerically(">", ByteWeigher("h", entries)))
+			})
+		})
+	})
+
+	Describe("Given a cached registry with a filter budget", func() {
+		var r *CachedRegistry
+		BeforeEach(func() {
+			r = NewCacheRegistry(100, WithFilterCacheBudget(5, EntryWeigher))
+			for i := 0; i < 4; i++ {
+				r.Set(Key{"service": "api", "instance": strconv.Itoa(i)}, i)
+			}
+			r.Set(Key{"service": "web"}, 4)
+			for i := 0; i < 3; i++ {
+				r.Filter(Key{"instance": strconv.Itoa(i)})
+			}
+		})
+		Context("When a Filter with more entries is cached", func() {
+			It("Then as many filters should be evicted as it takes and their entries shouldn't point at them", func() {
+				Expect(r.Filter(Key{"service": "api"})).To(HaveLen(4))
+				Expect(r.Stats().Filter).To(Equal(CacheUsage{Misses: 4, Evictions: 2, Size: 2}))
+				Expect(r.filterKeys).To(HaveLen(2))
+				entry, err := r.registry.Get(Key{"service": "api", "instance": "0"})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(entry.filterCacheKeys).To(Equal([]string{toHashString(Key{"service": "api"})}))
+			})
+		})
+		Context("When a Filter has more entries than the budget", func() {
+			It("Then it should still be returned but not cached", func() {
+				r.Set(Key{"service": "db"}, 5)
+				Expect(r.Filter(Key{})).To(HaveLen(6))
+				Expect(r.Filter(Key{})).To(HaveLen(6))
+				Expect(r.Stats().Filter).To(Equal(CacheUsage{Misses: 5, Evictions: 2, Size: 3}))
+			})
+		})
+		Context("When the get cache has a byte budget too", func() {
+			It("Then Gets should be cached until it runs out", func() {
+				r = NewCacheRegistry(100, WithCacheBudget(3*ByteWeigher(toHashString(Key{"a": "0"}), hashEntries{{}}), ByteWeigher))
+				for i := 0; i < 5; i++ {
+					k := Key{"a": strconv.Itoa(i)}
+					r.Set(k, i)
+					Expect(r.Get(k)).To(Equal(i))
+				}
+				Expect(r.Stats().Get).To(Equal(CacheUsage{Misses: 5, Evictions: 2, Size: 3}))
+			})
+		})
+	})
+})